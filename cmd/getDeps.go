@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+
+	"praktiskt/go-index-dl/dl"
+
+	"github.com/spf13/cobra"
+)
+
+var getDepsCmdConfig = struct {
+	concurrentProcessors int
+	tempDir              string
+	outputDir            string
+	store                string
+	numRetries           int
+	goSumDB              string
+	rateLimit            rateLimitConfig
+	private              privateConfig
+}{}
+
+var getDepsCmd = &cobra.Command{
+	Use:   "deps [path...]",
+	Short: "Get the dependencies of a project from proxy.golang.org",
+	Long: `This command reads the module versions a project depends on from go.mod,
+go.sum, go.work and go.work.sum files, or directories containing them, and
+downloads exactly those versions. Requirements of the downloaded modules are not
+followed, since go.sum already lists everything the go command needs.
+
+Module versions which are missing upstream are printed to stdout, one
+path@version per line, and make the command exit with status 1.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mods := dl.Modules{}
+		for _, arg := range args {
+			deps, err := dl.ReadDeps(arg)
+			if err != nil {
+				slog.Error("failed to read dependencies", "path", arg, "err", err)
+				os.Exit(1)
+			}
+			mods = append(mods, deps...)
+		}
+		slog.Info("downloading dependencies", "modules", len(mods))
+
+		store := newStore(getDepsCmdConfig.store, getDepsCmdConfig.outputDir)
+		limiter := getDepsCmdConfig.rateLimit.limiter()
+		dlc := dl.NewDownloadClient().
+			WithNumConcurrentProcessors(getDepsCmdConfig.concurrentProcessors).
+			WithOutputDir(getDepsCmdConfig.outputDir).
+			WithStore(store).
+			WithTempDir(getDepsCmdConfig.tempDir).
+			WithRequestCapacity(len(mods)+1).
+			WithPerModuleRetries(getDepsCmdConfig.numRetries).
+			WithSkipMaxTsWrite(true).
+			WithFollowRequirements(false).
+			WithUpstreams(newUpstreams()).
+			WithPrivateModules(getDepsCmdConfig.private.patterns, getDepsCmdConfig.private.vcs()).
+			WithRateLimiter(limiter).
+			WithChecksumDB(newChecksumDB(getDepsCmdConfig.goSumDB, store, limiter))
+		defer dlc.Cleanup()
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+		go dlc.ProcessIncomingDownloadRequests(ctx)
+		dlc.EnqueueBatch(ctx, mods)
+		if err := dlc.AwaitInflight(ctx); err != nil {
+			slog.Error("interrupted", "err", err)
+			os.Exit(1)
+		}
+
+		failed := dlc.FailedModules()
+		missing := []string{}
+		for mod, err := range failed {
+			if dl.IsNotFound(err) {
+				missing = append(missing, mod)
+			}
+		}
+		sort.Strings(missing)
+		for _, mod := range missing {
+			fmt.Println(mod)
+		}
+		slog.Info("done", "modules", len(mods), "missing", len(missing), "failed", len(failed)-len(missing))
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	getCmd.AddCommand(getDepsCmd)
+	getDepsCmd.Flags().IntVarP(&getDepsCmdConfig.concurrentProcessors, "concurrent-processors", "c", 10, "number of concurrent processors processing requests, reducing it will reduce network i/o")
+	getDepsCmd.Flags().IntVar(&getDepsCmdConfig.numRetries, "num-retries", 3, "number of times to retry a module download if it fails")
+	getDepsCmd.Flags().StringVarP(&getDepsCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	getDepsCmd.Flags().StringVar(&getDepsCmdConfig.store, "store", "", storeFlagUsage)
+	getDepsCmd.Flags().StringVar(&getDepsCmdConfig.tempDir, "temp-dir", path.Join(dl.OUTPUT_DIR, "tmp"), "the place to store temporary artifacts in")
+	getDepsCmdConfig.rateLimit.addFlags(getDepsCmd)
+	getDepsCmdConfig.private.addFlags(getDepsCmd)
+	getDepsCmd.Flags().StringVar(&getDepsCmdConfig.goSumDB, "gosumdb", dl.GO_SUMDB, "the checksum database to verify downloads against, e.g. 'sum.golang.org' or '<name>+<hash>+<key> <url>', or 'off' (can also be set with GO_SUMDB)")
+}
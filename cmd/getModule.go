@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"path"
@@ -8,13 +9,23 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/mod/module"
 )
 
 var getModuleCmdConfig = struct {
 	tempDir       string
 	outputDir     string
+	store         string
 	moduleName    string
 	moduleVersion string
+	goSumDB       string
+	skipRetracted bool
+	include       []string
+	exclude       []string
+	rulesFile     string
+	rateLimit     rateLimitConfig
+	private       privateConfig
+	license       licenseConfig
 }{}
 
 var getModuleCmd = &cobra.Command{
@@ -26,15 +37,42 @@ var getModuleCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		store := newStore(getModuleCmdConfig.store, getModuleCmdConfig.outputDir)
+		limiter := getModuleCmdConfig.rateLimit.limiter()
+		filter := newModuleFilter(getModuleCmdConfig.include, getModuleCmdConfig.exclude, getModuleCmdConfig.rulesFile)
+		if !filter.Allows(getModuleCmdConfig.moduleName) {
+			slog.Error("module is excluded by the module filter", "modPath", getModuleCmdConfig.moduleName)
+			os.Exit(1)
+		}
+		upstreams := newUpstreams()
+		vcs := getModuleCmdConfig.private.vcs()
 		dlc := dl.NewDownloadClient().
 			WithOutputDir(getModuleCmdConfig.outputDir).
+			WithStore(store).
 			WithTempDir(getModuleCmdConfig.tempDir).
-			WithSkipMaxTsWrite(true)
+			WithSkipMaxTsWrite(true).
+			WithSkipRetracted(getModuleCmdConfig.skipRetracted).
+			WithLicensePolicy(getModuleCmdConfig.license.policy()).
+			WithChecksumDB(newChecksumDB(getModuleCmdConfig.goSumDB, store, limiter)).
+			WithModuleFilter(filter).
+			WithUpstreams(upstreams).
+			WithPrivateModules(getModuleCmdConfig.private.patterns, vcs).
+			WithRateLimiter(limiter)
+
+		defer dlc.Cleanup()
 
-		go dlc.ProcessIncomingDownloadRequests()
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+		go dlc.ProcessIncomingDownloadRequests(ctx)
 		mod := dl.Module{Path: getModuleCmdConfig.moduleName, Version: getModuleCmdConfig.moduleVersion}
 		if getModuleCmdConfig.moduleVersion == "latest" {
-			modl, err := dl.NewIndexClient(false).GetLatestVersion(getModuleCmdConfig.moduleName)
+			var modl dl.Module
+			var err error
+			if vcs != nil && module.MatchPrefixPatterns(getModuleCmdConfig.private.patterns, getModuleCmdConfig.moduleName) {
+				modl, err = vcs.Latest(ctx, getModuleCmdConfig.moduleName)
+			} else {
+				modl, err = dl.NewIndexClient(false).WithUpstreams(upstreams).WithRateLimiter(limiter).GetLatestVersion(ctx, getModuleCmdConfig.moduleName)
+			}
 			if err != nil {
 				slog.Error("failed to get latest version", "err", err)
 				os.Exit(1)
@@ -42,16 +80,28 @@ var getModuleCmd = &cobra.Command{
 			mod = modl
 		}
 		mods := dl.Modules{mod}
-		dlc.EnqueueBatch(mods)
+		dlc.EnqueueBatch(ctx, mods)
 		time.Sleep(time.Duration(500) * time.Millisecond) // TODO: this solves race condition, but we can do it better
-		dlc.AwaitInflight()
+		if err := dlc.AwaitInflight(ctx); err != nil {
+			slog.Error("interrupted", "err", err)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	getCmd.AddCommand(getModuleCmd)
 	getModuleCmd.Flags().StringVarP(&getModuleCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	getModuleCmd.Flags().StringVar(&getModuleCmdConfig.store, "store", "", storeFlagUsage)
 	getModuleCmd.Flags().StringVar(&getModuleCmdConfig.tempDir, "temp-dir", path.Join(dl.OUTPUT_DIR, "tmp"), "the place to store temporary artifacts in")
 	getModuleCmd.Flags().StringVarP(&getModuleCmdConfig.moduleName, "module-name", "m", "", "the name of the module to download, e.g. golang.org/x/exp")
 	getModuleCmd.Flags().StringVarP(&getModuleCmdConfig.moduleVersion, "module-version", "v", "latest", "the version of the module to download, can be a semver version or 'latest'")
+	getModuleCmd.Flags().StringVar(&getModuleCmdConfig.goSumDB, "gosumdb", dl.GO_SUMDB, "the checksum database to verify downloads against, e.g. 'sum.golang.org' or '<name>+<hash>+<key> <url>', or 'off' (can also be set with GO_SUMDB)")
+	getModuleCmd.Flags().BoolVar(&getModuleCmdConfig.skipRetracted, "skip-retracted", false, "skip the module version if it is retracted, requirements are downloaded regardless")
+	getModuleCmd.Flags().StringArrayVar(&getModuleCmdConfig.include, "include", nil, includeFlagUsage)
+	getModuleCmd.Flags().StringArrayVar(&getModuleCmdConfig.exclude, "exclude", nil, excludeFlagUsage)
+	getModuleCmdConfig.rateLimit.addFlags(getModuleCmd)
+	getModuleCmdConfig.private.addFlags(getModuleCmd)
+	getModuleCmdConfig.license.addFlags(getModuleCmd)
+	getModuleCmd.Flags().StringVar(&getModuleCmdConfig.rulesFile, "rules-file", "", rulesFileFlagUsage)
 }
@@ -1,28 +1,114 @@
 package cmd
 
 import (
-	"fmt"
 	"log/slog"
 	"os"
 	"praktiskt/go-index-dl/dl"
 	"reflect"
+	"regexp"
 
 	"github.com/spf13/cobra"
 )
 
 var listModulesCmdConfig = struct {
-	limit int
+	limit          int
+	stateFile      string
+	vulnDB         string
+	since          string
+	until          string
+	pathPrefixes   []string
+	pathRegexp     string
+	versionClasses []string
+	format         string
+	template       string
 }{}
 
 var listModulesCmd = &cobra.Command{
 	Use:   "modules",
 	Short: "List modules on index.golang.org",
+	Long: `This command lists modules on index.golang.org, as JSON lines by default.
+
+Modules can be selected by index timestamp with --since and --until, by path with
+--path-prefix and --path-regexp, and by version with --version-class.
+
+With --format, modules are written as CSV, a table or with a Go template, e.g.
+--format template --template '{{.Path}}@{{.Version}}'. Templates are given the
+fields Timestamp, Path, Version, Retracted, RetractRationale, Deprecated, Vulns
+and Licenses.
+
+With --state-file, modules are annotated with the retractions, deprecations,
+vulnerabilities and licenses recorded by 'sync modules' in its state store. With --vulndb,
+modules are annotated with the vulnerabilities in a database mirrored by
+'sync vulndb' instead, which is up to date even if the state store is not.
+
+The state store can only be opened by one process at a time, so --state-file fails
+while 'sync modules' is running on it. Use --vulndb for vulnerabilities then, or
+list once the sync has exited.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		query := dl.ModuleQuery{
+			Since:        parseTimestampFlag("since", listModulesCmdConfig.since),
+			Until:        parseTimestampFlag("until", listModulesCmdConfig.until),
+			PathPrefixes: listModulesCmdConfig.pathPrefixes,
+		}
+		if listModulesCmdConfig.pathRegexp != "" {
+			re, err := regexp.Compile(listModulesCmdConfig.pathRegexp)
+			if err != nil {
+				slog.Error("invalid --path-regexp", "err", err)
+				os.Exit(1)
+			}
+			query.PathRegexp = re
+		}
+		for _, s := range listModulesCmdConfig.versionClasses {
+			class, err := dl.ParseVersionClass(s)
+			if err != nil {
+				slog.Error("invalid --version-class", "err", err)
+				os.Exit(1)
+			}
+			query.VersionClasses = append(query.VersionClasses, class)
+		}
+
+		var stateStore *dl.StateStore
+		if listModulesCmdConfig.stateFile != "" {
+			var err error
+			stateStore, err = dl.OpenStateStore(listModulesCmdConfig.stateFile)
+			if err != nil {
+				slog.Error("failed to open state store", "err", err)
+				os.Exit(1)
+			}
+			defer stateStore.Close()
+		}
+
+		var vulnDB *dl.VulnDB
+		if listModulesCmdConfig.vulnDB != "" {
+			var err error
+			vulnDB, err = dl.OpenVulnDB(cmd.Context(), newStore(listModulesCmdConfig.vulnDB, listModulesCmdConfig.vulnDB))
+			if err != nil {
+				slog.Error("failed to open vulnerability database", "err", err)
+				os.Exit(1)
+			}
+		}
+
+		format := listModulesCmdConfig.format
+		if cmd.Flags().Changed("template") && !cmd.Flags().Changed("format") {
+			format = dl.ListFormatTemplate
+		}
+		w, err := dl.NewModuleWriter(os.Stdout, format, listModulesCmdConfig.template, stateStore != nil || vulnDB != nil)
+		if err != nil {
+			slog.Error("failed to set up output", "err", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := w.Flush(); err != nil {
+				slog.Error("failed to write output", "err", err)
+			}
+		}()
+
 		totalMods := 0
 		prevMods := dl.Modules{}
 		scraper := dl.NewIndexClient(false)
-		for totalMods <= listModulesCmdConfig.limit {
-			mods, err := scraper.Scrape(2000)
+		scraper.WithExplicitMaxTs(query.Since)
+		for listModulesCmdConfig.limit < 0 || totalMods <= listModulesCmdConfig.limit {
+			mods, err := scraper.Scrape(cmd.Context(), 2000)
 			scraper.WithExplicitMaxTs(mods.GetMaxTs())
 			if err != nil {
 				slog.Error("failed to scrape", "err", err)
@@ -35,9 +121,34 @@ var listModulesCmd = &cobra.Command{
 			prevMods = mods
 
 			for _, mod := range mods {
-				fmt.Println(mod.AsJSON())
+				if query.Done(mod) {
+					return
+				}
+				if !query.Matches(mod) {
+					continue
+				}
+				annotated := dl.AnnotatedModule{Module: mod}
+				if stateStore != nil {
+					annotated, err = stateStore.Annotate(mod)
+					if err != nil {
+						slog.Error("failed to read state store", "err", err)
+						os.Exit(1)
+					}
+				}
+				if vulnDB != nil {
+					vulns, err := vulnDB.Vulns(cmd.Context(), mod)
+					if err != nil {
+						slog.Error("failed to read vulnerability database", "err", err)
+						os.Exit(1)
+					}
+					annotated.Vulns = dl.VulnIDs(vulns)
+				}
+				if err := w.Write(annotated); err != nil {
+					slog.Error("failed to write output", "err", err)
+					os.Exit(1)
+				}
 				totalMods += 1
-				if totalMods >= listModulesCmdConfig.limit {
+				if listModulesCmdConfig.limit >= 0 && totalMods >= listModulesCmdConfig.limit {
 					return
 				}
 			}
@@ -47,5 +158,14 @@ var listModulesCmd = &cobra.Command{
 
 func init() {
 	listCmd.AddCommand(listModulesCmd)
-	listModulesCmd.Flags().IntVar(&listModulesCmdConfig.limit, "limit", 100, "limit the number of modules listed")
+	listModulesCmd.Flags().IntVar(&listModulesCmdConfig.limit, "limit", 100, "limit the number of modules listed (-1 for no limit)")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.stateFile, "state-file", "", "annotate modules with the retractions, deprecations, vulnerabilities and licenses recorded in this state store")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.vulnDB, "vulndb", "", "annotate modules with the vulnerabilities in the database mirrored to this output directory or store")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.since, "since", "", "only list modules added to the index at or after this RFC 3339 timestamp or date, e.g. 2024-01-31")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.until, "until", "", "only list modules added to the index at or before this RFC 3339 timestamp or date, e.g. 2024-01-31T12:00:00Z")
+	listModulesCmd.Flags().StringArrayVar(&listModulesCmdConfig.pathPrefixes, "path-prefix", nil, "only list module paths starting with this prefix, can be repeated")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.pathRegexp, "path-regexp", "", "only list module paths matching this regular expression")
+	listModulesCmd.Flags().StringArrayVar(&listModulesCmdConfig.versionClasses, "version-class", nil, "only list versions of this class, one of release, prerelease or pseudo, can be repeated")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.format, "format", dl.ListFormatJSONL, "output format, one of jsonl, csv, table or template")
+	listModulesCmd.Flags().StringVar(&listModulesCmdConfig.template, "template", "", "Go template executed for each module with --format template, e.g. '{{.Path}}@{{.Version}}'")
 }
@@ -0,0 +1,13 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var reportCmd = &cobra.Command{
+	Use: "report",
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"praktiskt/go-index-dl/dl"
+
+	"github.com/spf13/cobra"
+)
+
+var reportVulnsCmdConfig = struct {
+	outputDir    string
+	store        string
+	stateFile    string
+	noStateStore bool
+	format       string
+	report       string
+}{}
+
+var reportVulnsCmd = &cobra.Command{
+	Use:   "vulns",
+	Short: "Summarise the exposure of the mirrored modules to vulnerabilities",
+	Long: `This command looks up every module version in the output directory in the
+vulnerability database mirrored by 'sync vulndb', and summarises which versions of
+each module are affected by which vulnerabilities, most affected modules first.
+
+The report is written to --report, stdout by default, as a table or as JSON with
+--format json. The vulnerabilities of every version are recorded in the state
+store as well, if there is one, so 'list modules --state-file' shows them. The
+state store can only be opened by one process at a time, so while 'sync modules'
+is running on it, pass --no-state-store to report without recording.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := newStore(reportVulnsCmdConfig.store, reportVulnsCmdConfig.outputDir)
+		db, err := dl.OpenVulnDB(cmd.Context(), store)
+		if err != nil {
+			slog.Error("failed to open vulnerability database", "err", err)
+			os.Exit(1)
+		}
+
+		stateStore := openExistingStateStore(reportVulnsCmdConfig.stateFile, reportVulnsCmdConfig.outputDir, reportVulnsCmdConfig.noStateStore)
+		if stateStore != nil {
+			defer stateStore.Close()
+		}
+
+		report, err := db.Report(cmd.Context(), store, stateStore)
+		if err != nil {
+			slog.Error("failed to report vulnerabilities", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("reported", "modules", report.Modules, "versions", report.Versions, "vulnerableModules", report.VulnerableModules, "vulnerableVersions", report.VulnerableVersions)
+
+		out := os.Stdout
+		if reportVulnsCmdConfig.report != "-" {
+			f, err := os.Create(reportVulnsCmdConfig.report)
+			if err != nil {
+				slog.Error("failed to create report", "err", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+		switch reportVulnsCmdConfig.format {
+		case "json":
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(report)
+		case "table":
+			err = writeVulnReportTable(out, report)
+		default:
+			err = fmt.Errorf("unknown format %q, must be one of table or json", reportVulnsCmdConfig.format)
+		}
+		if err != nil {
+			slog.Error("failed to write report", "err", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// writeVulnReportTable writes one row per vulnerable module of report.
+func writeVulnReportTable(w io.Writer, report dl.VulnReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tVULNERABLE\tLATEST\tVULNS")
+	for _, e := range report.Exposures {
+		latest := e.LatestVersion
+		if e.LatestVulnerable {
+			latest += " (vulnerable)"
+		}
+		ids := []string{}
+		for _, v := range e.Vulns {
+			ids = append(ids, v.ID)
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%s\n", e.Path, len(e.VulnerableVersions), e.Versions, latest, strings.Join(ids, " "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d of %d modules and %d of %d versions are vulnerable (database modified %s)\n",
+		report.VulnerableModules, report.Modules, report.VulnerableVersions, report.Versions, report.DBModified.Format("2006-01-02"))
+	return err
+}
+
+func init() {
+	reportCmd.AddCommand(reportVulnsCmd)
+	reportVulnsCmd.Flags().StringVarP(&reportVulnsCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	reportVulnsCmd.Flags().StringVar(&reportVulnsCmdConfig.store, "store", "", storeFlagUsage)
+	reportVulnsCmd.Flags().StringVar(&reportVulnsCmdConfig.stateFile, "state-file", "", "the state store to record the vulnerabilities of every version in, used if it exists (default <output-dir>/state.db)")
+	reportVulnsCmd.Flags().BoolVar(&reportVulnsCmdConfig.noStateStore, "no-state-store", false, "do not record the vulnerabilities in the state store, e.g. while 'sync modules' is running on it")
+	reportVulnsCmd.Flags().StringVar(&reportVulnsCmdConfig.format, "format", "table", "report format, one of table or json")
+	reportVulnsCmd.Flags().StringVar(&reportVulnsCmdConfig.report, "report", "-", "where to write the report, '-' for stdout")
+}
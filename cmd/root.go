@@ -1,7 +1,16 @@
 package cmd
 
 import (
+	"context"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"praktiskt/go-index-dl/dl"
 
 	"github.com/spf13/cobra"
 )
@@ -11,11 +20,276 @@ var rootCmd = &cobra.Command{
 	Short: "Download :allthethings: from proxy.golang.org",
 }
 
+// Execute runs the root command. SIGINT and SIGTERM cancel the context passed
+// to the commands, which lets them shut down gracefully.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
 func init() {}
+
+const metricsAddrFlagUsage = "serve Prometheus metrics at http://<addr>/metrics, the rate limits at http://<addr>/ratelimit and the health of the upstream proxies at http://<addr>/upstreams, e.g. ':9090' (disabled by default)"
+
+const storeFlagUsage = "where to store mirrored files, a directory or an URL like s3://bucket/prefix?endpoint=https://minio.example.com&region=eu-north-1 (default <output-dir>, S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)"
+
+// newStore creates the store for mirrored files, which is the output
+// directory unless location is set.
+func newStore(location string, outputDir string) dl.Store {
+	if location == "" {
+		return dl.NewLocalStore(outputDir)
+	}
+	store, err := dl.NewStore(location)
+	if err != nil {
+		slog.Error("failed to set up store", "err", err)
+		os.Exit(1)
+	}
+	return store
+}
+
+// newUpstreams parses GO_PROXY, which is a GOPROXY-style list of proxies to
+// download from.
+func newUpstreams() *dl.Upstreams {
+	upstreams, err := dl.ParseUpstreams(dl.GO_PROXY)
+	if err != nil {
+		slog.Error("failed to parse GO_PROXY", "err", err)
+		os.Exit(1)
+	}
+	return upstreams
+}
+
+// newChecksumDB creates the checksum database to verify downloads against,
+// or nil if verification is turned off. Requests to it are limited by
+// limiter, if set.
+func newChecksumDB(setting string, store dl.Store, limiter *dl.RateLimiter) *dl.ChecksumDB {
+	if setting == "off" {
+		return nil
+	}
+	db, err := dl.NewChecksumDB(setting)
+	if err != nil {
+		slog.Error("failed to set up checksum database", "err", err)
+		os.Exit(1)
+	}
+	if limiter != nil {
+		db.WithRateLimiter(limiter)
+	}
+	return db.WithCache(store, "sumdb")
+}
+
+// newModuleFilter combines the rules in rulesFile with the include and exclude
+// flags, in that order, or returns nil if there are no rules.
+func newModuleFilter(include []string, exclude []string, rulesFile string) *dl.ModuleFilter {
+	rules := []string{}
+	if rulesFile != "" {
+		fileRules, err := dl.LoadModuleFilterRules(rulesFile)
+		if err != nil {
+			slog.Error("failed to read rules file", "err", err)
+			os.Exit(1)
+		}
+		rules = append(rules, fileRules...)
+	}
+	rules = append(rules, include...)
+	for _, rule := range exclude {
+		rules = append(rules, "!"+rule)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	filter, err := dl.NewModuleFilter(rules)
+	if err != nil {
+		slog.Error("failed to set up module filter", "err", err)
+		os.Exit(1)
+	}
+	return filter
+}
+
+// openExistingStateStore opens the state store at stateFile, or at
+// <output-dir>/state.db if it is empty, if there is one and skip is not set.
+// It returns nil otherwise.
+func openExistingStateStore(stateFile string, outputDir string, skip bool) *dl.StateStore {
+	if skip {
+		return nil
+	}
+	if stateFile == "" {
+		stateFile = path.Join(outputDir, "state.db")
+	}
+	if _, err := os.Stat(stateFile); err != nil {
+		return nil
+	}
+	stateStore, err := dl.OpenStateStore(stateFile)
+	if err != nil {
+		slog.Error("failed to open state store", "err", err)
+		os.Exit(1)
+	}
+	return stateStore
+}
+
+// parseTimestampFlag parses the value of a timestamp flag, or returns the zero
+// time if it is empty.
+func parseTimestampFlag(name string, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	ts, err := dl.ParseTimestamp(value)
+	if err != nil {
+		slog.Error("invalid --"+name, "err", err)
+		os.Exit(1)
+	}
+	return ts
+}
+
+const (
+	includeFlagUsage   = "only download module paths matching this glob (e.g. 'github.com/ourorg/**') or regular expression prefixed with 're:', can be repeated"
+	excludeFlagUsage   = "never download module paths matching this glob (e.g. '**/internal-fork') or regular expression prefixed with 're:', can be repeated"
+	rulesFileFlagUsage = "a file with one include rule, or exclude rule prefixed with '!', per line, applied before --include and --exclude with the last matching rule winning"
+)
+
+// serveMetrics serves new metrics at http://<addr>/metrics until ctx is done,
+// together with limiter at http://<addr>/ratelimit which lets the limits be
+// changed at runtime, and the health of upstreams at http://<addr>/upstreams.
+// It returns nil metrics, which discard everything, if addr is empty.
+func serveMetrics(ctx context.Context, addr string, limiter *dl.RateLimiter, upstreams *dl.Upstreams) *dl.Metrics {
+	if addr == "" {
+		return nil
+	}
+	m := dl.NewMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	if limiter != nil {
+		mux.Handle("/ratelimit", limiter)
+	}
+	if upstreams != nil {
+		mux.Handle("/upstreams", upstreams)
+	}
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		slog.Info("serving metrics", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server stopped", "err", err)
+		}
+	}()
+	return m
+}
+
+// rateLimitConfig holds the rate limiting flags of commands downloading from upstream.
+type rateLimitConfig struct {
+	requestsPerSecond     float64
+	bytesPerSecond        float64
+	hostRequestsPerSecond float64
+	hostBytesPerSecond    float64
+}
+
+func (c *rateLimitConfig) addFlags(cmd *cobra.Command) {
+	cmd.Flags().Float64Var(&c.requestsPerSecond, "rate-limit", 0, "max requests per second to upstream in total (0 for unlimited)")
+	cmd.Flags().Float64Var(&c.bytesPerSecond, "bandwidth-limit", 0, "max bytes per second downloaded from upstream in total (0 for unlimited)")
+	cmd.Flags().Float64Var(&c.hostRequestsPerSecond, "host-rate-limit", 0, "max requests per second to each upstream host (0 for unlimited)")
+	cmd.Flags().Float64Var(&c.hostBytesPerSecond, "host-bandwidth-limit", 0, "max bytes per second downloaded from each upstream host (0 for unlimited)")
+}
+
+func (c *rateLimitConfig) limiter() *dl.RateLimiter {
+	return dl.NewRateLimiter(
+		dl.RateLimits{RequestsPerSecond: c.requestsPerSecond, BytesPerSecond: c.bytesPerSecond},
+		dl.RateLimits{RequestsPerSecond: c.hostRequestsPerSecond, BytesPerSecond: c.hostBytesPerSecond},
+	)
+}
+
+// privateConfig holds the flags of commands which build private modules from VCS.
+type privateConfig struct {
+	patterns string
+	repos    string
+}
+
+func (c *privateConfig) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&c.patterns, "private", dl.GO_PRIVATE, "comma-separated module path prefix globs, like GOPRIVATE, of modules built from the git repositories in --private-repos instead of downloaded (can also be set with GO_PRIVATE)")
+	cmd.Flags().StringVar(&c.repos, "private-repos", "", "directory or file:// URL holding the git repositories of private modules, where module example.com/org/repo is in <dir>/example.com/org/repo or <dir>/example.com/org/repo.git")
+}
+
+// vcs returns the source of private modules, or nil if there are none.
+func (c *privateConfig) vcs() *dl.VCSSource {
+	if c.patterns == "" {
+		return nil
+	}
+	if c.repos == "" {
+		slog.Error("--private-repos must be set together with --private")
+		os.Exit(1)
+	}
+	vcs, err := dl.NewVCSSource(c.repos)
+	if err != nil {
+		slog.Error("failed to set up private module repositories", "err", err)
+		os.Exit(1)
+	}
+	return vcs
+}
+
+// licenseConfig holds the license policy flags of commands downloading modules.
+type licenseConfig struct {
+	action        string
+	allow         []string
+	deny          []string
+	minConfidence float64
+}
+
+func (c *licenseConfig) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&c.action, "license-policy", "", "skip or quarantine module versions whose licenses are not allowed, one of skip or quarantine (empty to mirror every license)")
+	cmd.Flags().StringArrayVar(&c.allow, "license-allow", nil, "only allow licenses with this SPDX id, e.g. MIT, can be repeated")
+	cmd.Flags().StringArrayVar(&c.deny, "license-deny", nil, "deny licenses with this SPDX id, e.g. AGPL-3.0, can be repeated")
+	cmd.Flags().Float64Var(&c.minConfidence, "license-min-confidence", 0.75, "the confidence from 0 to 1 below which a license counts as not detected")
+}
+
+// policy returns the license policy, or nil if there is none.
+func (c *licenseConfig) policy() *dl.LicensePolicy {
+	if c.action == "" {
+		return nil
+	}
+	policy, err := dl.NewLicensePolicy(c.action, c.allow, c.deny, c.minConfidence)
+	if err != nil {
+		slog.Error("invalid --license-policy", "err", err)
+		os.Exit(1)
+	}
+	return policy
+}
+
+// newVulnDB opens the vulnerability database mirrored in store, if any,
+// and parses the minimum severity of --skip-vulnerable, which requires it.
+func newVulnDB(ctx context.Context, store dl.Store, skipVulnerable string) (*dl.VulnDB, string) {
+	severity := ""
+	if skipVulnerable != "" {
+		var err error
+		severity, err = dl.ParseMinSeverity(skipVulnerable)
+		if err != nil {
+			slog.Error("invalid --skip-vulnerable", "err", err)
+			os.Exit(1)
+		}
+	}
+	db, err := dl.OpenVulnDB(ctx, store)
+	if err != nil {
+		if skipVulnerable != "" {
+			slog.Error("--skip-vulnerable requires a vulnerability database", "err", err)
+			os.Exit(1)
+		}
+		slog.Debug("not recording vulnerabilities", "err", err)
+		return nil, ""
+	}
+	if severity != "" {
+		// a threshold would skip nothing in a database without severities
+		rated, err := db.Rated(ctx)
+		if err != nil {
+			slog.Error("failed to read vulnerability database", "err", err)
+			os.Exit(1)
+		}
+		if !rated {
+			slog.Error("--skip-vulnerable " + skipVulnerable + " would skip nothing, since the vulnerability database rates no severities, use --skip-vulnerable any instead")
+			os.Exit(1)
+		}
+	}
+	slog.Info("recording vulnerabilities", "dbModified", db.Modified())
+	return db, severity
+}
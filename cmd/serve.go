@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"praktiskt/go-index-dl/dl"
+
+	"github.com/spf13/cobra"
+)
+
+var serveCmdConfig = struct {
+	addr        string
+	outputDir   string
+	store       string
+	tempDir     string
+	pullThrough bool
+	goSumDB     string
+	private     privateConfig
+}{}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the output directory using the GOPROXY protocol",
+	Long: `This command serves a directory populated by 'sync modules' or 'get module'
+using the GOPROXY protocol, see https://go.dev/ref/mod#goproxy-protocol.
+
+Point the go command at it with e.g. GOPROXY=http://localhost:8080.
+
+With --store, the files are served from that store instead, e.g. an S3 bucket
+populated by 'sync modules --store'.
+
+With --pull-through, module versions which are not mirrored yet are fetched from
+GO_PROXY on demand and stored in the output directory. Modules matching --private
+are built from the git repositories in --private-repos instead, so public and
+private modules are served together.
+
+Checksum databases mirrored into the output directory are served under
+/sumdb/<name>/, which the go command uses instead of GOSUMDB when it is pointed
+at this server through GOPROXY.
+
+A vulnerability database mirrored by 'sync vulndb' is served under /vulndb/,
+which govulncheck uses with GOVULNDB=http://<addr>/vulndb.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := newStore(serveCmdConfig.store, serveCmdConfig.outputDir)
+		srv := dl.NewProxyServer().
+			WithStore(store)
+		if serveCmdConfig.pullThrough {
+			dlc := dl.NewDownloadClient().
+				WithOutputDir(serveCmdConfig.outputDir).
+				WithStore(store).
+				WithTempDir(serveCmdConfig.tempDir).
+				WithUpstreams(newUpstreams()).
+				WithPrivateModules(serveCmdConfig.private.patterns, serveCmdConfig.private.vcs()).
+				WithChecksumDB(newChecksumDB(serveCmdConfig.goSumDB, store, nil))
+			defer dlc.Cleanup()
+			srv.WithPullThrough(dlc)
+		}
+
+		server := &http.Server{Addr: serveCmdConfig.addr, Handler: srv}
+		shutdownDone := make(chan struct{})
+		go func() {
+			defer close(shutdownDone)
+			<-cmd.Context().Done()
+			slog.Info("shutting down, waiting for open requests")
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(30)*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("failed to shut down gracefully", "err", err)
+			}
+		}()
+
+		slog.Info("serving", "addr", serveCmdConfig.addr, "outputDir", serveCmdConfig.outputDir)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("server stopped", "err", err)
+			os.Exit(1)
+		}
+		<-shutdownDone
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&serveCmdConfig.addr, "addr", ":8080", "the address to listen on")
+	serveCmd.Flags().StringVarP(&serveCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	serveCmd.Flags().StringVar(&serveCmdConfig.store, "store", "", storeFlagUsage)
+	serveCmd.Flags().StringVar(&serveCmdConfig.tempDir, "temp-dir", path.Join(dl.OUTPUT_DIR, "tmp"), "the place to store temporary artifacts in")
+	serveCmd.Flags().BoolVar(&serveCmdConfig.pullThrough, "pull-through", false, "fetch modules which are not mirrored yet from GO_PROXY on demand")
+	serveCmdConfig.private.addFlags(serveCmd)
+	serveCmd.Flags().StringVar(&serveCmdConfig.goSumDB, "gosumdb", dl.GO_SUMDB, "the checksum database to verify downloads against, e.g. 'sum.golang.org' or '<name>+<hash>+<key> <url>', or 'off' (can also be set with GO_SUMDB)")
+}
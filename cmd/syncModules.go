@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"os"
 	"path"
 	"time"
 
@@ -14,10 +17,27 @@ var syncModulesCmdConfig = struct {
 	concurrentProcessors int
 	batchSize            int
 	outputDir            string
+	store                string
 	tempDir              string
 	numRetries           int
 	skipPseudoVersions   bool
+	skipRetracted        bool
+	skipVulnerable       string
 	exitOnEnd            bool
+	since                string
+	backfillShards       int
+	archiveIndex         bool
+	fromFile             string
+	until                string
+	goSumDB              string
+	stateFile            string
+	include              []string
+	exclude              []string
+	rulesFile            string
+	metricsAddr          string
+	rateLimit            rateLimitConfig
+	license              licenseConfig
+	private              privateConfig
 }{}
 
 var syncModulesCmd = &cobra.Command{
@@ -28,44 +48,248 @@ since there are millions of module+versions.
 
 The command will on each batch completion update a MAX_TS-file in the output directory,
 containing max timestamp of the last successful batch. This timestamp is used to
-determine where to collect modules from.`,
+determine where to collect modules from.
+
+The state of every module version is kept in a state store (<output-dir>/state.db
+by default), so module versions completed in an earlier run are not downloaded again.
+
+With --include, --exclude or --rules-file only matching module paths are downloaded,
+which applies to the requirements of downloaded modules as well.
+
+Retractions and deprecations are read from the go.mod of the latest version of each
+module and recorded in the state store, see 'list modules --state-file'. With
+--skip-retracted, retracted versions are skipped unless they are required by
+another module.
+
+If a vulnerability database has been mirrored with 'sync vulndb', the
+vulnerabilities affecting every module version are recorded in the state store as
+well, see 'list modules --state-file' and 'report vulns'. With --skip-vulnerable,
+versions with vulnerabilities of at least that severity are skipped unless they are
+required by another module. Note that vuln.go.dev does not rate severities, so
+only --skip-vulnerable any skips its vulnerabilities, and the sync refuses to start
+with another severity if no entry of the database is rated. The database is read
+once at startup.
+
+The license files in the root of every downloaded module zip, like LICENSE or
+COPYING, are classified to SPDX ids with a confidence, and recorded in the state
+store. With --license-policy, versions without a license file, with a license which
+is not detected with --license-min-confidence, or with a license which is denied
+by --license-deny or not allowed by --license-allow, are skipped, or stored in
+<output-dir>/quarantine/ where they are not served. This applies to versions
+required by other modules as well.
+
+GO_PROXY can list several proxies like GOPROXY does, e.g.
+GO_PROXY=https://proxy.golang.org,https://artifactory.example.com. After a comma
+the next proxy is only tried if a module is not found, after a pipe on any error.
+With --metrics-addr, the health of every proxy is served at http://<addr>/upstreams.
+Modules matching --private, like requirements of synced modules on internal
+hosts, are built from the git repositories in --private-repos instead.
+
+With --since and/or --until, only the modules added to the index in that window
+are synced, starting at the beginning of the index if --since is not set. The sync
+ends at --until, or at the end of the index, and neither reads nor updates MAX_TS,
+which makes it suitable for backfills and bounded jobs alongside the main sync.
+
+With --backfill-shards, the history from MAX_TS up to now, or the window, is first
+split into that many shards of equal duration, which are scraped and downloaded
+concurrently, each with --concurrent-processors. The cursor of every shard is kept
+in the state store, so an interrupted backfill resumes where each shard was, and
+MAX_TS is advanced as soon as every shard before the cursor has completed. Once
+the backfill is done, the sync continues from MAX_TS as usual.
+
+With --archive-index, the raw index feed is archived in <output-dir>/index, in
+gzipped JSONL segments of one day each, like 2024-01-31.jsonl.gz, together with
+segments.json listing the time range and number of entries of every segment.
+
+With --from-file, the index feed is replayed from disk instead of index.golang.org,
+either from an index archive like <output-dir>/index or from a JSONL file like the
+output of 'list modules', gzipped if its name ends with .gz. Replays use MAX_TS,
+--since, --until and --backfill-shards like syncs from the index do, and exit at
+the end of the feed.
+
+Upstream traffic can be limited with --rate-limit, --bandwidth-limit and their per
+host variants. With --metrics-addr, the limits can be changed while syncing with
+e.g. curl -X PUT -d '{"Global":{"BytesPerSecond":1048576}}' http://<addr>/ratelimit.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if syncModulesCmdConfig.batchSize <= 1 || syncModulesCmdConfig.batchSize > 2000 {
 			slog.Error("batch-size must be between 2 and 2000 inclusive")
 		}
-		dlc := dl.NewDownloadClient().
-			WithNumConcurrentProcessors(syncModulesCmdConfig.concurrentProcessors).
-			WithOutputDir(syncModulesCmdConfig.outputDir).
-			WithTempDir(syncModulesCmdConfig.tempDir).
-			WithRequestCapacity(syncModulesCmdConfig.batchSize).
-			WithSkipPseudoVersions(syncModulesCmdConfig.skipPseudoVersions).
-			WithPerModuleRetries(syncModulesCmdConfig.numRetries)
+		window := dl.ModuleQuery{
+			Since: parseTimestampFlag("since", syncModulesCmdConfig.since),
+			Until: parseTimestampFlag("until", syncModulesCmdConfig.until),
+		}
+		windowed := syncModulesCmdConfig.since != "" || syncModulesCmdConfig.until != ""
+		stateFile := syncModulesCmdConfig.stateFile
+		if stateFile == "" {
+			stateFile = path.Join(syncModulesCmdConfig.outputDir, "state.db")
+		}
+		stateStore, err := dl.OpenStateStore(stateFile)
+		if err != nil {
+			slog.Error("failed to open state store", "err", err)
+			os.Exit(1)
+		}
+		defer stateStore.Close()
+		store := newStore(syncModulesCmdConfig.store, syncModulesCmdConfig.outputDir)
+		limiter := syncModulesCmdConfig.rateLimit.limiter()
+		upstreams := newUpstreams()
+		metrics := serveMetrics(cmd.Context(), syncModulesCmdConfig.metricsAddr, limiter, upstreams)
+
+		checksumDB := newChecksumDB(syncModulesCmdConfig.goSumDB, store, limiter)
+		filter := newModuleFilter(syncModulesCmdConfig.include, syncModulesCmdConfig.exclude, syncModulesCmdConfig.rulesFile)
+		vcs := syncModulesCmdConfig.private.vcs()
+		vulnDB, skipSeverity := newVulnDB(cmd.Context(), store, syncModulesCmdConfig.skipVulnerable)
+		licensePolicy := syncModulesCmdConfig.license.policy()
+		var source dl.IndexSource
+		if syncModulesCmdConfig.fromFile != "" {
+			source, err = dl.OpenFileIndexSource(syncModulesCmdConfig.fromFile)
+			if err != nil {
+				slog.Error("failed to open recorded index feed", "err", err)
+				os.Exit(1)
+			}
+		}
+		var archive *dl.IndexArchive
+		if syncModulesCmdConfig.archiveIndex {
+			archive, err = dl.OpenIndexArchive(path.Join(syncModulesCmdConfig.outputDir, "index"))
+			if err != nil {
+				slog.Error("failed to open index archive", "err", err)
+				os.Exit(1)
+			}
+		}
+		newDownloadClient := func(tempDir string) *dl.DownloadClient {
+			return dl.NewDownloadClient().
+				WithNumConcurrentProcessors(syncModulesCmdConfig.concurrentProcessors).
+				WithOutputDir(syncModulesCmdConfig.outputDir).
+				WithStore(store).
+				WithTempDir(tempDir).
+				WithRequestCapacity(syncModulesCmdConfig.batchSize).
+				WithSkipPseudoVersions(syncModulesCmdConfig.skipPseudoVersions).
+				WithSkipRetracted(syncModulesCmdConfig.skipRetracted).
+				WithVulnDB(vulnDB).
+				WithSkipVulnerable(syncModulesCmdConfig.skipVulnerable != "", skipSeverity).
+				WithLicensePolicy(licensePolicy).
+				WithPerModuleRetries(syncModulesCmdConfig.numRetries).
+				WithChecksumDB(checksumDB).
+				WithStateStore(stateStore).
+				WithModuleFilter(filter).
+				WithUpstreams(upstreams).
+				WithPrivateModules(syncModulesCmdConfig.private.patterns, vcs).
+				WithMetrics(metrics).
+				WithRateLimiter(limiter)
+		}
+		dlc := newDownloadClient(syncModulesCmdConfig.tempDir).WithSkipMaxTsWrite(windowed)
 		defer dlc.Cleanup()
-		go dlc.ProcessIncomingDownloadRequests()
 
-		ind := dl.NewIndexClient(true).
-			WithMaxTsLocation(path.Join(syncModulesCmdConfig.outputDir, "MAX_TS"))
+		ctx, cancel := context.WithCancel(cmd.Context())
+		processorsDone := make(chan struct{})
+		go func() {
+			dlc.ProcessIncomingDownloadRequests(ctx)
+			close(processorsDone)
+		}()
+		defer func() {
+			cancel()
+			<-processorsDone
+		}()
+
+		if syncModulesCmdConfig.backfillShards > 0 {
+			backfill := dl.NewBackfill(stateStore).
+				WithWindow(window.Since, window.Until).
+				WithNumShards(syncModulesCmdConfig.backfillShards).
+				WithBatchSize(syncModulesCmdConfig.batchSize).
+				WithIndexClient(func() *dl.IndexClient {
+					return dl.NewIndexClient(false).WithRateLimiter(limiter).WithArchive(archive).WithSource(source)
+				}).
+				WithDownloadClients(func(shard int) *dl.DownloadClient {
+					return newDownloadClient(path.Join(syncModulesCmdConfig.tempDir, fmt.Sprintf("shard-%d", shard))).WithSkipMaxTsWrite(true)
+				})
+			if !windowed {
+				backfill.WithMaxTsLocation(path.Join(syncModulesCmdConfig.outputDir, "MAX_TS"))
+			}
+			if err := backfill.Run(ctx); err != nil {
+				if ctx.Err() != nil {
+					slog.Info("shutting down, the next run resumes the backfill where each shard was")
+					return
+				}
+				slog.Error("failed to backfill", "err", err)
+				os.Exit(1)
+			}
+			if windowed {
+				return
+			}
+		}
+
+		ind := dl.NewIndexClient(!windowed).
+			WithMaxTsLocation(path.Join(syncModulesCmdConfig.outputDir, "MAX_TS")).
+			WithRateLimiter(limiter).
+			WithArchive(archive).
+			WithSource(source)
+		if windowed {
+			ind.WithExplicitMaxTs(window.Since)
+			slog.Info("syncing window", "since", window.Since, "until", window.Until)
+		} else if err := ind.LoadMaxTsFile(); err == nil {
+			metrics.SetIndexCursor(ind.MaxTs)
+		}
 
-		for {
-			mods, err := ind.Scrape(syncModulesCmdConfig.batchSize)
+		for ctx.Err() == nil {
+			mods, err := ind.Scrape(ctx, syncModulesCmdConfig.batchSize)
 			if err != nil {
 				slog.Error("failed to scrape", "err", err)
 				continue
 			}
+			if windowed {
+				// the window ends at --until or at the end of the index, whichever comes first
+				selected, done := window.Select(mods)
+				done = done || len(mods) < syncModulesCmdConfig.batchSize
+				if len(selected) > 0 {
+					dlc.EnqueueBatch(ctx, selected)
+					if err := dlc.AwaitInflight(ctx); err != nil {
+						break
+					}
+					dlc.Cleanup()
+					slog.Info("finished writing batch", "maxTs", selected.GetMaxTs().String())
+				}
+				if done || mods.GetMaxTs().Equal(ind.MaxTs) {
+					slog.Info("the end of the window has been reached, exiting")
+					break
+				}
+				ind.WithExplicitMaxTs(mods.GetMaxTs())
+				continue
+			}
+			if len(mods) < syncModulesCmdConfig.batchSize && source != nil {
+				// a recorded feed does not grow, so its last batch is synced as well
+				if len(mods) > 0 {
+					dlc.EnqueueBatch(ctx, mods)
+					if err := dlc.AwaitInflight(ctx); err != nil {
+						break
+					}
+					dlc.Cleanup()
+					metrics.SetIndexCursor(mods.GetMaxTs())
+				}
+				slog.Info("the end of the recorded feed has been reached, exiting")
+				break
+			}
 			if len(mods) < syncModulesCmdConfig.batchSize {
 				if syncModulesCmdConfig.exitOnEnd {
 					slog.Info("the end has been reached, exiting")
 					break
 				}
 				slog.Info("very few modules collected, sleeping for 60 seconds before trying again")
-				time.Sleep(time.Duration(60) * time.Second)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Duration(60) * time.Second):
+				}
 				continue
 			}
-			dlc.EnqueueBatch(mods)
-			dlc.AwaitInflight()
+			dlc.EnqueueBatch(ctx, mods)
+			if err := dlc.AwaitInflight(ctx); err != nil {
+				break
+			}
 			dlc.Cleanup()
+			metrics.SetIndexCursor(mods.GetMaxTs())
 			slog.Info("finished writing batch", "maxTs", mods.GetMaxTs().String())
 		}
+		if ctx.Err() != nil {
+			slog.Info("shutting down, the next run resumes from the last finished batch")
+		}
 	},
 }
 
@@ -75,7 +299,24 @@ func init() {
 	syncModulesCmd.Flags().IntVarP(&syncModulesCmdConfig.concurrentProcessors, "concurrent-processors", "c", 10, "number of concurrent processors processing requests, reducing it will reduce network i/o")
 	syncModulesCmd.Flags().IntVar(&syncModulesCmdConfig.numRetries, "num-retries", 10, "number of times to retry a module download if it fails")
 	syncModulesCmd.Flags().StringVarP(&syncModulesCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.store, "store", "", storeFlagUsage)
 	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.tempDir, "temp-dir", path.Join(dl.OUTPUT_DIR, "tmp"), "the place to store temporary artifacts in")
 	syncModulesCmd.Flags().BoolVar(&syncModulesCmdConfig.skipPseudoVersions, "skip-pseudo-versions", true, "skip pseudo versions unless they are required by a non-pseudo-version, see https://go.dev/ref/mod#glos-pseudo-version")
+	syncModulesCmd.Flags().BoolVar(&syncModulesCmdConfig.skipRetracted, "skip-retracted", false, "skip retracted versions unless they are required by another module, see https://go.dev/ref/mod#go-mod-file-retract")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.skipVulnerable, "skip-vulnerable", "", "skip versions with vulnerabilities of at least this severity, one of any, low, moderate, high or critical, unless they are required by another module")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.since, "since", "", "only sync modules added to the index at or after this RFC 3339 timestamp or date, without reading or updating MAX_TS")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.until, "until", "", "only sync modules added to the index at or before this RFC 3339 timestamp or date, and exit once reached, without reading or updating MAX_TS")
+	syncModulesCmd.Flags().IntVar(&syncModulesCmdConfig.backfillShards, "backfill-shards", 0, "first backfill the index history in this many concurrently synced time shards (0 to sync sequentially)")
+	syncModulesCmd.Flags().BoolVar(&syncModulesCmdConfig.archiveIndex, "archive-index", false, "archive the raw index feed in <output-dir>/index")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.fromFile, "from-file", "", "replay the index feed from an index archive directory or a JSONL file instead of index.golang.org")
 	syncModulesCmd.Flags().BoolVar(&syncModulesCmdConfig.exitOnEnd, "exit-on-end", false, "when reaching 'the end' of the current listing, exit the program")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.goSumDB, "gosumdb", dl.GO_SUMDB, "the checksum database to verify downloads against, e.g. 'sum.golang.org' or '<name>+<hash>+<key> <url>', or 'off' (can also be set with GO_SUMDB)")
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.stateFile, "state-file", "", "the state store keeping track of downloaded modules across restarts (default <output-dir>/state.db)")
+	syncModulesCmd.Flags().StringArrayVar(&syncModulesCmdConfig.include, "include", nil, includeFlagUsage)
+	syncModulesCmd.Flags().StringArrayVar(&syncModulesCmdConfig.exclude, "exclude", nil, excludeFlagUsage)
+	syncModulesCmdConfig.rateLimit.addFlags(syncModulesCmd)
+	syncModulesCmdConfig.license.addFlags(syncModulesCmd)
+	syncModulesCmdConfig.private.addFlags(syncModulesCmd)
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.metricsAddr, "metrics-addr", "", metricsAddrFlagUsage)
+	syncModulesCmd.Flags().StringVar(&syncModulesCmdConfig.rulesFile, "rules-file", "", rulesFileFlagUsage)
 }
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+
+	"praktiskt/go-index-dl/dl"
+	"praktiskt/go-index-dl/utils"
+
+	"github.com/spf13/cobra"
+)
+
+var syncSumdbCmdConfig = struct {
+	concurrentProcessors int
+	outputDir            string
+	store                string
+	goSumDB              string
+	rateLimit            rateLimitConfig
+}{}
+
+var syncSumdbCmd = &cobra.Command{
+	Use:   "sumdb",
+	Short: "Mirror the checksum database for all modules in the output directory",
+	Long: `This command looks up every module version in the output directory in the
+checksum database, and mirrors the lookup records and tiles needed to verify
+them into <output-dir>/sumdb/<name>/.
+
+Modules downloaded with checksum verification enabled are mirrored as they are
+downloaded, this command is only needed to backfill older downloads. The mirror
+is served by 'serve' under /sumdb/<name>/, which lets the go command verify
+modules without access to the checksum database.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := newStore(syncSumdbCmdConfig.store, syncSumdbCmdConfig.outputDir)
+		db := newChecksumDB(syncSumdbCmdConfig.goSumDB, store, syncSumdbCmdConfig.rateLimit.limiter())
+		if db == nil {
+			slog.Error("a checksum database is required")
+			os.Exit(1)
+		}
+
+		mods, err := dl.ListStoredModules(cmd.Context(), store)
+		if err != nil {
+			slog.Error("failed to list modules", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("mirroring checksum database", "name", db.Name(), "modules", len(mods))
+
+		ctx := cmd.Context()
+		failed := utils.NewConcurrentCounter[int]()
+		queue := make(chan dl.Module)
+		wg := sync.WaitGroup{}
+		for range syncSumdbCmdConfig.concurrentProcessors {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for mod := range queue {
+					if err := db.Mirror(ctx, mod); err != nil {
+						slog.Error("failed to mirror", "modPath", mod.Path, "modVersion", mod.Version, "err", err)
+						failed.Increment()
+					}
+				}
+			}()
+		}
+		for _, mod := range mods {
+			if ctx.Err() != nil {
+				break
+			}
+			queue <- mod
+		}
+		close(queue)
+		wg.Wait()
+		if ctx.Err() != nil {
+			slog.Error("interrupted", "err", ctx.Err())
+			os.Exit(1)
+		}
+
+		slog.Info("done", "modules", len(mods), "failed", failed.Value())
+		if failed.Value() > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	syncCmd.AddCommand(syncSumdbCmd)
+	syncSumdbCmd.Flags().IntVarP(&syncSumdbCmdConfig.concurrentProcessors, "concurrent-processors", "c", 10, "number of concurrent lookups in the checksum database")
+	syncSumdbCmd.Flags().StringVarP(&syncSumdbCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	syncSumdbCmd.Flags().StringVar(&syncSumdbCmdConfig.store, "store", "", storeFlagUsage)
+	syncSumdbCmd.Flags().StringVar(&syncSumdbCmdConfig.goSumDB, "gosumdb", dl.GO_SUMDB, "the checksum database to mirror, e.g. 'sum.golang.org' or '<name>+<hash>+<key> <url>' (can also be set with GO_SUMDB)")
+	syncSumdbCmdConfig.rateLimit.addFlags(syncSumdbCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+
+	"praktiskt/go-index-dl/dl"
+
+	"github.com/spf13/cobra"
+)
+
+var syncVulndbCmdConfig = struct {
+	concurrentProcessors int
+	outputDir            string
+	store                string
+	vulnDB               string
+	rateLimit            rateLimitConfig
+}{}
+
+var syncVulndbCmd = &cobra.Command{
+	Use:   "vulndb",
+	Short: "Mirror the Go vulnerability database to the output directory",
+	Long: `This command mirrors the Go vulnerability database, see
+https://go.dev/security/vuln/database, into <output-dir>/vulndb/. Only entries
+which are new or modified since the last run are downloaded, and nothing is
+downloaded if the database has not been modified at all.
+
+The mirror is served by 'serve' under /vulndb/, so govulncheck can use it with
+GOVULNDB=http://<addr>/vulndb. It can also be used directly from the output
+directory with GOVULNDB=file:///<absolute-output-dir>/vulndb.
+
+--vulndb can be a directory or file:// URL holding a copy of a database, which
+is useful to move the database to a machine without network access.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := newStore(syncVulndbCmdConfig.store, syncVulndbCmdConfig.outputDir)
+		mirror, err := dl.NewVulnDBMirror(syncVulndbCmdConfig.vulnDB, store)
+		if err != nil {
+			slog.Error("failed to set up vulnerability database", "err", err)
+			os.Exit(1)
+		}
+		mirror.
+			WithNumWorkers(syncVulndbCmdConfig.concurrentProcessors).
+			WithRateLimiter(syncVulndbCmdConfig.rateLimit.limiter())
+
+		report, err := mirror.Sync(cmd.Context())
+		if err != nil {
+			slog.Error("failed to mirror vulnerability database", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("done", "modified", report.Modified, "entries", report.Entries, "updated", report.Updated)
+	},
+}
+
+func init() {
+	syncCmd.AddCommand(syncVulndbCmd)
+	syncVulndbCmd.Flags().IntVarP(&syncVulndbCmdConfig.concurrentProcessors, "concurrent-processors", "c", 10, "number of entries downloaded concurrently")
+	syncVulndbCmd.Flags().StringVarP(&syncVulndbCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	syncVulndbCmd.Flags().StringVar(&syncVulndbCmdConfig.store, "store", "", storeFlagUsage)
+	syncVulndbCmd.Flags().StringVar(&syncVulndbCmdConfig.vulnDB, "vulndb", dl.GO_VULNDB, "the vulnerability database to mirror, an URL or a directory (can also be set with GO_VULNDB)")
+	syncVulndbCmdConfig.rateLimit.addFlags(syncVulndbCmd)
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path"
+
+	"praktiskt/go-index-dl/dl"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyCmdConfig = struct {
+	concurrentProcessors int
+	outputDir            string
+	store                string
+	tempDir              string
+	stateFile            string
+	noStateStore         bool
+	goSumDB              string
+	repair               bool
+	numRetries           int
+	report               string
+	skipRetracted        bool
+	skipVulnerable       string
+	include              []string
+	exclude              []string
+	rulesFile            string
+	rateLimit            rateLimitConfig
+	license              licenseConfig
+	private              privateConfig
+}{}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Audit the output directory, and optionally repair it",
+	Long: `This command walks every module in the output directory and checks that
+every version in its list has a .info, .mod and .zip, that no file is truncated
+or invalid, that zips follow the rules of the go command and match their .mod,
+and that the hashes of .mod and .zip files match their .ziphash, the hashes in
+the state store and, with --gosumdb, the checksum database.
+
+A JSON report of all issues is written to --report, stdout by default. With
+--repair, the broken files are deleted and downloaded again from GO_PROXY, and
+the report records which module versions were repaired. Only the versions with
+issues are downloaded again, and they are subject to the same module filter and
+policies as in 'sync modules', so pass the same --include, --exclude,
+--rules-file, --skip-retracted, --skip-vulnerable, --license-policy and --private
+flags. Versions these reject are reported as failed repairs.
+
+The state store can only be opened by one process at a time, so verify fails
+while 'sync modules' is running on it, unless --no-state-store is set, which skips
+the comparison with recorded hashes.
+
+The command exits with status 1 if any issue was found and not repaired.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := newStore(verifyCmdConfig.store, verifyCmdConfig.outputDir)
+		limiter := verifyCmdConfig.rateLimit.limiter()
+		checksumDB := newChecksumDB(verifyCmdConfig.goSumDB, store, limiter)
+		verifier := dl.NewMirrorVerifier(store).
+			WithNumWorkers(verifyCmdConfig.concurrentProcessors).
+			WithTempDir(verifyCmdConfig.tempDir).
+			WithChecksumDB(checksumDB)
+
+		stateStore := openExistingStateStore(verifyCmdConfig.stateFile, verifyCmdConfig.outputDir, verifyCmdConfig.noStateStore)
+		if stateStore != nil {
+			defer stateStore.Close()
+			verifier.WithStateStore(stateStore)
+		}
+
+		if err := os.MkdirAll(verifyCmdConfig.tempDir, 0o755); err != nil {
+			slog.Error("failed to create temp dir", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("verifying", "outputDir", verifyCmdConfig.outputDir)
+		report, err := verifier.Verify(cmd.Context())
+		if err != nil {
+			slog.Error("failed to verify", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("verified", "modules", report.Modules, "versions", report.Versions, "issues", len(report.Issues))
+
+		if verifyCmdConfig.repair && len(report.Issues) > 0 {
+			vulnDB, skipSeverity := newVulnDB(cmd.Context(), store, verifyCmdConfig.skipVulnerable)
+			dlc := dl.NewDownloadClient().
+				WithNumConcurrentProcessors(verifyCmdConfig.concurrentProcessors).
+				WithOutputDir(verifyCmdConfig.outputDir).
+				WithStore(store).
+				WithTempDir(verifyCmdConfig.tempDir).
+				WithRequestCapacity(len(report.Issues)+1).
+				WithPerModuleRetries(verifyCmdConfig.numRetries).
+				WithSkipMaxTsWrite(true).
+				WithFollowRequirements(false).
+				WithUpstreams(newUpstreams()).
+				WithModuleFilter(newModuleFilter(verifyCmdConfig.include, verifyCmdConfig.exclude, verifyCmdConfig.rulesFile)).
+				WithSkipRetracted(verifyCmdConfig.skipRetracted).
+				WithVulnDB(vulnDB).
+				WithSkipVulnerable(verifyCmdConfig.skipVulnerable != "", skipSeverity).
+				WithLicensePolicy(verifyCmdConfig.license.policy()).
+				WithPrivateModules(verifyCmdConfig.private.patterns, verifyCmdConfig.private.vcs()).
+				WithRateLimiter(limiter).
+				WithChecksumDB(checksumDB)
+			if stateStore != nil {
+				dlc.WithStateStore(stateStore)
+			}
+			defer dlc.Cleanup()
+
+			ctx, cancel := context.WithCancel(cmd.Context())
+			go dlc.ProcessIncomingDownloadRequests(ctx)
+			err := verifier.Repair(ctx, report, dlc)
+			cancel()
+			if err != nil {
+				slog.Error("failed to repair", "err", err)
+				os.Exit(1)
+			}
+			slog.Info("repaired", "repaired", len(report.Repaired), "failed", len(report.RepairFailed))
+		}
+
+		out := os.Stdout
+		if verifyCmdConfig.report != "-" {
+			f, err := os.Create(verifyCmdConfig.report)
+			if err != nil {
+				slog.Error("failed to create report", "err", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			slog.Error("failed to write report", "err", err)
+			os.Exit(1)
+		}
+
+		if len(report.Issues) > 0 && (!verifyCmdConfig.repair || len(report.RepairFailed) > 0) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().IntVarP(&verifyCmdConfig.concurrentProcessors, "concurrent-processors", "c", 10, "number of modules verified, and repaired, concurrently")
+	verifyCmd.Flags().StringVarP(&verifyCmdConfig.outputDir, "output-dir", "o", dl.OUTPUT_DIR, "the absolute or relative path to the output directory (can also be set with OUTPUT_DIR)")
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.store, "store", "", storeFlagUsage)
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.tempDir, "temp-dir", path.Join(dl.OUTPUT_DIR, "tmp"), "the place to store temporary artifacts in")
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.stateFile, "state-file", "", "the state store with the hashes recorded when downloading, used if it exists (default <output-dir>/state.db)")
+	verifyCmd.Flags().BoolVar(&verifyCmdConfig.noStateStore, "no-state-store", false, "do not open the state store, e.g. while 'sync modules' is running on it")
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.goSumDB, "gosumdb", "off", "the checksum database to check hashes against, e.g. 'sum.golang.org' or '<name>+<hash>+<key> <url>', or 'off'")
+	verifyCmd.Flags().BoolVar(&verifyCmdConfig.repair, "repair", false, "delete broken files and download them again")
+	verifyCmd.Flags().IntVar(&verifyCmdConfig.numRetries, "num-retries", 3, "number of times to retry a repair download if it fails")
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.report, "report", "-", "where to write the JSON report, '-' for stdout")
+	verifyCmd.Flags().BoolVar(&verifyCmdConfig.skipRetracted, "skip-retracted", false, "do not repair retracted versions, see 'sync modules --skip-retracted'")
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.skipVulnerable, "skip-vulnerable", "", "do not repair versions with vulnerabilities of at least this severity, see 'sync modules --skip-vulnerable'")
+	verifyCmd.Flags().StringArrayVar(&verifyCmdConfig.include, "include", nil, includeFlagUsage)
+	verifyCmd.Flags().StringArrayVar(&verifyCmdConfig.exclude, "exclude", nil, excludeFlagUsage)
+	verifyCmd.Flags().StringVar(&verifyCmdConfig.rulesFile, "rules-file", "", rulesFileFlagUsage)
+	verifyCmdConfig.rateLimit.addFlags(verifyCmd)
+	verifyCmdConfig.license.addFlags(verifyCmd)
+	verifyCmdConfig.private.addFlags(verifyCmd)
+}
@@ -0,0 +1,235 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveIndexFile  = "segments.json"
+	archiveSegmentExt = ".jsonl.gz"
+
+	// maxSeenSegments bounds the segments of which the entries are kept in
+	// memory to skip entries already archived.
+	maxSeenSegments = 16
+)
+
+// ArchiveSegment is one gzipped JSONL file of an IndexArchive, holding the
+// index entries of one UTC day.
+type ArchiveSegment struct {
+	Name    string
+	Start   time.Time
+	End     time.Time
+	Entries int
+}
+
+// IndexArchive keeps a copy of the raw index feed in segments partitioned by
+// day, like 2024-01-31.jsonl.gz, together with segments.json which lists the
+// time range of every segment. Segments are only ever appended to, as
+// concatenated gzip members, and entries already in a segment are skipped.
+type IndexArchive struct {
+	dir      string
+	mtx      sync.Mutex
+	segments map[string]*ArchiveSegment
+	seen     map[string]map[string]struct{}
+}
+
+// OpenIndexArchive opens, or creates, the archive in dir.
+func OpenIndexArchive(dir string) (*IndexArchive, error) {
+	if err := createDirIfNotExist(dir); err != nil {
+		return nil, err
+	}
+	a := &IndexArchive{dir: dir, segments: map[string]*ArchiveSegment{}, seen: map[string]map[string]struct{}{}}
+	b, err := os.ReadFile(path.Join(dir, archiveIndexFile))
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	segments := []ArchiveSegment{}
+	if err := json.Unmarshal(b, &segments); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", archiveIndexFile, err)
+	}
+	for _, s := range segments {
+		a.segments[s.Name] = &s
+	}
+	return a, nil
+}
+
+// Segments returns the segments of the archive, oldest first.
+func (a *IndexArchive) Segments() []ArchiveSegment {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.sortedSegments()
+}
+
+func (a *IndexArchive) sortedSegments() []ArchiveSegment {
+	segments := []ArchiveSegment{}
+	for _, s := range a.segments {
+		segments = append(segments, *s)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Start.Before(segments[j].Start) })
+	return segments
+}
+
+// SegmentPath returns the path of the segment named name.
+func (a *IndexArchive) SegmentPath(name string) string {
+	return path.Join(a.dir, name)
+}
+
+// Append archives the entries of a response from the index, which is JSONL.
+func (a *IndexArchive) Append(feed []byte) error {
+	bySegment := map[string][]string{}
+	timestamps := map[string]time.Time{}
+	for _, line := range strings.Split(string(feed), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		entry := struct{ Timestamp time.Time }{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			slog.Warn("not archiving invalid index entry", "line", line, "err", err)
+			continue
+		}
+		name := entry.Timestamp.UTC().Format(time.DateOnly) + archiveSegmentExt
+		bySegment[name] = append(bySegment[name], line)
+		timestamps[line] = entry.Timestamp
+	}
+	if len(bySegment) == 0 {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for name, lines := range bySegment {
+		seen, err := a.loadSeen(name)
+		if err != nil {
+			return err
+		}
+		fresh := []string{}
+		for _, line := range lines {
+			if _, ok := seen[line]; !ok {
+				seen[line] = struct{}{}
+				fresh = append(fresh, line)
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		if err := a.appendSegment(name, fresh); err != nil {
+			delete(a.seen, name)
+			return err
+		}
+
+		s, ok := a.segments[name]
+		if !ok {
+			s = &ArchiveSegment{Name: name, Start: timestamps[fresh[0]], End: timestamps[fresh[0]]}
+			a.segments[name] = s
+		}
+		for _, line := range fresh {
+			if ts := timestamps[line]; ts.Before(s.Start) {
+				s.Start = ts
+			} else if ts.After(s.End) {
+				s.End = ts
+			}
+		}
+		s.Entries += len(fresh)
+	}
+	return a.writeIndex()
+}
+
+// appendSegment appends lines to segment name as a new gzip member.
+func (a *IndexArchive) appendSegment(name string, lines []string) error {
+	f, err := os.OpenFile(a.SegmentPath(name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	for _, line := range lines {
+		if _, err := io.WriteString(zw, line+"\n"); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadSeen returns the entries of segment name, reading them from the
+// segment if they are not in memory.
+func (a *IndexArchive) loadSeen(name string) (map[string]struct{}, error) {
+	if seen, ok := a.seen[name]; ok {
+		return seen, nil
+	}
+	seen := map[string]struct{}{}
+	err := a.ReadSegment(name, func(line []byte) error {
+		seen[string(line)] = struct{}{}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read archive segment %s: %w", name, err)
+	}
+	if len(a.seen) >= maxSeenSegments {
+		for k := range a.seen {
+			delete(a.seen, k)
+			break
+		}
+	}
+	a.seen[name] = seen
+	return seen, nil
+}
+
+// ReadSegment calls fn with every entry in segment name.
+func (a *IndexArchive) ReadSegment(name string, fn func(line []byte) error) error {
+	f, err := os.Open(a.SegmentPath(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (a *IndexArchive) writeIndex() error {
+	b, err := json.MarshalIndent(a.sortedSegments(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(a.dir, archiveIndexFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(a.dir, archiveIndexFile))
+}
@@ -0,0 +1,52 @@
+package dl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexArchive(t *testing.T) {
+	dir := t.TempDir()
+	entry := func(ts string, modPath string) string {
+		return fmt.Sprintf(`{"Path":%q,"Version":"v1.0.0","Timestamp":%q}`, modPath, ts)
+	}
+	a, err := OpenIndexArchive(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, a.Append([]byte(entry("2024-01-31T23:00:00Z", "example.com/a")+"\n"+entry("2024-02-01T01:00:00Z", "example.com/b")+"\n")))
+
+	// entries overlapping with what has been archived are skipped, also after reopening
+	a, err = OpenIndexArchive(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, a.Append([]byte(entry("2024-02-01T01:00:00Z", "example.com/b")+"\n"+entry("2024-02-01T00:30:00Z", "example.com/c")+"\nnot json\n")))
+
+	segments := a.Segments()
+	assert.Equal(t, []ArchiveSegment{
+		{Name: "2024-01-31.jsonl.gz", Start: time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC), End: time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC), Entries: 1},
+		{Name: "2024-02-01.jsonl.gz", Start: time.Date(2024, 2, 1, 0, 30, 0, 0, time.UTC), End: time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC), Entries: 2},
+	}, segments)
+
+	lines := []string{}
+	assert.Nil(t, a.ReadSegment("2024-02-01.jsonl.gz", func(line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	}))
+	assert.Equal(t, []string{entry("2024-02-01T01:00:00Z", "example.com/b"), entry("2024-02-01T00:30:00Z", "example.com/c")}, lines)
+}
+
+func TestScrapeArchive(t *testing.T) {
+	ts := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	index := newTestIndex(t, Modules{{Timestamp: ts, Path: "example.com/a", Version: "v1.0.0"}})
+	a, err := OpenIndexArchive(t.TempDir())
+	assert.Nil(t, err)
+
+	c := NewIndexClient(false).WithArchive(a)
+	c.BaseUrl = index.URL
+	mods, err := c.Scrape(context.Background(), 10)
+	assert.Nil(t, err)
+	assert.Len(t, mods, 1)
+	assert.Equal(t, []ArchiveSegment{{Name: "2024-01-31.jsonl.gz", Start: ts, End: ts, Entries: 1}}, a.Segments())
+}
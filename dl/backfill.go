@@ -0,0 +1,299 @@
+package dl
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// indexStart is before the first entry of index.golang.org.
+var indexStart = time.Date(2019, 4, 10, 0, 0, 0, 0, time.UTC)
+
+// BackfillShard is a period [Start, End) of the index synced by a backfill,
+// which has synced everything before Cursor.
+type BackfillShard struct {
+	Start  time.Time
+	End    time.Time
+	Cursor time.Time
+	Done   bool
+}
+
+// BackfillPlan splits the period [Since, Until) of the index into shards.
+type BackfillPlan struct {
+	Since  time.Time
+	Until  time.Time
+	Shards []BackfillShard
+}
+
+// newBackfillPlan splits [since, until) into numShards shards of equal duration.
+func newBackfillPlan(since time.Time, until time.Time, numShards int) BackfillPlan {
+	plan := BackfillPlan{Since: since, Until: until}
+	step := until.Sub(since) / time.Duration(numShards)
+	for i := 0; i < numShards; i++ {
+		start := since.Add(step * time.Duration(i))
+		end := start.Add(step)
+		if i == numShards-1 {
+			end = until
+		}
+		plan.Shards = append(plan.Shards, BackfillShard{Start: start, End: end, Cursor: start})
+	}
+	return plan
+}
+
+// Progress returns the time everything before has been synced, which is the
+// cursor of the first shard not done.
+func (p BackfillPlan) Progress() time.Time {
+	for _, shard := range p.Shards {
+		if !shard.Done {
+			return shard.Cursor
+		}
+	}
+	return p.Until
+}
+
+func (p BackfillPlan) Done() bool {
+	return p.Progress().Equal(p.Until)
+}
+
+// Backfill syncs a period of the index history in time shards, which are
+// scraped and downloaded concurrently. The cursor of every shard is kept in
+// the state store, so an interrupted backfill resumes where each shard was.
+type Backfill struct {
+	stateStore        *StateStore
+	since             time.Time
+	until             time.Time
+	numShards         int
+	batchSize         int
+	maxTsLocation     string
+	newIndexClient    func() *IndexClient
+	newDownloadClient func(shard int) *DownloadClient
+
+	mtx  sync.Mutex
+	plan BackfillPlan
+
+	// dedupe is the download client of the first shard, whose in-flight and
+	// completed module versions are shared with every other shard
+	dedupe *DownloadClient
+}
+
+func NewBackfill(stateStore *StateStore) *Backfill {
+	return &Backfill{
+		stateStore:        stateStore,
+		numShards:         8,
+		batchSize:         2000,
+		newIndexClient:    func() *IndexClient { return NewIndexClient(false) },
+		newDownloadClient: func(int) *DownloadClient { return NewDownloadClient() },
+	}
+}
+
+// WithWindow backfills [since, until). A zero since is the main cursor in
+// MAX_TS, if set with WithMaxTsLocation, else the start of the index. A zero
+// until is now.
+func (b *Backfill) WithWindow(since time.Time, until time.Time) *Backfill {
+	b.since = since
+	b.until = until
+	return b
+}
+
+func (b *Backfill) WithNumShards(n int) *Backfill {
+	b.numShards = max(n, 1)
+	return b
+}
+
+func (b *Backfill) WithBatchSize(n int) *Backfill {
+	b.batchSize = n
+	return b
+}
+
+// WithMaxTsLocation merges the progress of the backfill into the main cursor
+// in the MAX_TS file at location, as soon as every shard before has completed.
+func (b *Backfill) WithMaxTsLocation(location string) *Backfill {
+	b.maxTsLocation = location
+	return b
+}
+
+// WithIndexClient sets how the index client of each shard is created.
+func (b *Backfill) WithIndexClient(newIndexClient func() *IndexClient) *Backfill {
+	b.newIndexClient = newIndexClient
+	return b
+}
+
+// WithDownloadClients sets how the download client of each shard is created.
+// The clients must not share temp dirs, and should skip writing MAX_TS. They
+// share which module versions are in flight and completed, so that the
+// requirements common to several shards are only downloaded once.
+func (b *Backfill) WithDownloadClients(newDownloadClient func(shard int) *DownloadClient) *Backfill {
+	b.newDownloadClient = newDownloadClient
+	return b
+}
+
+// Plan returns the plan, and progress, of the backfill.
+func (b *Backfill) Plan() BackfillPlan {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	plan := b.plan
+	plan.Shards = append([]BackfillShard{}, b.plan.Shards...)
+	return plan
+}
+
+// Run backfills until every shard is done. The plan of an earlier, unfinished
+// backfill of the same window is resumed.
+func (b *Backfill) Run(ctx context.Context) error {
+	if err := b.loadPlan(); err != nil {
+		return err
+	}
+	b.merge()
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i, shard := range b.plan.Shards {
+		if shard.Done {
+			continue
+		}
+		g.Go(func() error {
+			return b.runShard(ctx, i)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	slog.Info("backfill done", "since", b.plan.Since, "until", b.plan.Until)
+	return nil
+}
+
+func (b *Backfill) loadPlan() error {
+	since := b.since
+	if since.IsZero() && b.maxTsLocation != "" {
+		since, _ = loadMaxTsFromFile(b.maxTsLocation)
+	}
+	if since.Before(indexStart) {
+		since = indexStart
+	}
+
+	plan, found, err := b.stateStore.GetBackfillPlan()
+	if err != nil {
+		return fmt.Errorf("failed to read backfill plan: %w", err)
+	}
+	if found && !plan.Done() && (b.since.IsZero() || plan.Since.Equal(since)) && (b.until.IsZero() || plan.Until.Equal(b.until)) {
+		slog.Info("resuming backfill", "since", plan.Since, "until", plan.Until, "shards", len(plan.Shards), "progress", plan.Progress())
+		b.plan = plan
+		return nil
+	}
+
+	until := b.until
+	if until.IsZero() {
+		until = time.Now().UTC()
+	}
+	if !until.After(since) {
+		return fmt.Errorf("nothing to backfill between %s and %s", since, until)
+	}
+	b.plan = newBackfillPlan(since, until, b.numShards)
+	slog.Info("starting backfill", "since", since, "until", until, "shards", len(b.plan.Shards))
+	return b.stateStore.PutBackfillPlan(b.plan)
+}
+
+// runShard syncs shard i batch by batch, with a download client of its own.
+func (b *Backfill) runShard(ctx context.Context, i int) error {
+	b.mtx.Lock()
+	shard := b.plan.Shards[i]
+
+	dlc := b.newDownloadClient(i)
+	if b.dedupe == nil {
+		b.dedupe = dlc
+	} else {
+		dlc.WithSharedDedupe(b.dedupe)
+	}
+	b.mtx.Unlock()
+	defer dlc.Cleanup()
+	processorsCtx, cancel := context.WithCancel(ctx)
+	processorsDone := make(chan struct{})
+	go func() {
+		dlc.ProcessIncomingDownloadRequests(processorsCtx)
+		close(processorsDone)
+	}()
+	defer func() {
+		cancel()
+		<-processorsDone
+	}()
+
+	ind := b.newIndexClient()
+	for {
+		ind.WithExplicitMaxTs(shard.Cursor)
+		mods, err := ind.Scrape(ctx, b.batchSize)
+		if err != nil {
+			slog.Error("failed to scrape", "shard", i, "err", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+
+		query := ModuleQuery{Since: shard.Cursor, Until: shard.End.Add(-time.Nanosecond)}
+		selected, done := query.Select(mods)
+		done = done || len(mods) < b.batchSize
+		if len(selected) > 0 {
+			dlc.EnqueueBatch(ctx, selected)
+			if err := dlc.AwaitInflight(ctx); err != nil {
+				return err
+			}
+			dlc.Cleanup()
+		}
+
+		switch cursor := mods.GetMaxTs(); {
+		case done:
+			shard.Cursor = shard.End
+			shard.Done = true
+		case cursor.Equal(shard.Cursor):
+			// a whole batch shares a timestamp, skip past it rather than scrape it forever
+			slog.Warn("skipping past a batch with a single timestamp", "shard", i, "ts", cursor)
+			shard.Cursor = cursor.Add(time.Nanosecond)
+		default:
+			shard.Cursor = cursor
+		}
+		if err := b.updateShard(i, shard); err != nil {
+			return err
+		}
+		slog.Info("finished writing backfill batch", "shard", i, "cursor", shard.Cursor, "end", shard.End)
+		if shard.Done {
+			return nil
+		}
+	}
+}
+
+func (b *Backfill) updateShard(i int, shard BackfillShard) error {
+	b.mtx.Lock()
+	b.plan.Shards[i] = shard
+	err := b.stateStore.PutBackfillPlan(b.plan)
+	b.mtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to update backfill plan: %w", err)
+	}
+	b.merge()
+	return nil
+}
+
+// merge advances MAX_TS to the progress of the backfill, unless MAX_TS is
+// already past it or there would be a gap between the two.
+func (b *Backfill) merge() {
+	if b.maxTsLocation == "" {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	current, err := loadMaxTsFromFile(b.maxTsLocation)
+	if err != nil {
+		current = time.Unix(0, 0)
+	}
+	progress := b.plan.Progress()
+	if b.plan.Since.After(current) && b.plan.Since.After(indexStart) || !progress.After(current) {
+		return
+	}
+	if err := writeMaxTsFile(b.maxTsLocation, progress); err != nil {
+		slog.Error("failed to write MAX_TS", "err", err)
+	}
+}
@@ -0,0 +1,169 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestIndex serves mods like index.golang.org does.
+func newTestIndex(t *testing.T, mods Modules) *httptest.Server {
+	sort.Slice(mods, func(i, j int) bool { return mods[i].Timestamp.Before(mods[j].Timestamp) })
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+		assert.Nil(t, err)
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		assert.Nil(t, err)
+		enc := json.NewEncoder(w)
+		for _, m := range mods {
+			if limit > 0 && !m.Timestamp.Before(since) {
+				assert.Nil(t, enc.Encode(m))
+				limit--
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestBackfill(t *testing.T, stateStore *StateStore, dir string, index *httptest.Server) *Backfill {
+	return NewBackfill(stateStore).
+		WithNumShards(3).
+		WithBatchSize(2).
+		WithMaxTsLocation(path.Join(dir, "MAX_TS")).
+		WithIndexClient(func() *IndexClient {
+			c := NewIndexClient(false)
+			c.BaseUrl = index.URL
+			return c
+		}).
+		WithDownloadClients(func(shard int) *DownloadClient {
+			return NewDownloadClient().
+				WithOutputDir(dir).
+				WithTempDir(path.Join(dir, "tmp", fmt.Sprintf("shard-%d", shard))).
+				WithStateStore(stateStore).
+				WithSkipMaxTsWrite(true).
+				WithFollowRequirements(false)
+		})
+}
+
+func TestBackfill(t *testing.T) {
+	p := newTestProxy(t)
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(6 * 24 * time.Hour)
+	mods := Modules{}
+	for i := 0; i < 6; i++ {
+		mod := Module{Timestamp: since.Add(time.Duration(i)*24*time.Hour + 12*time.Hour), Path: fmt.Sprintf("example.com/m%d", i), Version: "v1.0.0"}
+		p.addModule(t, mod, map[string]string{"go.mod": "module " + mod.Path + "\n"})
+		mods = append(mods, mod)
+	}
+	// after the window
+	p.addModule(t, Module{Path: "example.com/late", Version: "v1.0.0"}, map[string]string{"go.mod": "module example.com/late\n"})
+	index := newTestIndex(t, append(Modules{{Timestamp: until.Add(time.Hour), Path: "example.com/late", Version: "v1.0.0"}}, mods...))
+
+	dir := t.TempDir()
+	assert.Nil(t, writeMaxTsFile(path.Join(dir, "MAX_TS"), since))
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+
+	backfill := newTestBackfill(t, stateStore, dir, index).WithWindow(since, until)
+	assert.Nil(t, backfill.Run(context.Background()))
+
+	stored, err := ListStoredModules(context.Background(), NewLocalStore(dir))
+	assert.Nil(t, err)
+	assert.Len(t, stored, 6)
+	assert.Equal(t, 6, p.zipFetches.Value())
+
+	plan, found, err := stateStore.GetBackfillPlan()
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.True(t, plan.Done())
+	assert.Len(t, plan.Shards, 3)
+	assert.Equal(t, since.Add(2*24*time.Hour), plan.Shards[0].End)
+
+	maxTs, err := loadMaxTsFromFile(path.Join(dir, "MAX_TS"))
+	assert.Nil(t, err)
+	assert.True(t, maxTs.Equal(until))
+}
+
+func TestBackfillResume(t *testing.T) {
+	p := newTestProxy(t)
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mods := Modules{}
+	for i := 0; i < 6; i++ {
+		mod := Module{Timestamp: since.Add(time.Duration(i)*24*time.Hour + 12*time.Hour), Path: fmt.Sprintf("example.com/m%d", i), Version: "v1.0.0"}
+		p.addModule(t, mod, map[string]string{"go.mod": "module " + mod.Path + "\n"})
+		mods = append(mods, mod)
+	}
+	index := newTestIndex(t, mods)
+
+	dir := t.TempDir()
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+
+	// an interrupted backfill, with the first shard and half of the last done
+	plan := newBackfillPlan(since, since.Add(6*24*time.Hour), 3)
+	plan.Shards[0].Cursor = plan.Shards[0].End
+	plan.Shards[0].Done = true
+	plan.Shards[2].Cursor = mods[4].Timestamp.Add(time.Second)
+	assert.Nil(t, stateStore.PutBackfillPlan(plan))
+	assert.Equal(t, plan.Shards[1].Start, plan.Progress())
+
+	// MAX_TS is not advanced past a gap
+	assert.Nil(t, writeMaxTsFile(path.Join(dir, "MAX_TS"), since.Add(-time.Hour)))
+	backfill := newTestBackfill(t, stateStore, dir, index)
+	assert.Nil(t, backfill.Run(context.Background()))
+	assert.True(t, backfill.Plan().Done())
+	assert.Equal(t, 3, p.zipFetches.Value())
+	for _, mod := range append(mods[:2:2], mods[4]) {
+		_, err := os.Stat(path.Join(dir, mod.Path, "@v", mod.Version+".zip"))
+		assert.True(t, os.IsNotExist(err), mod)
+	}
+	maxTs, err := loadMaxTsFromFile(path.Join(dir, "MAX_TS"))
+	assert.Nil(t, err)
+	assert.True(t, maxTs.Equal(since.Add(-time.Hour)))
+}
+
+func TestBackfillSharedRequirements(t *testing.T) {
+	p := newTestProxy(t)
+	p.zipDelay = 200 * time.Millisecond
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	common := Module{Path: "example.com/common", Version: "v1.0.0"}
+	p.addModule(t, common, map[string]string{"go.mod": "module example.com/common\n"})
+	mods := Modules{}
+	for i := 0; i < 3; i++ {
+		mod := Module{Timestamp: since.Add(time.Duration(i)*24*time.Hour + 12*time.Hour), Path: fmt.Sprintf("example.com/m%d", i), Version: "v1.0.0"}
+		p.addModule(t, mod, map[string]string{"go.mod": "module " + mod.Path + "\n\nrequire example.com/common v1.0.0\n"})
+		mods = append(mods, mod)
+	}
+	index := newTestIndex(t, mods)
+
+	dir := t.TempDir()
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+
+	// every shard requires common at the same time, and only one downloads it
+	backfill := newTestBackfill(t, stateStore, dir, index).
+		WithWindow(since, since.Add(3*24*time.Hour)).
+		WithDownloadClients(func(shard int) *DownloadClient {
+			return NewDownloadClient().
+				WithOutputDir(dir).
+				WithTempDir(path.Join(dir, "tmp", fmt.Sprintf("shard-%d", shard))).
+				WithSkipMaxTsWrite(true)
+		})
+	assert.Nil(t, backfill.Run(context.Background()))
+	assert.Eventually(t, func() bool { return fileExists(path.Join(dir, "example.com/common/@v/v1.0.0.zip")) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 4, p.zipFetches.Value())
+}
@@ -4,4 +4,7 @@ var (
 	GO_PROXY   = GetEnvOr("GO_PROXY", "https://proxy.golang.org")
 	GO_INDEX   = GetEnvOr("GO_INDEX", "https://index.golang.org")
 	OUTPUT_DIR = GetEnvOr("OUTPUT_DIR", "go_pkg")
+	GO_SUMDB   = GetEnvOr("GO_SUMDB", "sum.golang.org")
+	GO_PRIVATE = GetEnvOr("GO_PRIVATE", "")
+	GO_VULNDB  = GetEnvOr("GO_VULNDB", "https://vuln.go.dev")
 )
@@ -0,0 +1,191 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// depsFiles are the files ReadDeps reads module versions from.
+var depsFiles = map[string]bool{
+	"go.mod":      true,
+	"go.sum":      true,
+	"go.work":     true,
+	"go.work.sum": true,
+}
+
+// ReadDeps returns the module versions a project depends on, read from p which
+// is a go.mod, go.sum, go.work or go.work.sum file, or a directory which is
+// searched for them. Requirements are resolved through replace directives, and
+// modules replaced by local directories are left out.
+func ReadDeps(p string) (Modules, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]Module{}
+	add := func(mods Modules) {
+		for _, m := range mods {
+			seen[m.String()] = m
+		}
+	}
+	if !info.IsDir() {
+		mods, err := readDepsFile(p)
+		if err != nil {
+			return nil, err
+		}
+		add(mods)
+	} else {
+		err := filepath.WalkDir(p, func(fp string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				// the same directories the go command ignores in ./...
+				name := d.Name()
+				if fp != p && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !depsFiles[d.Name()] {
+				return nil
+			}
+			mods, err := readDepsFile(fp)
+			if err != nil {
+				return err
+			}
+			add(mods)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mods := Modules{}
+	for _, m := range seen {
+		mods = append(mods, m)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		if mods[i].Path != mods[j].Path {
+			return mods[i].Path < mods[j].Path
+		}
+		return semver.Compare(mods[i].Version, mods[j].Version) < 0
+	})
+	return mods, nil
+}
+
+func readDepsFile(fp string) (Modules, error) {
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Base(fp) {
+	case "go.mod":
+		return readGoModDeps(fp, data, nil)
+	case "go.work":
+		return readGoWorkDeps(fp, data)
+	case "go.sum", "go.work.sum":
+		return readGoSumDeps(fp, data)
+	}
+	return nil, fmt.Errorf("%s: not a go.mod, go.sum or go.work file", fp)
+}
+
+// readGoModDeps returns the requirements of a go.mod file. Workspace replace
+// directives in workReplace take precedence over the ones in the file.
+func readGoModDeps(fp string, data []byte, workReplace []*modfile.Replace) (Modules, error) {
+	f, err := modfile.Parse(fp, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mods := Modules{}
+	for _, r := range f.Require {
+		if m, ok := resolveReplace(Module{Path: r.Mod.Path, Version: r.Mod.Version}, workReplace, f.Replace); ok {
+			mods = append(mods, m)
+		}
+	}
+	return mods, nil
+}
+
+// resolveReplace applies the first set of replace directives which matches m,
+// and reports false if m is replaced by a local directory.
+func resolveReplace(m Module, replaceSets ...[]*modfile.Replace) (Module, bool) {
+	for _, replace := range replaceSets {
+		var match *modfile.Replace
+		for _, r := range replace {
+			// a replace with a version takes precedence over one without
+			if r.Old.Path == m.Path && (r.Old.Version == m.Version || (r.Old.Version == "" && match == nil)) {
+				match = r
+			}
+		}
+		if match == nil {
+			continue
+		}
+		if match.New.Version == "" {
+			return Module{}, false
+		}
+		return Module{Path: match.New.Path, Version: match.New.Version}, true
+	}
+	return m, true
+}
+
+// readGoWorkDeps returns the requirements of all modules used by a go.work file.
+func readGoWorkDeps(fp string, data []byte) (Modules, error) {
+	f, err := modfile.ParseWork(fp, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mods := Modules{}
+	for _, use := range f.Use {
+		dir := use.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(fp), dir)
+		}
+		modFile := filepath.Join(dir, "go.mod")
+		modData, err := os.ReadFile(modFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fp, err)
+		}
+		useMods, err := readGoModDeps(modFile, modData, f.Replace)
+		if err != nil {
+			return nil, err
+		}
+		mods = append(mods, useMods...)
+	}
+	return mods, nil
+}
+
+// readGoSumDeps returns every module version listed in a go.sum file. Versions
+// which only have their go.mod listed are included, since the go command needs
+// them for minimal version selection.
+func readGoSumDeps(fp string, data []byte) (Modules, error) {
+	mods := Modules{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line", fp, line)
+		}
+		version := strings.TrimSuffix(fields[1], "/go.mod")
+		if !semver.IsValid(version) {
+			return nil, fmt.Errorf("%s:%d: invalid version %q", fp, line, fields[1])
+		}
+		mods = append(mods, Module{Path: fields[0], Version: version})
+	}
+	return mods, scanner.Err()
+}
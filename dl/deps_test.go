@@ -0,0 +1,83 @@
+package dl
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDeps(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"svc/go.mod": `module example.com/svc
+
+go 1.22
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.2.0
+	example.com/local v0.0.0
+	example.com/pinned v1.0.0
+)
+
+replace example.com/b => example.com/b-fork v1.2.1
+
+replace example.com/local => ../local
+
+replace example.com/pinned v1.0.0 => example.com/pinned v1.0.1
+`,
+		"svc/go.sum": `example.com/a v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+example.com/a v1.0.0/go.mod h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+example.com/c v0.9.0/go.mod h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+`,
+		"svc/vendor/example.com/v/go.mod": "module example.com/v\n\nrequire example.com/vendored v1.0.0\n",
+		"work/go.work":                    "go 1.22\n\nuse ./m\n\nreplace example.com/a => example.com/a v1.1.0\n",
+		"work/m/go.mod":                   "module example.com/m\n\nrequire example.com/a v1.0.0\n",
+	})
+
+	mods, err := ReadDeps(path.Join(dir, "svc/go.mod"))
+	assert.Nil(t, err)
+	assert.Equal(t, Modules{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/b-fork", Version: "v1.2.1"},
+		{Path: "example.com/pinned", Version: "v1.0.1"},
+	}, mods)
+
+	mods, err = ReadDeps(path.Join(dir, "work/go.work"))
+	assert.Nil(t, err)
+	assert.Equal(t, Modules{{Path: "example.com/a", Version: "v1.1.0"}}, mods)
+
+	mods, err = ReadDeps(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, Modules{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/a", Version: "v1.1.0"},
+		{Path: "example.com/b-fork", Version: "v1.2.1"},
+		{Path: "example.com/c", Version: "v0.9.0"},
+		{Path: "example.com/pinned", Version: "v1.0.1"},
+	}, mods)
+
+	writeTestFiles(t, dir, map[string]string{"bad/go.sum": "example.com/a v1.0.0\n"})
+	_, err = ReadDeps(path.Join(dir, "bad/go.sum"))
+	assert.NotNil(t, err)
+}
+
+func TestDownloadClientDeps(t *testing.T) {
+	p := newTestProxy(t)
+	mod := Module{Path: "example.com/dep", Version: "v1.0.0"}
+	p.addModule(t, mod, map[string]string{"go.mod": "module example.com/dep\n\nrequire example.com/indirect v1.0.0\n"})
+	p.addModule(t, Module{Path: "example.com/indirect", Version: "v1.0.0"}, map[string]string{"go.mod": "module example.com/indirect\n"})
+	missing := Module{Path: "example.com/missing", Version: "v1.0.0"}
+
+	c := NewDownloadClient().
+		WithRequestCapacity(3).
+		WithPerModuleRetries(0).
+		WithFollowRequirements(false)
+	stored := syncWith(t, c, t.TempDir(), Modules{mod, missing})
+	assert.Equal(t, Modules{mod}, stored)
+
+	failed := c.FailedModules()
+	assert.Len(t, failed, 1)
+	assert.True(t, IsNotFound(failed[missing.String()]))
+}
@@ -1,18 +1,21 @@
 package dl
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"praktiskt/go-index-dl/utils"
 
-	"github.com/ncruces/go-strftime"
 	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 )
 
@@ -24,6 +27,10 @@ const (
 	DownloadStatusCompleted = "completed"
 	DownloadStatusPending   = "pending"
 	DownloadStatusSkipped   = "skipped"
+
+	// DownloadStatusQuarantined means the files were stored in quarantine by
+	// the license policy instead of being mirrored.
+	DownloadStatusQuarantined = "quarantined"
 )
 
 type DownloadRequest struct {
@@ -54,17 +61,38 @@ func NewDownloadRequest(mod Module, required bool, retries int) DownloadRequest
 
 type DownloadClient struct {
 	outputDir                string
+	store                    Store
 	tempDir                  string
 	maxTsDir                 string
 	incomingDownloadRequests chan DownloadRequest
-	inflightModules          utils.ConcurrentSet[string]
-	completedModules         utils.ConcurrentSet[string]
+	inflightModules          *utils.ConcurrentSet[string]
+	completedModules         *utils.ConcurrentSet[string]
 	numConcurrentProcessors  int
 	skipPseudoVersions       bool
+	skipRetracted            bool
+	vulnDB                   *VulnDB
+	skipVulnerable           bool
+	skipVulnSeverity         string
+	licensePolicy            *LicensePolicy
 	skipMaxTsWrite           bool
 	stats                    stats
 	numRetries               int
 	currentBatch             *Modules
+	checksumDB               *ChecksumDB
+	stateStore               *StateStore
+	moduleFilter             *ModuleFilter
+	followRequirements       bool
+	failedModules            utils.ConcurrentMap[string, error]
+	metrics                  *Metrics
+	httpClient               *http.Client
+	upstreams                *Upstreams
+	privatePatterns          string
+	vcs                      *VCSSource
+	retryBaseDelay           time.Duration
+	retryMaxDelay            time.Duration
+	batchStarted             time.Time
+	pendingStates            utils.ConcurrentMap[string, []func(state *ModuleState)]
+	pathMetadataCache        utils.ConcurrentMap[string, PathMetadata]
 }
 
 type stats struct {
@@ -94,25 +122,49 @@ func (s *stats) Reset() {
 	s.completedRequests.Reset()
 }
 
+func newModuleSet() *utils.ConcurrentSet[string] {
+	set := utils.NewConcurrentSet[string]()
+	return &set
+}
+
 func NewDownloadClient() *DownloadClient {
 	return &DownloadClient{
 		incomingDownloadRequests: make(chan DownloadRequest, 1),
 		outputDir:                OUTPUT_DIR,
+		store:                    NewLocalStore(OUTPUT_DIR),
 		tempDir:                  path.Join(OUTPUT_DIR, "tmp"),
 		maxTsDir:                 path.Join(OUTPUT_DIR, "MAX_TS"),
 		numConcurrentProcessors:  1,
 		skipPseudoVersions:       false,
 		skipMaxTsWrite:           false,
-		completedModules:         utils.NewConcurrentSet[string](),
-		inflightModules:          utils.NewConcurrentSet[string](),
+		completedModules:         newModuleSet(),
+		inflightModules:          newModuleSet(),
 		numRetries:               10,
+		followRequirements:       true,
+		failedModules:            utils.NewConcurrentMap[string, error](),
+		httpClient:               http.DefaultClient,
+		upstreams:                defaultUpstreams(),
+		retryBaseDelay:           time.Second,
+		retryMaxDelay:            time.Duration(2) * time.Minute,
 		stats:                    newStats(),
+		pendingStates:            utils.NewConcurrentMap[string, []func(state *ModuleState)](),
+		pathMetadataCache:        utils.NewConcurrentMap[string, PathMetadata](),
 	}
 }
 
+// WithOutputDir sets the directory holding MAX_TS, and stores downloaded files
+// in it unless WithStore is used.
 func (c *DownloadClient) WithOutputDir(dir string) *DownloadClient {
 	c.outputDir = dir
 	c.maxTsDir = path.Join(c.outputDir, "MAX_TS")
+	c.store = NewLocalStore(dir)
+	return c
+}
+
+// WithStore stores downloaded files in store instead of the output directory.
+// Files are still downloaded to the temp dir first.
+func (c *DownloadClient) WithStore(store Store) *DownloadClient {
+	c.store = store
 	return c
 }
 
@@ -136,6 +188,37 @@ func (c *DownloadClient) WithSkipPseudoVersions(setting bool) *DownloadClient {
 	return c
 }
 
+// WithSkipRetracted skips module versions retracted by the latest version of
+// their module, unless they are required by another module.
+func (c *DownloadClient) WithSkipRetracted(setting bool) *DownloadClient {
+	c.skipRetracted = setting
+	return c
+}
+
+// WithVulnDB looks up the vulnerabilities of module versions in db, which are
+// recorded in the state store.
+func (c *DownloadClient) WithVulnDB(db *VulnDB) *DownloadClient {
+	c.vulnDB = db
+	return c
+}
+
+// WithSkipVulnerable skips module versions with vulnerabilities of at least
+// minSeverity, or of any severity if it is empty, unless they are required by
+// another module. It requires WithVulnDB.
+func (c *DownloadClient) WithSkipVulnerable(setting bool, minSeverity string) *DownloadClient {
+	c.skipVulnerable = setting
+	c.skipVulnSeverity = minSeverity
+	return c
+}
+
+// WithLicensePolicy skips or quarantines downloaded module versions whose
+// licenses are not allowed by policy, including versions required by another
+// module. Set to nil to mirror every license.
+func (c *DownloadClient) WithLicensePolicy(policy *LicensePolicy) *DownloadClient {
+	c.licensePolicy = policy
+	return c
+}
+
 func (c *DownloadClient) WithSkipMaxTsWrite(setting bool) *DownloadClient {
 	c.skipMaxTsWrite = setting
 	return c
@@ -146,85 +229,285 @@ func (c *DownloadClient) WithPerModuleRetries(setting int) *DownloadClient {
 	return c
 }
 
-func (c *DownloadClient) EnqueueBatch(mods Modules) {
+// WithRetryBackoff sets the delay before the first retry of a failed request,
+// which doubles for every further retry up to maxDelay. A Retry-After sent by
+// upstream is used instead, up to maxDelay.
+func (c *DownloadClient) WithRetryBackoff(base time.Duration, maxDelay time.Duration) *DownloadClient {
+	c.retryBaseDelay = base
+	c.retryMaxDelay = maxDelay
+	return c
+}
+
+// WithChecksumDB verifies every downloaded .mod and .zip against db. Set to nil
+// to disable verification.
+func (c *DownloadClient) WithChecksumDB(db *ChecksumDB) *DownloadClient {
+	c.checksumDB = db
+	return c
+}
+
+// WithStateStore persists the state of every request in store, and skips
+// module versions which the store has recorded as completed.
+func (c *DownloadClient) WithStateStore(store *StateStore) *DownloadClient {
+	c.stateStore = store
+	return c
+}
+
+// WithModuleFilter only downloads module paths allowed by filter, both from
+// batches and from requirements. Set to nil to download everything.
+func (c *DownloadClient) WithModuleFilter(filter *ModuleFilter) *DownloadClient {
+	c.moduleFilter = filter
+	return c
+}
+
+// WithFollowRequirements controls whether the requirements in the go.mod of
+// every downloaded module are downloaded as well, which is the default.
+func (c *DownloadClient) WithFollowRequirements(setting bool) *DownloadClient {
+	c.followRequirements = setting
+	return c
+}
+
+// WithRateLimiter limits all upstream traffic with limiter.
+func (c *DownloadClient) WithRateLimiter(limiter *RateLimiter) *DownloadClient {
+	c.httpClient = limiter.Client()
+	return c
+}
+
+// WithUpstreams downloads from upstreams instead of the proxies in GO_PROXY.
+func (c *DownloadClient) WithUpstreams(upstreams *Upstreams) *DownloadClient {
+	c.upstreams = upstreams
+	return c
+}
+
+// WithPrivateModules builds the module paths matching patterns from VCS
+// instead of downloading them, and skips the checksum database for them.
+// patterns is a comma-separated list of path prefix globs, like GOPRIVATE.
+func (c *DownloadClient) WithPrivateModules(patterns string, vcs *VCSSource) *DownloadClient {
+	c.privatePatterns = patterns
+	c.vcs = vcs
+	return c
+}
+
+// WithSharedDedupe skips the module versions which are in flight or completed
+// in other, and the other way around, so that clients syncing concurrently,
+// like the shards of a backfill, download common requirements only once.
+func (c *DownloadClient) WithSharedDedupe(other *DownloadClient) *DownloadClient {
+	c.inflightModules = other.inflightModules
+	c.completedModules = other.completedModules
+	return c
+}
+
+// WithMetrics records request, download and batch metrics in m.
+func (c *DownloadClient) WithMetrics(m *Metrics) *DownloadClient {
+	c.metrics = m
+	m.GaugeFunc("go_index_dl_requests_queued", "Download requests waiting to be processed.", func() float64 {
+		return float64(c.stats.queuedRequests.Value())
+	})
+	m.GaugeFunc("go_index_dl_requests_inflight", "Download requests being processed.", func() float64 {
+		return float64(c.stats.inflightRequests.Value())
+	})
+	return c
+}
+
+func (c *DownloadClient) EnqueueBatch(ctx context.Context, mods Modules) {
 	if err := createDirIfNotExist(c.tempDir); err != nil {
 		slog.Error(err.Error())
 	}
 	c.currentBatch = &mods
+	c.batchStarted = time.Now()
+	c.failedModules.Reset()
+	c.pathMetadataCache.Reset()
 
 	for _, mod := range mods {
-		c.enqueueMod(mod, false)
+		c.enqueueMod(ctx, mod, false)
 	}
 }
 
-func (c *DownloadClient) enqueueMod(mod Module, required bool) {
+func (c *DownloadClient) enqueueMod(ctx context.Context, mod Module, required bool) {
+	if !c.moduleFilter.Allows(mod.Path) {
+		slog.Debug("filtered", "modPath", mod.Path, "modVersion", mod.Version, "required", required)
+		return
+	}
+	if c.stateStore != nil && c.stateStore.IsCompleted(mod) {
+		c.completedModules.Set(mod.String())
+		return
+	}
+	c.enqueue(ctx, NewDownloadRequest(mod, required, c.numRetries))
+}
+
+// enqueue blocks until req has been queued, or ctx is done.
+func (c *DownloadClient) enqueue(ctx context.Context, req DownloadRequest) {
+	c.stats.queuedRequests.Increment()
+	c.send(ctx, req)
+}
+
+// enqueueAfter queues req once delay has passed, without blocking. The request
+// counts as queued while waiting.
+func (c *DownloadClient) enqueueAfter(ctx context.Context, req DownloadRequest, delay time.Duration) {
 	c.stats.queuedRequests.Increment()
-	c.incomingDownloadRequests <- NewDownloadRequest(mod, required, c.numRetries)
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			c.send(ctx, req)
+		case <-ctx.Done():
+			c.stats.queuedRequests.Decrement()
+		}
+	}()
+}
+
+// send blocks until req, which is already counted as queued, has been sent to
+// the processors, or ctx is done.
+func (c *DownloadClient) send(ctx context.Context, req DownloadRequest) {
+	select {
+	case c.incomingDownloadRequests <- req:
+	case <-ctx.Done():
+		c.stats.queuedRequests.Decrement()
+	}
 }
 
 func (c *DownloadClient) setInflight(req DownloadRequest) {
 	c.stats.inflightRequests.Increment()
 	c.stats.queuedRequests.Decrement()
-	c.inflightModules.Set(req.Module.String())
 }
 
-func (c *DownloadClient) completeInflight(req DownloadRequest, status DownloadStatus) {
+func (c *DownloadClient) completeInflight(req DownloadRequest, status DownloadStatus, err error) {
 	switch status {
 	case DownloadStatusCompleted:
 		c.stats.completedRequests.Increment()
 	case DownloadStatusFailed:
 		c.stats.failedRequests.Increment()
-	case DownloadStatusSkipped:
+	case DownloadStatusSkipped, DownloadStatusQuarantined:
 		c.stats.skippedRequests.Increment()
 	case DownloadStatusRetry:
 		c.stats.retriedRequests.Increment()
+	case DownloadStatusPending:
+		// interrupted by shutdown, the request is picked up again on the next run
 	default:
 		slog.Error("unmapped state", "requestStatus", status)
 	}
+	if status != DownloadStatusPending {
+		c.metrics.recordRequest(status)
+	}
 	c.inflightModules.Delete(req.Module.String())
 	c.stats.inflightRequests.Decrement()
+
+	c.recordState(req.Module, func(state *ModuleState) {
+		state.Status = status
+		if status != DownloadStatusSkipped && status != DownloadStatusQuarantined && status != DownloadStatusPending {
+			state.Attempts += 1
+		}
+		state.Error = ""
+		if err != nil {
+			state.Error = err.Error()
+		}
+		if status == DownloadStatusCompleted {
+			state.Completed = time.Now().UTC()
+		}
+	})
+	c.flushState(req.Module)
+}
+
+// recordState queues a change to the state of m, which is written to the state
+// store, if any, by the next flushState of m.
+func (c *DownloadClient) recordState(m Module, fn func(state *ModuleState)) {
+	if c.stateStore == nil {
+		return
+	}
+	c.pendingStates.Update(m.String(), func(fns []func(state *ModuleState)) []func(state *ModuleState) {
+		return append(fns, fn)
+	})
+}
+
+// flushState writes the queued changes to the state of m in a single update,
+// so every module version costs one fsync of the state store.
+func (c *DownloadClient) flushState(m Module) {
+	fns := c.pendingStates.Pop(m.String())
+	if c.stateStore == nil || len(fns) == 0 {
+		return
+	}
+	err := c.stateStore.Update(m, func(state *ModuleState) {
+		for _, fn := range fns {
+			fn(state)
+		}
+	})
+	if err != nil {
+		slog.Error("failed to update state store", "modPath", m.Path, "modVersion", m.Version, "err", err)
+	}
 }
 
 // ProcessIncomingDownloadRequests blocks the thread and processes incoming DownloadRequests
-func (c *DownloadClient) ProcessIncomingDownloadRequests() {
+// until ctx is done. Requests which are in-flight when ctx is done are aborted and
+// cleaned up before it returns.
+func (c *DownloadClient) ProcessIncomingDownloadRequests(ctx context.Context) {
+	wg := sync.WaitGroup{}
 	for range c.numConcurrentProcessors {
+		wg.Add(1)
 		go func() {
-			for req := range c.incomingDownloadRequests {
-				if c.completedModules.Exists(req.Module.String()) || c.inflightModules.Exists(req.Module.String()) {
-					// TODO: We should probably log skipping these somehow.
-					c.stats.queuedRequests.Decrement()
-					continue
-				}
-
-				c.setInflight(req)
-				if !req.Required && c.skipPseudoVersions && req.Module.IsPseudoVersion() {
-					c.completeInflight(req, DownloadStatusSkipped)
-					continue
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-c.incomingDownloadRequests:
+					c.processRequest(ctx, req)
 				}
-				if err := c.Download(req); err != nil {
-					if req.Retries > 0 {
-						req.Retries -= 1
-						go func() {
-							c.stats.queuedRequests.Increment()
-							c.incomingDownloadRequests <- req
-						}()
-						c.completeInflight(req, DownloadStatusRetry)
-						continue
-					}
-					slog.Error("download processor:", "modPath", req.Module.Path, "modVersion", req.Module.Version, "err", err)
-					c.completeInflight(req, DownloadStatusFailed)
-					continue
-				}
-
-				c.completedModules.Set(req.Module.String())
-				c.completeInflight(req, DownloadStatusCompleted)
 			}
 		}()
 	}
-	<-make(chan struct{})
+	wg.Wait()
+}
+
+func (c *DownloadClient) processRequest(ctx context.Context, req DownloadRequest) {
+	if ctx.Err() != nil || c.completedModules.Exists(req.Module.String()) || !c.inflightModules.SetIfAbsent(req.Module.String()) {
+		// TODO: We should probably log skipping these somehow.
+		c.stats.queuedRequests.Decrement()
+		return
+	}
+
+	c.setInflight(req)
+	if !req.Required && c.skipPseudoVersions && req.Module.IsPseudoVersion() {
+		c.completeInflight(req, DownloadStatusSkipped, nil)
+		return
+	}
+	if err := c.download(ctx, req); err != nil {
+		if errors.Is(err, ErrQuarantined) {
+			slog.Info("quarantined version", "modPath", req.Module.Path, "modVersion", req.Module.Version, "err", err)
+			c.completeInflight(req, DownloadStatusQuarantined, err)
+			return
+		}
+		if errors.Is(err, ErrRetracted) || errors.Is(err, ErrVulnerable) || errors.Is(err, ErrLicense) {
+			slog.Debug("skipping version", "modPath", req.Module.Path, "modVersion", req.Module.Version, "err", err)
+			c.completeInflight(req, DownloadStatusSkipped, err)
+			return
+		}
+		if ctx.Err() != nil {
+			c.completeInflight(req, DownloadStatusPending, err)
+			return
+		}
+		if req.Retries > 0 && !isPermanent(err) {
+			req.Retries -= 1
+			delay := retryDelay(c.numRetries-req.Retries, err, c.retryBaseDelay, c.retryMaxDelay)
+			slog.Debug("download processor: retrying", "modPath", req.Module.Path, "modVersion", req.Module.Version, "delay", delay, "err", err)
+			c.enqueueAfter(ctx, req, delay)
+			c.completeInflight(req, DownloadStatusRetry, err)
+			return
+		}
+		slog.Error("download processor:", "modPath", req.Module.Path, "modVersion", req.Module.Version, "err", err)
+		c.failedModules.Set(req.Module.String(), err)
+		c.completeInflight(req, DownloadStatusFailed, err)
+		return
+	}
+
+	c.completedModules.Set(req.Module.String())
+	c.completeInflight(req, DownloadStatusCompleted, nil)
 }
 
-func (c *DownloadClient) AwaitInflight() {
+// AwaitInflight blocks until all queued and in-flight requests are done, and then
+// updates MAX_TS to the max timestamp of the current batch. If ctx is done, queued
+// requests are abandoned, in-flight ones are awaited, MAX_TS is left untouched and
+// the context error is returned.
+func (c *DownloadClient) AwaitInflight(ctx context.Context) error {
 	msg := func(m string) {
 		slog.Info(m,
 			"queued", c.stats.queuedRequests.Value(),
@@ -235,24 +518,46 @@ func (c *DownloadClient) AwaitInflight() {
 			"completed", c.stats.completedRequests.Value(),
 		)
 	}
-	for c.stats.queuedRequests.Value() != 0 || c.stats.inflightRequests.Value() != 0 {
+	ticker := time.NewTicker(time.Duration(1) * time.Second)
+	defer ticker.Stop()
+	for c.stats.inflightRequests.Value() != 0 || (ctx.Err() == nil && c.stats.queuedRequests.Value() != 0) {
 		msg("awaitInflight")
-		time.Sleep(time.Duration(1) * time.Second)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if c.stats.inflightRequests.Value() != 0 {
+				<-ticker.C
+			}
+		}
 	}
 	msg("done")
 	c.stats.Reset()
 
+	if ctx.Err() != nil {
+		slog.Warn("interrupted, not updating MAX_TS", "err", ctx.Err())
+		return ctx.Err()
+	}
+	c.metrics.recordBatch(time.Since(c.batchStarted))
+
 	if !c.skipMaxTsWrite {
 		if c.currentBatch == nil {
 			slog.Error("failed to update MAX_TS, no currentBatch to get timestamp from")
 		}
-		maxTs := c.currentBatch.GetMaxTs()
-		maxTsFile := path.Join(c.maxTsDir)
-		ts := strftime.Format("%Y-%m-%dT%H:%M:%S.%fZ", maxTs)
-		if err := os.WriteFile(maxTsFile, []byte(ts), 0o644); err != nil {
+		if err := writeMaxTsFile(c.maxTsDir, c.currentBatch.GetMaxTs()); err != nil {
 			slog.Error("failed to write minTs to file MAX_TS:", "err", err)
 		}
 	}
+	return nil
+}
+
+// FailedModules returns the last error of every module version which failed
+// for good since the last call to EnqueueBatch, keyed by path@version.
+func (c *DownloadClient) FailedModules() map[string]error {
+	failed := map[string]error{}
+	for _, k := range c.failedModules.Keys() {
+		failed[k] = c.failedModules.Get(k)
+	}
+	return failed
 }
 
 // Cleanup cleans up in-flight artifacts and/or downloads.
@@ -260,81 +565,321 @@ func (c *DownloadClient) Cleanup() {
 	os.RemoveAll(c.tempDir)
 }
 
-func (c *DownloadClient) Download(req DownloadRequest) error {
+// Download downloads the module version of req, and records what was found
+// out about it, like its hashes, vulnerabilities and licenses, in the state
+// store.
+func (c *DownloadClient) Download(ctx context.Context, req DownloadRequest) error {
+	err := c.download(ctx, req)
+	c.flushState(req.Module)
+	return err
+}
+
+// download is Download without writing to the state store, which is left to
+// completeInflight so that it is written once per request.
+func (c *DownloadClient) download(ctx context.Context, req DownloadRequest) error {
 	if !semver.IsValid(req.Module.Version) {
-		return fmt.Errorf("invalid version: %#v", req.Module)
+		return fmt.Errorf("%w: %#v", ErrInvalidPath, req.Module)
 	}
 
-	modulePath := strings.ReplaceAll(req.Module.Path, "/", "/") // TODO: Should we really sanitize? :)
-	cacheDir := path.Join(c.outputDir, modulePath, "@v")
-	if err := createDirIfNotExist(cacheDir); err != nil {
-		return err
+	if c.vulnDB != nil {
+		if err := c.checkVulns(ctx, req); err != nil {
+			return err
+		}
 	}
 
-	// get list file
-	listURL := fmt.Sprintf("%s/%s/@v/list", GO_PROXY, req.Module.Path)
-	listPath := path.Join(cacheDir, "list")
-	slog.Debug("downloading", "url", listURL, "targetDir", listPath)
-	err := downloadFile(listPath, listURL, c.tempDir, false)
+	if err := createDirIfNotExist(c.tempDir); err != nil {
+		return err
+	}
+	listPath, err := c.fetchFile(ctx, req.Module.Path, "list", nil)
 	if err != nil {
-		if strings.Contains(err.Error(), `invalid escaped module path`) {
+		if errors.Is(err, ErrInvalidPath) {
+			// modules which no proxy can serve are not worth failing over
 			return nil
 		}
-		return fmt.Errorf("failed to download list: %v", err)
+		return fmt.Errorf("failed to download list: %w", err)
+	}
+	// the list is only stored once the version it lists has been verified
+	defer os.Remove(listPath)
+	list, err := os.ReadFile(listPath)
+	if err != nil {
+		return err
+	}
+
+	if c.skipRetracted || c.stateStore != nil {
+		meta, err := c.pathMetadata(ctx, req.Module.Path, list)
+		if err != nil {
+			slog.Warn("failed to read retractions", "modPath", req.Module.Path, "err", err)
+		} else if r, retracted := meta.Retraction(req.Module.Version); retracted && c.skipRetracted && !req.Required {
+			return fmt.Errorf("%w: %s: %s", ErrRetracted, req.Module, r.Rationale)
+		}
 	}
 
-	modURL := req.Module.BaseURL() + ".mod"
-	modPath := path.Join(cacheDir, req.Module.Version+".mod")
-	slog.Debug("downloading", "url", modURL, "targetDir", modPath)
-	err = downloadFile(modPath, modURL, c.tempDir, true)
+	mod, hashes, err := c.downloadVersion(ctx, req.Module)
+	if len(hashes) > 0 {
+		c.recordState(req.Module, func(state *ModuleState) { state.Hashes = hashes })
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), `invalid escaped module path`) {
+		if errors.Is(err, ErrInvalidPath) {
 			return nil
 		}
-		return fmt.Errorf("failed to download mod: %v", err)
+		return err
 	}
 
-	modFile, err := os.Open(modPath)
-	if err != nil {
+	if c.followRequirements {
+		go func(mod *modfile.File) {
+			for _, req := range mod.Require {
+				newMod := Module{Path: req.Mod.Path, Version: req.Mod.Version}
+				c.enqueueMod(ctx, newMod, true)
+			}
+		}(mod)
+	}
+
+	if err := putFile(ctx, c.store, moduleKey(req.Module.Path, "list"), listPath); err != nil {
 		return err
 	}
-	defer modFile.Close()
+	return c.downloadLatest(ctx, req.Module.Path)
+}
 
-	modData, err := io.ReadAll(modFile)
+// checkVulns records the vulnerabilities of the requested module version in
+// the state store, and refuses it if it is too vulnerable to be mirrored.
+func (c *DownloadClient) checkVulns(ctx context.Context, req DownloadRequest) error {
+	vulns, err := c.vulnDB.Vulns(ctx, req.Module)
 	if err != nil {
+		return fmt.Errorf("failed to look up vulnerabilities of %s: %w", req.Module, err)
+	}
+	c.recordState(req.Module, func(state *ModuleState) { state.Vulns = VulnIDs(vulns) })
+	if !c.skipVulnerable || req.Required {
+		return nil
+	}
+	for _, v := range vulns {
+		if v.AtLeast(c.skipVulnSeverity) {
+			return fmt.Errorf("%w: %s: %s", ErrVulnerable, req.Module, v.ID)
+		}
+	}
+	return nil
+}
+
+// downloadList downloads the list of known versions for a module path.
+func (c *DownloadClient) downloadList(ctx context.Context, modPath string) error {
+	if err := createDirIfNotExist(c.tempDir); err != nil {
 		return err
 	}
+	if err := c.downloadFile(ctx, modPath, "list"); err != nil {
+		return fmt.Errorf("failed to download list: %w", err)
+	}
+	return nil
+}
 
-	mod, err := modfile.Parse("go.mod", modData, nil)
+// downloadLatest downloads the @latest response for a module path.
+func (c *DownloadClient) downloadLatest(ctx context.Context, modPath string) error {
+	if err := createDirIfNotExist(c.tempDir); err != nil {
+		return err
+	}
+	if err := c.downloadFile(ctx, modPath, "latest"); err != nil {
+		return fmt.Errorf("failed to download latest: %w", err)
+	}
+	return nil
+}
+
+// downloadFile downloads file of modPath and stores it.
+func (c *DownloadClient) downloadFile(ctx context.Context, modPath string, file string) error {
+	tmpPath, err := c.fetchFile(ctx, modPath, file, nil)
 	if err != nil {
 		return err
 	}
+	return putFile(ctx, c.store, moduleKey(modPath, file), tmpPath)
+}
 
-	go func(mod *modfile.File) {
-		for _, req := range mod.Require {
-			newMod := Module{Path: req.Mod.Path, Version: req.Mod.Version}
-			c.enqueueMod(newMod, true)
+// fetchFile downloads file of modPath, which is "list", "latest" or a version
+// followed by .info, .mod or .zip, into the temp dir from the first upstream
+// which has it, or builds it from VCS for private modules. The latency and
+// size of the download are recorded by file type.
+func (c *DownloadClient) fetchFile(ctx context.Context, modPath string, file string, verify verifyFunc) (string, error) {
+	fileType := file
+	if ext := path.Ext(file); ext != "" {
+		fileType = ext
+	}
+	record := func(started time.Time, tmpPath string) {
+		if info, err := os.Stat(tmpPath); err == nil {
+			c.metrics.recordDownload(fileType, time.Since(started), info.Size())
 		}
-	}(mod)
+	}
 
-	// get base files
-	files := []string{".info", ".zip"}
-	for _, ext := range files {
-		fileURL := req.Module.BaseURL() + ext
-		filePath := path.Join(cacheDir, req.Module.Version+ext)
-		slog.Debug("downloading", "url", fileURL, "targetDir", filePath)
-		if err := downloadFile(filePath, fileURL, c.tempDir, true); err != nil {
-			return fmt.Errorf("failed to download %s: %v", fileURL, err)
+	if c.isPrivate(modPath) {
+		slog.Debug("building from vcs", "modPath", modPath, "file", file)
+		started := time.Now()
+		tmpPath, err := c.vcs.fetchFile(ctx, modPath, file, c.tempDir, verify)
+		if err != nil {
+			return "", err
 		}
+		record(started, tmpPath)
+		return tmpPath, nil
 	}
 
-	// get latest file
-	latestURL := fmt.Sprintf("%s/%s/@latest", GO_PROXY, req.Module.Path)
-	latestPath := path.Join(cacheDir, "latest")
-	slog.Debug("downloading", "url", latestURL, "targetDir", latestPath)
-	if err := downloadFile(latestPath, latestURL, c.tempDir, false); err != nil {
-		return fmt.Errorf("failed to download latest: %v", err)
+	var tmpPath string
+	err := c.upstreams.do(ctx, c.metrics, fileType, func(baseURL string) error {
+		url := baseURL + "/" + proxyPath(modPath, file)
+		slog.Debug("downloading", "url", url)
+		started := time.Now()
+		var err error
+		tmpPath, err = fetchFile(ctx, c.httpClient, url, c.tempDir, verify)
+		if err != nil {
+			return err
+		}
+		record(started, tmpPath)
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
+	return tmpPath, nil
+}
 
-	return nil
+// isPrivate reports whether modPath is built from VCS instead of downloaded.
+func (c *DownloadClient) isPrivate(modPath string) bool {
+	return c.vcs != nil && module.MatchPrefixPatterns(c.privatePatterns, modPath)
+}
+
+// downloadVersion downloads the .mod, .zip and .info files of a single module
+// version without following its requirements, and returns the parsed go.mod
+// together with the h1: hashes of the files which were downloaded.
+// The files are only committed to the store once all of them have been
+// downloaded and verified, with the .info last since it marks the version as
+// mirrored. A downloaded .zip is checked against the rules of the go command
+// and its .mod, and its hash is stored next to it in a .ziphash file like in
+// GOMODCACHE.
+func (c *DownloadClient) downloadVersion(ctx context.Context, m Module) (*modfile.File, map[string]string, error) {
+	if err := createDirIfNotExist(c.tempDir); err != nil {
+		return nil, nil, err
+	}
+
+	exts := []string{".zip", ".mod", ".info"}
+	staged := map[string]string{}
+	hashes := map[string]string{}
+	defer func() {
+		for _, tmpPath := range staged {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	for _, ext := range exts {
+		key := moduleKey(m.Path, m.Version+ext)
+		if storeFileExists(ctx, c.store, key) {
+			continue
+		}
+		tmpPath, err := c.fetchFile(ctx, m.Path, m.Version+ext, c.verifier(ctx, m, ext, hashes))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download %s: %w", m.String()+ext, err)
+		}
+		staged[ext] = tmpPath
+	}
+
+	var modData []byte
+	var err error
+	if tmpPath, ok := staged[".mod"]; ok {
+		modData, err = os.ReadFile(tmpPath)
+	} else {
+		modData, err = readStoreFile(ctx, c.store, moduleKey(m.Path, m.Version+".mod"))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mod, err := modfile.Parse("go.mod", modData, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tmpPath, ok := staged[".zip"]; ok {
+		if err := checkZipGoMod(m, tmpPath, modData); err != nil {
+			return nil, nil, err
+		}
+		if err := c.checkLicenses(ctx, m, tmpPath); errors.Is(err, ErrLicense) && c.licensePolicy.Action == LicenseActionQuarantine {
+			if err := c.quarantine(ctx, m, staged, hashes); err != nil {
+				return nil, nil, err
+			}
+			return nil, hashes, fmt.Errorf("%w: %w", ErrQuarantined, err)
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, ext := range exts {
+		tmpPath, ok := staged[ext]
+		if !ok {
+			continue
+		}
+		delete(staged, ext)
+		if err := putFile(ctx, c.store, moduleKey(m.Path, m.Version+ext), tmpPath); err != nil {
+			return nil, nil, err
+		}
+		if ext == ".zip" {
+			if err := c.store.Put(ctx, moduleKey(m.Path, m.Version+".ziphash"), strings.NewReader(hashes[".zip"])); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return mod, hashes, nil
+}
+
+// checkLicenses detects the licenses in the module zip of m at zipPath and
+// records them in the state store, and checks them against the license policy.
+func (c *DownloadClient) checkLicenses(ctx context.Context, m Module, zipPath string) error {
+	if c.stateStore == nil && c.licensePolicy == nil {
+		return nil
+	}
+	licenses, err := DetectLicenses(m, zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to detect licenses of %s: %w", m, err)
+	}
+	c.recordState(m, func(state *ModuleState) { state.Licenses = licenses })
+	if c.licensePolicy == nil {
+		return nil
+	}
+	return c.licensePolicy.Check(licenses)
+}
+
+// quarantine stores the staged files of m below quarantinePrefix instead of
+// mirroring them.
+func (c *DownloadClient) quarantine(ctx context.Context, m Module, staged map[string]string, hashes map[string]string) error {
+	for ext, tmpPath := range staged {
+		delete(staged, ext)
+		if err := putFile(ctx, c.store, path.Join(quarantinePrefix, moduleKey(m.Path, m.Version+ext)), tmpPath); err != nil {
+			return err
+		}
+	}
+	return c.store.Put(ctx, path.Join(quarantinePrefix, moduleKey(m.Path, m.Version+".ziphash")), strings.NewReader(hashes[".zip"]))
+}
+
+// verifier returns a verifyFunc which hashes a downloaded .mod or .zip file of
+// m into hashes, and checks the hash against the checksum database if set.
+func (c *DownloadClient) verifier(ctx context.Context, m Module, ext string, hashes map[string]string) verifyFunc {
+	return func(tmpPath string) error {
+		var h string
+		var err error
+		switch ext {
+		case ".mod":
+			data, readErr := os.ReadFile(tmpPath)
+			if readErr != nil {
+				return readErr
+			}
+			h, err = hashMod(data)
+		case ".zip":
+			if err := checkZip(m, tmpPath); err != nil {
+				return err
+			}
+			h, err = hashZip(tmpPath)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hashes[ext] = h
+
+		if c.checksumDB == nil || c.isPrivate(m.Path) {
+			return nil
+		}
+		return c.checksumDB.verify(ctx, m, ext, h)
+	}
 }
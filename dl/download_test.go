@@ -1,7 +1,9 @@
 package dl
 
 import (
+	"context"
 	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -9,8 +11,6 @@ import (
 )
 
 func TestDownloadClient(t *testing.T) {
-	defer func() { os.RemoveAll("TestDownloadClient") }()
-
 	ts, err := time.Parse(time.RFC3339, "2019-04-10T19:08:52.997264Z")
 	assert.Nil(t, err)
 	mod := Module{
@@ -20,25 +20,60 @@ func TestDownloadClient(t *testing.T) {
 	}
 	req := NewDownloadRequest(mod, true, 5)
 
-	c := NewDownloadClient()
-	assert.Nil(t, c.Download(req))
+	dir := t.TempDir()
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp"))
+	assert.Nil(t, c.Download(context.Background(), req))
 }
 
 func TestDownloadClientLargeSample(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
 	}
-	defer func() { os.RemoveAll("TestDownloadClientLargeSample") }()
-
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	dl := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
 		WithRequestCapacity(10).
 		WithNumConcurrentProcessors(10)
-	go dl.ProcessIncomingDownloadRequests()
+	go dl.ProcessIncomingDownloadRequests(ctx)
 	ind := NewIndexClient(true)
 	for range 5 {
-		mods, err := ind.Scrape(10)
+		mods, err := ind.Scrape(ctx, 10)
 		assert.Nil(t, err)
-		dl.EnqueueBatch(mods)
-		dl.AwaitInflight()
+		dl.EnqueueBatch(ctx, mods)
+		assert.Nil(t, dl.AwaitInflight(ctx))
 	}
 }
+
+func TestDownloadClientShutdown(t *testing.T) {
+	p := newTestProxy(t)
+	p.zipDelay = 500 * time.Millisecond
+	mod := Module{Path: "example.com/slow", Version: "v1.0.0", Timestamp: time.Now()}
+	p.addModule(t, mod, map[string]string{"go.mod": "module example.com/slow\n"})
+
+	dir := t.TempDir()
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp"))
+	ctx, cancel := context.WithCancel(context.Background())
+	processorsDone := make(chan struct{})
+	go func() {
+		c.ProcessIncomingDownloadRequests(ctx)
+		close(processorsDone)
+	}()
+
+	c.EnqueueBatch(ctx, Modules{mod})
+	time.AfterFunc(100*time.Millisecond, cancel)
+	assert.ErrorIs(t, c.AwaitInflight(ctx), context.Canceled)
+	<-processorsDone
+
+	assert.False(t, fileExists(path.Join(dir, "MAX_TS")))
+	assert.False(t, fileExists(path.Join(dir, "example.com/slow/@v/v1.0.0.mod")))
+	tmpFiles, err := os.ReadDir(path.Join(dir, "tmp"))
+	assert.Nil(t, err)
+	assert.Len(t, tmpFiles, 0)
+}
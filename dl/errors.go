@@ -0,0 +1,144 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of download errors, use errors.Is to check the kind of an error.
+var (
+	// ErrNotFound means upstream does not have the module or version.
+	ErrNotFound = errors.New("not found upstream")
+
+	// ErrGone means upstream has removed the module or version.
+	ErrGone = errors.New("gone upstream")
+
+	// ErrRejected means upstream refused the request for good, e.g. with 401
+	// Unauthorized or 403 Forbidden.
+	ErrRejected = errors.New("rejected by upstream")
+
+	// ErrRateLimited means upstream asked us to slow down.
+	ErrRateLimited = errors.New("rate limited by upstream")
+
+	// ErrTransient means the download may succeed if retried, e.g. after a
+	// network error or a server error.
+	ErrTransient = errors.New("transient error")
+
+	// ErrInvalidPath means the module path or version can not be downloaded
+	// from any proxy.
+	ErrInvalidPath = errors.New("invalid module path or version")
+
+	// ErrInvalidZip means a module zip breaks the rules of the go command, or
+	// does not match its .mod file.
+	ErrInvalidZip = errors.New("invalid module zip")
+
+	// ErrRetracted means a module version was skipped since it is retracted.
+	ErrRetracted = errors.New("retracted")
+
+	// ErrVulnerable means a module version was skipped since it has vulnerabilities.
+	ErrVulnerable = errors.New("vulnerable")
+
+	// ErrLicense means the licenses of a module version are not allowed by
+	// the license policy.
+	ErrLicense = errors.New("license not allowed")
+
+	// ErrQuarantined means a module version was quarantined by the license policy.
+	ErrQuarantined = errors.New("quarantined")
+)
+
+// DownloadError is returned when a file can not be downloaded from upstream.
+type DownloadError struct {
+	// Kind is one of ErrNotFound, ErrGone, ErrRejected, ErrRateLimited,
+	// ErrTransient or ErrInvalidPath.
+	Kind error
+	URL  string
+
+	// RetryAfter is how long upstream asked us to wait before retrying, if it did.
+	RetryAfter time.Duration
+
+	Err error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("%s: %v: %v", e.URL, e.Kind, e.Err)
+}
+
+func (e *DownloadError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// IsNotFound reports whether err was caused by the upstream proxy not having
+// the requested module or version.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrGone)
+}
+
+// isPermanent reports whether retrying a download which failed with err is pointless.
+func isPermanent(err error) bool {
+	return IsNotFound(err) || errors.Is(err, ErrRejected) || errors.Is(err, ErrInvalidPath) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrInvalidZip)
+}
+
+// classifyStatus turns a non-200 response into a DownloadError.
+func classifyStatus(url string, resp *http.Response, body string) error {
+	err := &DownloadError{URL: url, Err: &statusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}}
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && strings.Contains(body, "invalid escaped"):
+		err.Kind = ErrInvalidPath
+	case resp.StatusCode == http.StatusNotFound:
+		err.Kind = ErrNotFound
+	case resp.StatusCode == http.StatusGone:
+		err.Kind = ErrGone
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err.Kind = ErrRateLimited
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		err.Kind = ErrTransient
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout:
+		err.Kind = ErrTransient
+	case resp.StatusCode >= 400:
+		err.Kind = ErrRejected
+	default:
+		return err.Err
+	}
+	return err
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if ts, err := http.ParseTime(header); err == nil && ts.After(now) {
+		return ts.Sub(now)
+	}
+	return 0
+}
+
+// retryDelay returns how long to wait before retry number attempt (starting
+// at 1) of a download which failed with err: the Retry-After asked for by
+// upstream, or else an exponential backoff from base with full jitter. Both
+// are capped at maxDelay.
+func retryDelay(attempt int, err error, base time.Duration, maxDelay time.Duration) time.Duration {
+	var de *DownloadError
+	if errors.As(err, &de) && de.RetryAfter > 0 {
+		return min(de.RetryAfter, maxDelay)
+	}
+	backoff := maxDelay
+	if attempt <= 20 {
+		backoff = min(base<<(attempt-1), maxDelay)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return rand.N(backoff) + 1
+}
@@ -0,0 +1,144 @@
+package dl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"praktiskt/go-index-dl/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchFileErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/404":
+			http.Error(w, "not found", http.StatusNotFound)
+		case "/410":
+			http.Error(w, "gone", http.StatusGone)
+		case "/429":
+			w.Header().Set("Retry-After", "3")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case "/503":
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/500":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case "/400":
+			http.Error(w, "bad request: invalid escaped module path", http.StatusBadRequest)
+		case "/401":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case "/403":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/408":
+			http.Error(w, "timeout", http.StatusRequestTimeout)
+		case "/418":
+			http.Error(w, "teapot", http.StatusTeapot)
+		case "/304":
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path       string
+		kind       error
+		retryAfter time.Duration
+		permanent  bool
+	}{
+		{path: "/404", kind: ErrNotFound, permanent: true},
+		{path: "/410", kind: ErrGone, permanent: true},
+		{path: "/429", kind: ErrRateLimited, retryAfter: 3 * time.Second},
+		{path: "/503", kind: ErrTransient, retryAfter: 7 * time.Second},
+		{path: "/500", kind: ErrTransient},
+		{path: "/400", kind: ErrInvalidPath, permanent: true},
+		{path: "/401", kind: ErrRejected, permanent: true},
+		{path: "/403", kind: ErrRejected, permanent: true},
+		{path: "/408", kind: ErrTransient},
+		{path: "/418", kind: ErrRejected, permanent: true},
+		{path: "/304"},
+	}
+	for _, test := range tests {
+		_, err := fetchFile(context.Background(), http.DefaultClient, srv.URL+test.path, t.TempDir(), nil)
+		assert.NotNil(t, err, test.path)
+		assert.Equal(t, test.permanent, isPermanent(err), test.path)
+
+		var de *DownloadError
+		if test.kind == nil {
+			assert.False(t, errors.As(err, &de), test.path)
+			continue
+		}
+		assert.ErrorIs(t, err, test.kind, test.path)
+		assert.True(t, errors.As(err, &de), test.path)
+		assert.Equal(t, test.retryAfter, de.RetryAfter, test.path)
+		var se *statusError
+		assert.True(t, errors.As(err, &se), test.path)
+	}
+
+	_, err := fetchFile(context.Background(), http.DefaultClient, "http://127.0.0.1:1/unreachable", t.TempDir(), nil)
+	assert.ErrorIs(t, err, ErrTransient)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Mon, 01 Jan 2024 00:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Sun, 31 Dec 2023 23:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+}
+
+func TestRetryDelay(t *testing.T) {
+	transient := &DownloadError{Kind: ErrTransient, Err: errors.New("oops")}
+	for attempt := 1; attempt <= 40; attempt++ {
+		delay := retryDelay(attempt, transient, time.Second, time.Minute)
+		assert.Greater(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, min(time.Second<<min(attempt-1, 20), time.Minute))
+	}
+
+	rateLimited := &DownloadError{Kind: ErrRateLimited, RetryAfter: 30 * time.Second, Err: errors.New("slow down")}
+	assert.Equal(t, 30*time.Second, retryDelay(1, rateLimited, time.Second, time.Minute))
+	assert.Equal(t, 10*time.Second, retryDelay(1, rateLimited, time.Second, 10*time.Second))
+}
+
+func TestDownloadClientRetry(t *testing.T) {
+	p := newTestProxy(t)
+	flaky := Module{Path: "example.com/flaky", Version: "v1.0.0"}
+	p.addModule(t, flaky, map[string]string{"go.mod": "module example.com/flaky\n"})
+	missing := Module{Path: "example.com/missing", Version: "v1.0.0"}
+
+	// fail the first two .zip downloads, and count requests for the missing module
+	zipFailures := utils.NewConcurrentCounter[int]()
+	missingRequests := utils.NewConcurrentCounter[int]()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Ext(r.URL.Path) == ".zip" && zipFailures.Value() < 2 {
+			zipFailures.Increment()
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if path.Dir(path.Dir(r.URL.Path)) == "/example.com/missing" {
+			missingRequests.Increment()
+		}
+		http.FileServer(http.Dir(p.dir)).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	GO_PROXY = srv.URL
+
+	c := NewDownloadClient().
+		WithRequestCapacity(2).
+		WithRetryBackoff(time.Millisecond, 10*time.Millisecond)
+	stored := syncWith(t, c, t.TempDir(), Modules{flaky, missing})
+	assert.Equal(t, Modules{flaky}, stored)
+	assert.Equal(t, 2, zipFailures.Value())
+
+	// permanent errors are not retried
+	failed := c.FailedModules()
+	assert.Len(t, failed, 1)
+	assert.ErrorIs(t, failed[missing.String()], ErrNotFound)
+	assert.Equal(t, 1, missingRequests.Value())
+}
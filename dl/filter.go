@@ -0,0 +1,128 @@
+package dl
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ModuleFilter decides which module paths are mirrored. It is built from
+// rules which are applied in order, with the last matching rule winning:
+//
+//	github.com/ourorg/**     include paths matching a glob
+//	!**/internal-fork        exclude paths matching a glob
+//	re:^golang\.org/x/       include paths matching a regular expression
+//	!re:/v[0-9]+$            exclude paths matching a regular expression
+//
+// In globs, ** matches any number of path elements, * matches within a single
+// path element and ? matches a single character other than '/'. Regular
+// expressions match anywhere in the path unless anchored.
+//
+// Paths matching no rule are included, unless there are include rules, in which
+// case they are excluded.
+type ModuleFilter struct {
+	rules          []filterRule
+	defaultInclude bool
+}
+
+type filterRule struct {
+	exclude bool
+	re      *regexp.Regexp
+}
+
+func NewModuleFilter(rules []string) (*ModuleFilter, error) {
+	f := &ModuleFilter{defaultInclude: true}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		r := filterRule{}
+		if strings.HasPrefix(rule, "!") {
+			r.exclude = true
+			rule = rule[1:]
+		} else {
+			f.defaultInclude = false
+		}
+
+		expr := ""
+		if re, ok := strings.CutPrefix(rule, "re:"); ok {
+			expr = re
+		} else {
+			expr = globToRegexp(rule)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid module filter rule %q: %w", rule, err)
+		}
+		r.re = re
+		f.rules = append(f.rules, r)
+	}
+	return f, nil
+}
+
+// LoadModuleFilterRules reads rules from a file with one rule per line. Blank
+// lines and lines starting with # are ignored.
+func LoadModuleFilterRules(filepath string) ([]string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	return rules, scanner.Err()
+}
+
+// Allows reports whether modPath should be mirrored. A nil filter allows everything.
+func (f *ModuleFilter) Allows(modPath string) bool {
+	if f == nil {
+		return true
+	}
+	allowed := f.defaultInclude
+	for _, r := range f.rules {
+		if r.re.MatchString(modPath) {
+			allowed = !r.exclude
+		}
+	}
+	return allowed
+}
+
+// globToRegexp translates a module path glob into an anchored regular expression.
+func globToRegexp(glob string) string {
+	b := strings.Builder{}
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// zero or more leading path elements
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			// the path itself or anything below it
+			b.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i += 1
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
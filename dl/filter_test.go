@@ -0,0 +1,83 @@
+package dl
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleFilter(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		allowed []string
+		denied  []string
+	}{
+		{
+			rules:   nil,
+			allowed: []string{"github.com/a/b", "golang.org/x/mod"},
+		},
+		{
+			rules:   []string{"github.com/ourorg/**", "!**/internal-fork"},
+			allowed: []string{"github.com/ourorg", "github.com/ourorg/a", "github.com/ourorg/a/b/v2"},
+			denied:  []string{"github.com/ourorg/internal-fork", "github.com/ourorg/a/internal-fork", "github.com/ourorgx/a", "golang.org/x/mod"},
+		},
+		{
+			rules:   []string{"!**/internal-fork"},
+			allowed: []string{"github.com/a/b", "github.com/a/internal-fork-2"},
+			denied:  []string{"github.com/a/internal-fork", "internal-fork"},
+		},
+		{
+			rules:   []string{"github.com/*/tools", "golang.org/x/?od"},
+			allowed: []string{"github.com/a/tools", "golang.org/x/mod"},
+			denied:  []string{"github.com/a/b/tools", "golang.org/x/mmod"},
+		},
+		{
+			rules:   []string{`re:^golang\.org/x/`, `!re:/v[0-9]+$`, "golang.org/x/exp/v2"},
+			allowed: []string{"golang.org/x/mod", "golang.org/x/exp/v2"},
+			denied:  []string{"golang.org/x/mod/v2", "github.com/golang.org/x/mod"},
+		},
+	}
+	for _, test := range tests {
+		f, err := NewModuleFilter(test.rules)
+		assert.Nil(t, err)
+		for _, p := range test.allowed {
+			assert.True(t, f.Allows(p), "%v should allow %s", test.rules, p)
+		}
+		for _, p := range test.denied {
+			assert.False(t, f.Allows(p), "%v should deny %s", test.rules, p)
+		}
+	}
+
+	_, err := NewModuleFilter([]string{"re:("})
+	assert.NotNil(t, err)
+	assert.True(t, (*ModuleFilter)(nil).Allows("example.com/a"))
+}
+
+func TestLoadModuleFilterRules(t *testing.T) {
+	rulesFile := path.Join(t.TempDir(), "rules")
+	assert.Nil(t, os.WriteFile(rulesFile, []byte("# mirror our org\ngithub.com/ourorg/**\n\n  !**/internal-fork  \n"), 0o644))
+	rules, err := LoadModuleFilterRules(rulesFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"github.com/ourorg/**", "!**/internal-fork"}, rules)
+}
+
+func TestDownloadClientModuleFilter(t *testing.T) {
+	p := newTestProxy(t)
+	mods := Modules{
+		{Path: "example.com/app", Version: "v1.0.0"},
+		{Path: "example.com/lib", Version: "v1.0.0"},
+		{Path: "example.com/internal-fork", Version: "v1.0.0"},
+		{Path: "other.com/lib", Version: "v1.0.0"},
+	}
+	p.addModule(t, mods[0], map[string]string{"go.mod": "module example.com/app\n\nrequire (\n\texample.com/lib v1.0.0\n\texample.com/internal-fork v1.0.0\n)\n"})
+	for _, mod := range mods[1:] {
+		p.addModule(t, mod, map[string]string{"go.mod": "module " + mod.Path + "\n"})
+	}
+
+	filter, err := NewModuleFilter([]string{"example.com/**", "!**/internal-fork"})
+	assert.Nil(t, err)
+	stored := syncWith(t, NewDownloadClient().WithModuleFilter(filter), t.TempDir(), Modules{mods[0], mods[3]})
+	assert.ElementsMatch(t, Modules{mods[0], mods[1]}, stored)
+}
@@ -1,6 +1,7 @@
 package dl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,6 +19,10 @@ type IndexClient struct {
 	useMaxTsFromFile bool
 	maxTsLocation    string
 	MaxTs            time.Time
+	httpClient       *http.Client
+	upstreams        *Upstreams
+	archive          *IndexArchive
+	source           IndexSource
 }
 
 func NewIndexClient(useMaxTsFromFile bool) *IndexClient {
@@ -25,6 +30,8 @@ func NewIndexClient(useMaxTsFromFile bool) *IndexClient {
 		BaseUrl:          GO_INDEX,
 		useMaxTsFromFile: useMaxTsFromFile,
 		maxTsLocation:    path.Join(OUTPUT_DIR, "MAX_TS"),
+		httpClient:       http.DefaultClient,
+		upstreams:        defaultUpstreams(),
 	}
 }
 
@@ -37,6 +44,31 @@ func (c *IndexClient) WithMaxTsLocation(location string) *IndexClient {
 	return c
 }
 
+// WithRateLimiter limits all requests to the index and proxy with limiter.
+func (c *IndexClient) WithRateLimiter(limiter *RateLimiter) *IndexClient {
+	c.httpClient = limiter.Client()
+	return c
+}
+
+// WithUpstreams looks up latest versions from upstreams instead of the
+// proxies in GO_PROXY.
+func (c *IndexClient) WithUpstreams(upstreams *Upstreams) *IndexClient {
+	c.upstreams = upstreams
+	return c
+}
+
+// WithSource scrapes entries from source instead of the index.
+func (c *IndexClient) WithSource(source IndexSource) *IndexClient {
+	c.source = source
+	return c
+}
+
+// WithArchive archives every response from the index in archive.
+func (c *IndexClient) WithArchive(archive *IndexArchive) *IndexClient {
+	c.archive = archive
+	return c
+}
+
 func (c *IndexClient) LoadMaxTsFile() error {
 	maxTs, err := loadMaxTsFromFile(c.maxTsLocation)
 	if err != nil {
@@ -46,32 +78,29 @@ func (c *IndexClient) LoadMaxTsFile() error {
 	return nil
 }
 
-func (c IndexClient) Scrape(limit int) (Modules, error) {
+func (c IndexClient) Scrape(ctx context.Context, limit int) (Modules, error) {
 	if c.useMaxTsFromFile {
 		if err := c.LoadMaxTsFile(); err != nil {
 			slog.Error("failed to load MAX_TS, using default 1970-01-01", "err", err)
 		}
 	}
-	ts := strftime.Format("%Y-%m-%dT%H:%M:%S.%fZ", c.MaxTs)
-	endpoint := fmt.Sprintf("%s/index?since=%s&limit=%v", c.BaseUrl, ts, limit)
-	slog.Debug("scraper", "endpoint", endpoint)
-
-	resp, err := http.Get(endpoint)
-	if err != nil {
-		return []Module{}, err
+	var b []byte
+	var err error
+	if c.source != nil {
+		b, err = c.source.Feed(ctx, c.MaxTs, limit)
+	} else {
+		b, err = c.fetchFeed(ctx, limit)
 	}
-	defer resp.Body.Close()
-
-	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return []Module{}, err
-	}
-
-	if resp.StatusCode != 200 {
-		return Modules{}, fmt.Errorf("server responded with %v: %v", resp.Status, string(b))
+		return Modules{}, err
 	}
 
 	slog.Debug("scraper", "collectedBytes", len(b))
+	if c.archive != nil {
+		if err := c.archive.Append(b); err != nil {
+			return Modules{}, fmt.Errorf("failed to archive index feed: %w", err)
+		}
+	}
 
 	// incoming data is jsonlines, process one by one
 	modules := []Module{}
@@ -90,16 +119,57 @@ func (c IndexClient) Scrape(limit int) (Modules, error) {
 	return modules, nil
 }
 
-func (c IndexClient) GetLatestVersion(modName string) (Module, error) {
-	endpoint := fmt.Sprintf("%s/%s/@latest", GO_PROXY, modName)
-	slog.Debug("GetLatestVersion", "endpoint", endpoint)
-	resp, err := http.Get(endpoint)
+// fetchFeed fetches up to limit entries added at or after MaxTs from the index.
+func (c IndexClient) fetchFeed(ctx context.Context, limit int) ([]byte, error) {
+	ts := strftime.Format("%Y-%m-%dT%H:%M:%S.%fZ", c.MaxTs)
+	endpoint := fmt.Sprintf("%s/index?since=%s&limit=%v", c.BaseUrl, ts, limit)
+	slog.Debug("scraper", "endpoint", endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
-		return Module{}, err
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("server responded with %v: %v", resp.Status, string(b))
+	}
+	return b, nil
+}
+
+func (c IndexClient) GetLatestVersion(ctx context.Context, modName string) (Module, error) {
+	var b []byte
+	err := c.upstreams.do(ctx, nil, "latest", func(baseURL string) error {
+		endpoint := fmt.Sprintf("%s/%s/@latest", baseURL, escapePath(modName))
+		slog.Debug("GetLatestVersion", "endpoint", endpoint)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return &DownloadError{Kind: ErrTransient, URL: endpoint, Err: err}
+		}
+		defer resp.Body.Close()
+
+		b, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return &DownloadError{Kind: ErrTransient, URL: endpoint, Err: err}
+		}
+		if resp.StatusCode != http.StatusOK {
+			return classifyStatus(endpoint, resp, string(b))
+		}
+		return nil
+	})
 	if err != nil {
 		return Module{}, err
 	}
@@ -1,6 +1,7 @@
 package dl
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,7 +9,7 @@ import (
 
 func TestScrape(t *testing.T) {
 	c := NewIndexClient(false)
-	modules, err := c.Scrape(10)
+	modules, err := c.Scrape(context.Background(), 10)
 	assert.Nil(t, err)
 	assert.Greater(t, len(modules), 0)
 }
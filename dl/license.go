@@ -0,0 +1,252 @@
+package dl
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// LicenseNoAssertion is the SPDX id of license files which could not be
+// classified.
+const LicenseNoAssertion = "NOASSERTION"
+
+// quarantinePrefix is where the files of module versions quarantined by a
+// LicensePolicy are stored. It is not a valid module path, so it is not served.
+const quarantinePrefix = "quarantine"
+
+const (
+	LicenseActionSkip       = "skip"
+	LicenseActionQuarantine = "quarantine"
+)
+
+// maxLicenseSize is the size up to which license files are read.
+const maxLicenseSize = 1 << 20
+
+var licenseFileRegexp = regexp.MustCompile(`(?i)^((un)?licen[cs]e|copying)([.\-_][^/]*)?$`)
+
+var nonWordRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// License is a license file of a module version, classified to an SPDX id.
+type License struct {
+	File string
+	SPDX string
+
+	// Confidence is the share of the distinctive phrases of the license which
+	// were found in the file, from 0 to 1.
+	Confidence float64
+}
+
+// licenseTemplate are distinctive phrases of the text of a license.
+type licenseTemplate struct {
+	spdx    string
+	phrases []string
+}
+
+// licenseTemplates are the licenses which are recognised. Licenses whose text
+// contains another's, like BSD-3-Clause and BSD-2-Clause, are told apart by
+// the number of matched phrases.
+var licenseTemplates = []licenseTemplate{
+	{"MIT", []string{
+		"permission is hereby granted, free of charge, to any person obtaining a copy",
+		"to deal in the software without restriction",
+		"the above copyright notice and this permission notice shall be included in all copies or substantial portions of the software",
+		`the software is provided "as is", without warranty of any kind, express or implied`,
+	}},
+	{"ISC", []string{
+		"distribute this software for any purpose with or without fee is hereby granted",
+		"provided that the above copyright notice and this permission notice appear in all copies",
+		"disclaims all warranties with regard to this software",
+	}},
+	{"0BSD", []string{
+		"distribute this software for any purpose with or without fee is hereby granted",
+		"disclaims all warranties with regard to this software",
+	}},
+	{"BSD-2-Clause", []string{
+		"redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met",
+		"redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer",
+		"redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution",
+		`"as is" and any express or implied warranties, including, but not limited to, the implied warranties of merchantability and fitness for a particular purpose are disclaimed`,
+	}},
+	{"BSD-3-Clause", []string{
+		"redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met",
+		"redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer",
+		"redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution",
+		"may be used to endorse or promote products derived from this software without specific prior written permission",
+		`"as is" and any express or implied warranties, including, but not limited to, the implied warranties of merchantability and fitness for a particular purpose are disclaimed`,
+	}},
+	{"Apache-2.0", []string{
+		"apache license version 2.0, january 2004",
+		"terms and conditions for use, reproduction, and distribution",
+		"grant of copyright license",
+		"grant of patent license",
+	}},
+	{"MPL-2.0", []string{
+		"mozilla public license version 2.0",
+		"means each individual or legal entity that creates, contributes to the creation of, or owns covered software",
+		"secondary license",
+		"exhibit a - source code form license notice",
+	}},
+	{"GPL-2.0", []string{
+		"gnu general public license",
+		"version 2, june 1991",
+		"everyone is permitted to copy and distribute verbatim copies of this license document, but changing it is not allowed",
+		"the licenses for most software are designed to take away your freedom to share and change it",
+	}},
+	{"LGPL-2.1", []string{
+		"gnu lesser general public license",
+		"version 2.1, february 1999",
+		"everyone is permitted to copy and distribute verbatim copies of this license document, but changing it is not allowed",
+		"this license, the lesser general public license, applies to some specially designated software packages",
+	}},
+	{"GPL-3.0", []string{
+		"gnu general public license",
+		"version 3, 29 june 2007",
+		"the gnu general public license is a free, copyleft license for software and other kinds of works",
+		"everyone is permitted to copy and distribute verbatim copies of this license document, but changing it is not allowed",
+	}},
+	{"LGPL-3.0", []string{
+		"gnu lesser general public license",
+		"version 3, 29 june 2007",
+		"this version of the gnu lesser general public license incorporates the terms and conditions of version 3 of the gnu general public license",
+	}},
+	{"AGPL-3.0", []string{
+		"gnu affero general public license",
+		"version 3, 19 november 2007",
+		"the gnu affero general public license is a free, copyleft license for software and other kinds of works",
+		"everyone is permitted to copy and distribute verbatim copies of this license document, but changing it is not allowed",
+	}},
+	{"Unlicense", []string{
+		"this is free and unencumbered software released into the public domain",
+		"anyone is free to copy, modify, publish, use, compile, sell, or distribute this software",
+		"unlicense.org",
+	}},
+	{"CC0-1.0", []string{
+		"cc0 1.0 universal",
+		"statement of purpose",
+		"the laws of most jurisdictions throughout the world automatically confer exclusive copyright and related rights",
+	}},
+}
+
+func init() {
+	for _, t := range licenseTemplates {
+		for i, p := range t.phrases {
+			t.phrases[i] = normalizeLicenseText(p)
+		}
+	}
+}
+
+// normalizeLicenseText lowercases text and turns punctuation and whitespace
+// into single spaces, so texts match regardless of formatting.
+func normalizeLicenseText(text string) string {
+	return " " + strings.TrimSpace(nonWordRegexp.ReplaceAllString(strings.ToLower(text), " ")) + " "
+}
+
+// ClassifyLicense returns the SPDX id of the license in text with the highest
+// confidence, or LicenseNoAssertion if it matches none.
+func ClassifyLicense(text string) (string, float64) {
+	text = normalizeLicenseText(text)
+	best, bestConfidence, bestMatched := LicenseNoAssertion, 0.0, 0
+	for _, t := range licenseTemplates {
+		matched := 0
+		for _, p := range t.phrases {
+			if strings.Contains(text, p) {
+				matched++
+			}
+		}
+		confidence := math.Round(float64(matched)/float64(len(t.phrases))*100) / 100
+		if matched > 0 && (confidence > bestConfidence || confidence == bestConfidence && matched > bestMatched) {
+			best, bestConfidence, bestMatched = t.spdx, confidence, matched
+		}
+	}
+	return best, bestConfidence
+}
+
+// DetectLicenses classifies the license files, like LICENSE or COPYING.md, in
+// the root directory of the module zip of m, sorted by file name.
+func DetectLicenses(m Module, zipPath string) ([]License, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	prefix := m.Path + "@" + m.Version + "/"
+	licenses := []License{}
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok || strings.Contains(name, "/") || path.Ext(name) == ".go" || !licenseFileRegexp.MatchString(name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		text, err := io.ReadAll(io.LimitReader(rc, maxLicenseSize))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+		spdx, confidence := ClassifyLicense(string(text))
+		licenses = append(licenses, License{File: name, SPDX: spdx, Confidence: confidence})
+	}
+	sort.Slice(licenses, func(i, j int) bool { return licenses[i].File < licenses[j].File })
+	return licenses, nil
+}
+
+// licenseIDs returns the distinct SPDX ids of licenses.
+func licenseIDs(licenses []License) []string {
+	ids := []string{}
+	for _, l := range licenses {
+		if !slices.Contains(ids, l.SPDX) {
+			ids = append(ids, l.SPDX)
+		}
+	}
+	return ids
+}
+
+// LicensePolicy decides which licenses may be mirrored. A module version is
+// allowed if it has a license file, and every license file is classified with
+// at least MinConfidence to an SPDX id which is in Allow, if set, and not in
+// Deny. Other versions are skipped or quarantined, depending on Action.
+type LicensePolicy struct {
+	Action        string
+	Allow         []string
+	Deny          []string
+	MinConfidence float64
+}
+
+// NewLicensePolicy creates a LicensePolicy, where action is either
+// LicenseActionSkip or LicenseActionQuarantine.
+func NewLicensePolicy(action string, allow []string, deny []string, minConfidence float64) (*LicensePolicy, error) {
+	if action != LicenseActionSkip && action != LicenseActionQuarantine {
+		return nil, fmt.Errorf("unknown license policy action %q, must be one of skip or quarantine", action)
+	}
+	if minConfidence < 0 || minConfidence > 1 {
+		return nil, fmt.Errorf("license confidence must be between 0 and 1, got %v", minConfidence)
+	}
+	return &LicensePolicy{Action: action, Allow: allow, Deny: deny, MinConfidence: minConfidence}, nil
+}
+
+// Check returns an error wrapping ErrLicense if licenses are not allowed.
+func (p *LicensePolicy) Check(licenses []License) error {
+	if len(licenses) == 0 {
+		return fmt.Errorf("%w: no license file", ErrLicense)
+	}
+	for _, l := range licenses {
+		switch {
+		case l.SPDX == LicenseNoAssertion || l.Confidence < p.MinConfidence:
+			return fmt.Errorf("%w: license of %s not detected", ErrLicense, l.File)
+		case slices.Contains(p.Deny, l.SPDX):
+			return fmt.Errorf("%w: %s is denied", ErrLicense, l.SPDX)
+		case len(p.Allow) > 0 && !slices.Contains(p.Allow, l.SPDX):
+			return fmt.Errorf("%w: %s is not allowed", ErrLicense, l.SPDX)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package dl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMITLicense = `MIT License
+
+Copyright (c) 2024 Example
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY.
+`
+
+const testBSD3License = `Copyright 2009 The Go Authors.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google LLC nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED.
+`
+
+const testISCLicense = `ISC License
+
+Copyright (c) 2024 Example
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted, provided that the above
+copyright notice and this permission notice appear in all copies.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+WITH REGARD TO THIS SOFTWARE.
+`
+
+func TestClassifyLicense(t *testing.T) {
+	for text, want := range map[string]License{
+		testMITLicense:  {SPDX: "MIT", Confidence: 1},
+		testBSD3License: {SPDX: "BSD-3-Clause", Confidence: 1},
+		testISCLicense:  {SPDX: "ISC", Confidence: 1},
+		// a BSD-3-Clause without its third clause is a BSD-2-Clause
+		testBSD3License[:strings.Index(testBSD3License, "   * Neither")] + testBSD3License[strings.Index(testBSD3License, "THIS SOFTWARE"):]: {SPDX: "BSD-2-Clause", Confidence: 1},
+		// the Apache License 2.0 without its terms
+		"Apache License\nVersion 2.0, January 2004\nhttp://www.apache.org/licenses/": {SPDX: "Apache-2.0", Confidence: 0.25},
+		"All rights reserved.": {SPDX: LicenseNoAssertion},
+	} {
+		spdx, confidence := ClassifyLicense(text)
+		assert.Equal(t, want, License{SPDX: spdx, Confidence: confidence}, text)
+	}
+}
+
+func TestLicensePolicy(t *testing.T) {
+	_, err := NewLicensePolicy("delete", nil, nil, 0.75)
+	assert.NotNil(t, err)
+	_, err = NewLicensePolicy(LicenseActionSkip, nil, nil, 2)
+	assert.NotNil(t, err)
+
+	mit := License{File: "LICENSE", SPDX: "MIT", Confidence: 1}
+	gpl := License{File: "COPYING", SPDX: "GPL-3.0", Confidence: 1}
+	policy, err := NewLicensePolicy(LicenseActionSkip, nil, []string{"GPL-3.0"}, 0.75)
+	assert.Nil(t, err)
+	assert.Nil(t, policy.Check([]License{mit}))
+	assert.True(t, errors.Is(policy.Check([]License{mit, gpl}), ErrLicense))
+	assert.True(t, errors.Is(policy.Check(nil), ErrLicense))
+	assert.True(t, errors.Is(policy.Check([]License{{File: "LICENSE", SPDX: "MIT", Confidence: 0.5}}), ErrLicense))
+	assert.True(t, errors.Is(policy.Check([]License{mit, {File: "LICENSE.md", SPDX: LicenseNoAssertion}}), ErrLicense))
+
+	policy, err = NewLicensePolicy(LicenseActionSkip, []string{"MIT", "BSD-3-Clause"}, nil, 0.75)
+	assert.Nil(t, err)
+	assert.Nil(t, policy.Check([]License{mit, {File: "LICENSE-BSD", SPDX: "BSD-3-Clause", Confidence: 1}}))
+	assert.True(t, errors.Is(policy.Check([]License{gpl}), ErrLicense))
+}
+
+func TestDownloadClientLicensePolicy(t *testing.T) {
+	p := newTestProxy(t)
+	mit := Module{Path: "example.com/mit", Version: "v1.0.0"}
+	p.addModule(t, mit, map[string]string{
+		"go.mod":      "module example.com/mit\n",
+		"LICENSE":     testMITLicense,
+		"license.go":  "package mit\n",
+		"sub/LICENSE": "All rights reserved.\n",
+	})
+	unlicensed := Module{Path: "example.com/unlicensed", Version: "v1.0.0"}
+	p.addModule(t, unlicensed, map[string]string{"go.mod": "module example.com/unlicensed\n"})
+	isc := Module{Path: "example.com/isc", Version: "v1.0.0"}
+	p.addModule(t, isc, map[string]string{"go.mod": "module example.com/isc\n", "COPYING.md": testISCLicense})
+
+	dir := t.TempDir()
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+	policy, err := NewLicensePolicy(LicenseActionSkip, []string{"MIT"}, nil, 0.75)
+	assert.Nil(t, err)
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithStateStore(stateStore).
+		WithLicensePolicy(policy)
+	ctx := context.Background()
+
+	// license files in subdirectories do not apply to the module
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(mit, false, 0)))
+	state, found, err := stateStore.Get(mit)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []License{{File: "LICENSE", SPDX: "MIT", Confidence: 1}}, state.Licenses)
+	annotated, err := stateStore.Annotate(mit)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"MIT"}, annotated.Licenses)
+
+	// required versions are subject to the policy as well
+	err = c.Download(ctx, NewDownloadRequest(unlicensed, true, 0))
+	assert.True(t, errors.Is(err, ErrLicense))
+	assert.False(t, fileExists(path.Join(dir, "example.com/unlicensed/@v/v1.0.0.zip")))
+
+	policy.Action = LicenseActionQuarantine
+	err = c.Download(ctx, NewDownloadRequest(isc, false, 0))
+	assert.True(t, errors.Is(err, ErrQuarantined))
+	assert.True(t, errors.Is(err, ErrLicense))
+	assert.False(t, fileExists(path.Join(dir, "example.com/isc/@v/v1.0.0.zip")))
+	for _, ext := range []string{".zip", ".ziphash", ".mod", ".info"} {
+		assert.True(t, fileExists(path.Join(dir, "quarantine/example.com/isc/@v/v1.0.0"+ext)), ext)
+	}
+	state, _, err = stateStore.Get(isc)
+	assert.Nil(t, err)
+	assert.Equal(t, []License{{File: "COPYING.md", SPDX: "ISC", Confidence: 1}}, state.Licenses)
+
+	// quarantined versions are neither listed nor served
+	stored, err := ListStoredModules(ctx, NewLocalStore(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, Modules{mit}, stored)
+	srv := httptest.NewServer(NewProxyServer().WithOutputDir(dir))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/quarantine/example.com/isc/@v/v1.0.0.zip")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+
+	// licenses are recorded without a policy
+	os.RemoveAll(path.Join(dir, "quarantine"))
+	c.WithLicensePolicy(nil)
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(isc, false, 0)))
+	assert.True(t, fileExists(path.Join(dir, "example.com/isc/@v/v1.0.0.zip")))
+}
@@ -0,0 +1,245 @@
+package dl
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+type VersionClass string
+
+const (
+	VersionClassRelease    = "release"
+	VersionClassPrerelease = "prerelease"
+	VersionClassPseudo     = "pseudo"
+)
+
+// VersionClass classifies the version of m as a release, pre-release or
+// pseudo-version.
+func (m Module) VersionClass() VersionClass {
+	switch {
+	case m.IsPseudoVersion():
+		return VersionClassPseudo
+	case semver.Prerelease(m.Version) != "":
+		return VersionClassPrerelease
+	default:
+		return VersionClassRelease
+	}
+}
+
+// ParseVersionClass parses "release", "prerelease" or "pseudo".
+func ParseVersionClass(s string) (VersionClass, error) {
+	switch class := VersionClass(strings.ToLower(s)); class {
+	case VersionClassRelease, VersionClassPrerelease, VersionClassPseudo:
+		return class, nil
+	}
+	return "", fmt.Errorf("unknown version class %q, must be one of release, prerelease or pseudo", s)
+}
+
+// ParseTimestamp parses an RFC 3339 timestamp, or a date like 2024-01-31
+// which is midnight UTC.
+func ParseTimestamp(s string) (time.Time, error) {
+	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ts, nil
+	}
+	if ts, err := time.Parse(time.DateOnly, s); err == nil {
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, must be RFC 3339 like 2024-01-31T15:04:05Z or a date like 2024-01-31", s)
+}
+
+// ModuleQuery selects modules listed from the index. Zero fields select everything.
+type ModuleQuery struct {
+	// Since and Until bound the index timestamps, inclusive.
+	Since time.Time
+	Until time.Time
+
+	// PathPrefixes are prefixes of which a module path must have one.
+	PathPrefixes []string
+
+	// PathRegexp must match the module path.
+	PathRegexp *regexp.Regexp
+
+	// VersionClasses are the classes of which a version must be one.
+	VersionClasses []VersionClass
+}
+
+// Done reports whether m, and therefore every module after it in the index,
+// is past Until.
+func (q ModuleQuery) Done(m Module) bool {
+	return !q.Until.IsZero() && m.Timestamp.After(q.Until)
+}
+
+// Matches reports whether m is selected by the query.
+func (q ModuleQuery) Matches(m Module) bool {
+	if m.Timestamp.Before(q.Since) || q.Done(m) {
+		return false
+	}
+	if len(q.PathPrefixes) > 0 && !hasAnyPrefix(m.Path, q.PathPrefixes) {
+		return false
+	}
+	if q.PathRegexp != nil && !q.PathRegexp.MatchString(m.Path) {
+		return false
+	}
+	if len(q.VersionClasses) > 0 {
+		class := m.VersionClass()
+		for _, c := range q.VersionClasses {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Select returns the modules of ms matched by q, and whether any of them is
+// past Until, in which case there is nothing more to select in the index.
+func (q ModuleQuery) Select(ms Modules) (Modules, bool) {
+	selected := Modules{}
+	done := false
+	for _, m := range ms {
+		if q.Done(m) {
+			done = true
+		} else if q.Matches(m) {
+			selected = append(selected, m)
+		}
+	}
+	return selected, done
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ListFormatJSONL    = "jsonl"
+	ListFormatCSV      = "csv"
+	ListFormatTable    = "table"
+	ListFormatTemplate = "template"
+)
+
+// ModuleWriter writes listed modules in some format. Flush must be called
+// after the last module.
+type ModuleWriter interface {
+	Write(m AnnotatedModule) error
+	Flush() error
+}
+
+// NewModuleWriter creates a writer of format, one of jsonl, csv, table or
+// template. Templates are executed once per module with an AnnotatedModule,
+// followed by a newline like in 'go list -f'. With annotated, the csv and
+// table formats include the annotations as columns.
+func NewModuleWriter(w io.Writer, format string, tmpl string, annotated bool) (ModuleWriter, error) {
+	columns := []string{"timestamp", "path", "version"}
+	if annotated {
+		columns = append(columns, "retracted", "deprecated", "vulns", "licenses")
+	}
+	switch format {
+	case ListFormatJSONL:
+		return &jsonlModuleWriter{enc: json.NewEncoder(w)}, nil
+	case ListFormatCSV:
+		cw := csv.NewWriter(w)
+		return &csvModuleWriter{w: cw, columns: columns}, cw.Write(columns)
+	case ListFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		_, err := fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		return &tableModuleWriter{w: tw, columns: columns}, err
+	case ListFormatTemplate:
+		if tmpl == "" {
+			return nil, fmt.Errorf("the template format requires a template")
+		}
+		t, err := template.New("module").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %w", err)
+		}
+		return &templateModuleWriter{w: w, t: t}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, must be one of jsonl, csv, table or template", format)
+}
+
+// moduleRecord returns the values of columns for m.
+func moduleRecord(m AnnotatedModule, columns []string) []string {
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "timestamp":
+			record[i] = m.Timestamp.UTC().Format(time.RFC3339Nano)
+		case "path":
+			record[i] = m.Path
+		case "version":
+			record[i] = m.Version
+		case "retracted":
+			record[i] = strconv.FormatBool(m.Retracted)
+		case "deprecated":
+			record[i] = m.Deprecated
+		case "vulns":
+			record[i] = strings.Join(m.Vulns, " ")
+		case "licenses":
+			record[i] = strings.Join(m.Licenses, " ")
+		}
+	}
+	return record
+}
+
+type jsonlModuleWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonlModuleWriter) Write(m AnnotatedModule) error { return w.enc.Encode(m) }
+func (w *jsonlModuleWriter) Flush() error                  { return nil }
+
+type csvModuleWriter struct {
+	w       *csv.Writer
+	columns []string
+}
+
+func (w *csvModuleWriter) Write(m AnnotatedModule) error {
+	return w.w.Write(moduleRecord(m, w.columns))
+}
+
+func (w *csvModuleWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type tableModuleWriter struct {
+	w       *tabwriter.Writer
+	columns []string
+}
+
+func (w *tableModuleWriter) Write(m AnnotatedModule) error {
+	_, err := fmt.Fprintln(w.w, strings.Join(moduleRecord(m, w.columns), "\t"))
+	return err
+}
+
+func (w *tableModuleWriter) Flush() error { return w.w.Flush() }
+
+type templateModuleWriter struct {
+	w io.Writer
+	t *template.Template
+}
+
+func (w *templateModuleWriter) Write(m AnnotatedModule) error {
+	if err := w.t.Execute(w.w, m); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, "\n")
+	return err
+}
+
+func (w *templateModuleWriter) Flush() error { return nil }
@@ -0,0 +1,104 @@
+package dl
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuleQuery(t *testing.T) {
+	ts := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	release := Module{Timestamp: ts, Path: "github.com/org/a", Version: "v1.0.0"}
+	prerelease := Module{Timestamp: ts, Path: "github.com/org/b", Version: "v1.1.0-rc.1"}
+	pseudo := Module{Timestamp: ts, Path: "golang.org/x/c", Version: "v0.0.0-20240131120000-abcdefabcdef"}
+	assert.Equal(t, VersionClass(VersionClassRelease), release.VersionClass())
+	assert.Equal(t, VersionClass(VersionClassPrerelease), prerelease.VersionClass())
+	assert.Equal(t, VersionClass(VersionClassPseudo), pseudo.VersionClass())
+
+	assert.True(t, ModuleQuery{}.Matches(release))
+	assert.True(t, ModuleQuery{Since: ts, Until: ts}.Matches(release))
+	assert.False(t, ModuleQuery{Since: ts.Add(time.Second)}.Matches(release))
+	assert.False(t, ModuleQuery{Until: ts.Add(-time.Second)}.Matches(release))
+	assert.True(t, ModuleQuery{Until: ts.Add(-time.Second)}.Done(release))
+
+	byPath := ModuleQuery{PathPrefixes: []string{"github.com/org/"}, PathRegexp: regexp.MustCompile(`/a$`)}
+	assert.True(t, byPath.Matches(release))
+	assert.False(t, byPath.Matches(prerelease))
+	assert.False(t, byPath.Matches(pseudo))
+
+	byClass := ModuleQuery{VersionClasses: []VersionClass{VersionClassPrerelease, VersionClassPseudo}}
+	assert.False(t, byClass.Matches(release))
+	assert.True(t, byClass.Matches(prerelease))
+	assert.True(t, byClass.Matches(pseudo))
+
+	window := ModuleQuery{Since: ts, Until: ts.Add(time.Hour)}
+	before := Module{Timestamp: ts.Add(-time.Second), Path: "example.com/before", Version: "v1.0.0"}
+	after := Module{Timestamp: ts.Add(2 * time.Hour), Path: "example.com/after", Version: "v1.0.0"}
+	selected, done := window.Select(Modules{before, release, pseudo})
+	assert.Equal(t, Modules{release, pseudo}, selected)
+	assert.False(t, done)
+	selected, done = window.Select(Modules{release, after})
+	assert.Equal(t, Modules{release}, selected)
+	assert.True(t, done)
+
+	_, err := ParseVersionClass("nightly")
+	assert.NotNil(t, err)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	ts, err := ParseTimestamp("2024-01-31")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), ts)
+	ts, err = ParseTimestamp("2024-01-31T12:00:00.5Z")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 1, 31, 12, 0, 0, 5e8, time.UTC), ts)
+	_, err = ParseTimestamp("yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestModuleWriter(t *testing.T) {
+	mods := []AnnotatedModule{
+		{Module: Module{Timestamp: time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), Path: "example.com/a", Version: "v1.0.0"}},
+		{Module: Module{Timestamp: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Path: "example.com/b", Version: "v0.1.0"}, Retracted: true, Deprecated: "use a, b", Vulns: []string{"GO-2024-0001", "GO-2024-0002"}, Licenses: []string{"MIT"}},
+	}
+	write := func(format string, tmpl string, annotated bool) string {
+		out := bytes.Buffer{}
+		w, err := NewModuleWriter(&out, format, tmpl, annotated)
+		assert.Nil(t, err)
+		for _, m := range mods {
+			assert.Nil(t, w.Write(m))
+		}
+		assert.Nil(t, w.Flush())
+		return out.String()
+	}
+
+	assert.Equal(t, `{"Timestamp":"2024-01-31T12:00:00Z","Path":"example.com/a","Version":"v1.0.0"}
+{"Timestamp":"2024-02-01T00:00:00Z","Path":"example.com/b","Version":"v0.1.0","Retracted":true,"Deprecated":"use a, b","Vulns":["GO-2024-0001","GO-2024-0002"],"Licenses":["MIT"]}
+`, write(ListFormatJSONL, "", false))
+
+	assert.Equal(t, `timestamp,path,version
+2024-01-31T12:00:00Z,example.com/a,v1.0.0
+2024-02-01T00:00:00Z,example.com/b,v0.1.0
+`, write(ListFormatCSV, "", false))
+	assert.Equal(t, `timestamp,path,version,retracted,deprecated,vulns,licenses
+2024-01-31T12:00:00Z,example.com/a,v1.0.0,false,,,
+2024-02-01T00:00:00Z,example.com/b,v0.1.0,true,"use a, b",GO-2024-0001 GO-2024-0002,MIT
+`, write(ListFormatCSV, "", true))
+
+	assert.Equal(t, `TIMESTAMP             PATH           VERSION
+2024-01-31T12:00:00Z  example.com/a  v1.0.0
+2024-02-01T00:00:00Z  example.com/b  v0.1.0
+`, write(ListFormatTable, "", false))
+
+	assert.Equal(t, "example.com/a@v1.0.0\nexample.com/b@v0.1.0 retracted\n", write(ListFormatTemplate, "{{.Path}}@{{.Version}}{{if .Retracted}} retracted{{end}}", false))
+
+	for _, format := range []string{"xml", ListFormatTemplate} {
+		_, err := NewModuleWriter(&bytes.Buffer{}, format, "", false)
+		assert.NotNil(t, err)
+	}
+	_, err := NewModuleWriter(&bytes.Buffer{}, ListFormatTemplate, "{{.Path", false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,149 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// Retraction is a range of versions retracted by a retract directive, see
+// https://go.dev/ref/mod#go-mod-file-retract.
+type Retraction struct {
+	Low       string
+	High      string
+	Rationale string `json:",omitempty"`
+}
+
+// PathMetadata is what is known about a module path from the go.mod of its
+// latest version.
+type PathMetadata struct {
+	Path          string
+	LatestVersion string
+	Retractions   []Retraction `json:",omitempty"`
+
+	// Deprecated is the message of a "// Deprecated:" comment on the module directive.
+	Deprecated string `json:",omitempty"`
+
+	Updated time.Time
+}
+
+// Retraction returns the retraction covering version, if any.
+func (m PathMetadata) Retraction(version string) (Retraction, bool) {
+	for _, r := range m.Retractions {
+		if semver.Compare(r.Low, version) <= 0 && semver.Compare(version, r.High) <= 0 {
+			return r, true
+		}
+	}
+	return Retraction{}, false
+}
+
+// AnnotatedModule is a module version together with what is known about it.
+type AnnotatedModule struct {
+	Module
+	Retracted        bool   `json:",omitempty"`
+	RetractRationale string `json:",omitempty"`
+	Deprecated       string `json:",omitempty"`
+
+	// Vulns are the ids of the vulnerabilities affecting the module version.
+	Vulns []string `json:",omitempty"`
+
+	// Licenses are the SPDX ids of the licenses of the module version.
+	Licenses []string `json:",omitempty"`
+}
+
+// Annotate annotates m with the metadata recorded for its path, if any.
+func (m PathMetadata) Annotate(mod Module) AnnotatedModule {
+	a := AnnotatedModule{Module: mod, Deprecated: m.Deprecated}
+	if r, ok := m.Retraction(mod.Version); ok {
+		a.Retracted = true
+		a.RetractRationale = r.Rationale
+	}
+	return a
+}
+
+// parsePathMetadata extracts the retractions and deprecation from the go.mod
+// of the latest version of a module.
+func parsePathMetadata(latest Module, modData []byte) (PathMetadata, error) {
+	f, err := modfile.ParseLax("go.mod", modData, nil)
+	if err != nil {
+		return PathMetadata{}, err
+	}
+	meta := PathMetadata{Path: latest.Path, LatestVersion: latest.Version, Updated: time.Now().UTC()}
+	if f.Module != nil {
+		meta.Deprecated = f.Module.Deprecated
+	}
+	for _, r := range f.Retract {
+		meta.Retractions = append(meta.Retractions, Retraction{Low: r.Low, High: r.High, Rationale: r.Rationale})
+	}
+	return meta, nil
+}
+
+// listVersions returns the valid versions of a list file, sorted.
+func listVersions(list []byte) []string {
+	versions := []string{}
+	for _, line := range strings.Split(string(list), "\n") {
+		if version := strings.TrimSpace(line); semver.IsValid(version) {
+			versions = append(versions, version)
+		}
+	}
+	semver.Sort(versions)
+	return versions
+}
+
+// pathMetadata returns the metadata of modPath, reading it from the latest
+// .mod at most once per batch, where list is the list of versions of modPath.
+// The metadata is recorded in the state store, if set.
+func (c *DownloadClient) pathMetadata(ctx context.Context, modPath string, list []byte) (PathMetadata, error) {
+	if c.pathMetadataCache.Exists(modPath) {
+		return c.pathMetadataCache.Get(modPath), nil
+	}
+
+	latest := Module{Path: modPath, Version: latestVersion(listVersions(list))}
+	if latest.Version == "" {
+		// nothing is tagged, the latest version is a pseudo-version
+		tmpPath, err := c.fetchFile(ctx, modPath, "latest", nil)
+		if err != nil {
+			return PathMetadata{}, err
+		}
+		data, err := os.ReadFile(tmpPath)
+		os.Remove(tmpPath)
+		if err != nil {
+			return PathMetadata{}, err
+		}
+		if err := json.Unmarshal(data, &latest); err != nil {
+			return PathMetadata{}, fmt.Errorf("failed to parse latest of %s: %w", modPath, err)
+		}
+	}
+
+	modData, err := readStoreFile(ctx, c.store, moduleKey(modPath, latest.Version+".mod"))
+	if err != nil {
+		tmpPath, err := c.fetchFile(ctx, modPath, latest.Version+".mod", nil)
+		if err != nil {
+			return PathMetadata{}, err
+		}
+		modData, err = os.ReadFile(tmpPath)
+		os.Remove(tmpPath)
+		if err != nil {
+			return PathMetadata{}, err
+		}
+	}
+
+	meta, err := parsePathMetadata(latest, modData)
+	if err != nil {
+		return PathMetadata{}, fmt.Errorf("failed to parse go.mod of %s: %w", latest, err)
+	}
+	c.pathMetadataCache.Set(modPath, meta)
+	if c.stateStore != nil {
+		if err := c.stateStore.PutPathMetadata(meta); err != nil {
+			slog.Error("failed to update state store", "modPath", modPath, "err", err)
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,105 @@
+package dl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePathMetadata(t *testing.T) {
+	latest := Module{Path: "example.com/a", Version: "v1.3.0"}
+	meta, err := parsePathMetadata(latest, []byte(`// Deprecated: use example.com/b instead.
+module example.com/a
+
+retract (
+	v1.0.0 // published by accident
+	[v1.1.0, v1.2.0]
+)
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.3.0", meta.LatestVersion)
+	assert.Equal(t, "use example.com/b instead.", meta.Deprecated)
+	assert.Len(t, meta.Retractions, 2)
+
+	r, ok := meta.Retraction("v1.0.0")
+	assert.True(t, ok)
+	assert.Equal(t, "published by accident", r.Rationale)
+	_, ok = meta.Retraction("v1.1.5")
+	assert.True(t, ok)
+	_, ok = meta.Retraction("v1.3.0")
+	assert.False(t, ok)
+
+	annotated := meta.Annotate(Module{Path: "example.com/a", Version: "v1.0.0"})
+	assert.True(t, annotated.Retracted)
+	assert.Equal(t, "published by accident", annotated.RetractRationale)
+	assert.Equal(t, "use example.com/b instead.", annotated.Deprecated)
+
+	assert.Equal(t, []string{"v1.0.0", "v1.2.0", "v1.10.0"}, listVersions([]byte("v1.10.0\nv1.0.0\n\nv1.2.0\n")))
+}
+
+func TestStateStorePathMetadata(t *testing.T) {
+	store, err := OpenStateStore(path.Join(t.TempDir(), "state.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	mod := Module{Path: "example.com/a", Version: "v1.0.0"}
+	annotated, err := store.Annotate(mod)
+	assert.Nil(t, err)
+	assert.Equal(t, AnnotatedModule{Module: mod}, annotated)
+
+	assert.Nil(t, store.PutPathMetadata(PathMetadata{
+		Path:          mod.Path,
+		LatestVersion: "v1.1.0",
+		Retractions:   []Retraction{{Low: "v1.0.0", High: "v1.0.0"}},
+	}))
+	annotated, err = store.Annotate(mod)
+	assert.Nil(t, err)
+	assert.True(t, annotated.Retracted)
+}
+
+func TestDownloadClientSkipRetracted(t *testing.T) {
+	p := newTestProxy(t)
+	retracted := Module{Path: "example.com/retracted", Version: "v1.0.0"}
+	latest := Module{Path: "example.com/retracted", Version: "v1.1.0"}
+	p.addModule(t, retracted, map[string]string{"go.mod": "module example.com/retracted\n"})
+	p.addModule(t, latest, map[string]string{"go.mod": "// Deprecated: do not use.\nmodule example.com/retracted\n\nretract v1.0.0 // broken\n"})
+	writeTestFiles(t, path.Join(p.dir, "example.com/retracted/@v"), map[string]string{"list": "v1.0.0\nv1.1.0\n"})
+
+	dir := t.TempDir()
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithStateStore(stateStore).
+		WithSkipRetracted(true)
+	ctx := context.Background()
+
+	err = c.Download(ctx, NewDownloadRequest(retracted, false, 0))
+	assert.True(t, errors.Is(err, ErrRetracted))
+	_, err = os.Stat(path.Join(dir, "example.com/retracted/@v/v1.0.0.zip"))
+	assert.True(t, os.IsNotExist(err))
+
+	// the latest .mod is fetched only to read the retractions
+	_, err = os.Stat(path.Join(dir, "example.com/retracted/@v/v1.1.0.mod"))
+	assert.True(t, os.IsNotExist(err))
+
+	meta, found, err := stateStore.GetPathMetadata(retracted.Path)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "v1.1.0", meta.LatestVersion)
+	assert.Equal(t, "do not use.", meta.Deprecated)
+	assert.Equal(t, []Retraction{{Low: "v1.0.0", High: "v1.0.0", Rationale: "broken"}}, meta.Retractions)
+
+	// required retracted versions are downloaded regardless
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(retracted, true, 0)))
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(latest, false, 0)))
+	stored, err := ListStoredModules(ctx, NewLocalStore(dir))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, Modules{retracted, latest}, stored)
+}
@@ -0,0 +1,246 @@
+package dl
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	downloadDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	batchDurationBuckets    = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// Metrics collects sync and download metrics, and exposes them in the
+// Prometheus text format, see https://prometheus.io/docs/instrumenting/exposition_formats/.
+// A nil *Metrics discards everything.
+type Metrics struct {
+	mtx        sync.Mutex
+	families   map[string]*metricFamily
+	gaugeFuncs []gaugeFunc
+
+	indexCursor time.Time
+	now         func() time.Time
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+
+	// values holds counter values and histogram sums, keyed by label set
+	values map[string]float64
+
+	// counts holds the cumulative histogram bucket counts, keyed by label set
+	counts map[string][]uint64
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are written.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{families: map[string]*metricFamily{}, now: time.Now}
+	m.family("go_index_dl_requests_total", "Download requests by final status of each attempt.", "counter", nil)
+	m.family("go_index_dl_downloaded_bytes_total", "Bytes downloaded from upstream by file type.", "counter", nil)
+	m.family("go_index_dl_download_duration_seconds", "Latency of downloads from upstream by file type.", "histogram", downloadDurationBuckets)
+	m.family("go_index_dl_batch_duration_seconds", "Time taken to download a batch from the index.", "histogram", batchDurationBuckets)
+	m.family("go_index_dl_upstream_requests_total", "Requests to each upstream proxy by file type and result.", "counter", nil)
+	m.family("go_index_dl_upstream_healthy", "Whether each upstream proxy is healthy, 1, or skipped after repeated failures, 0.", "gauge", nil)
+	return m
+}
+
+func (m *Metrics) family(name string, help string, kind string, buckets []float64) *metricFamily {
+	f := &metricFamily{name: name, help: help, kind: kind, buckets: buckets, values: map[string]float64{}, counts: map[string][]uint64{}}
+	m.families[name] = f
+	return f
+}
+
+// labels formats label pairs such as "file", ".zip" as {file=".zip"}.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *Metrics) add(name string, v float64, labelPairs ...string) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.families[name].values[labels(labelPairs...)] += v
+}
+
+func (m *Metrics) set(name string, v float64, labelPairs ...string) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.families[name].values[labels(labelPairs...)] = v
+}
+
+func (m *Metrics) observe(name string, v float64, labelPairs ...string) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f := m.families[name]
+	l := labels(labelPairs...)
+	if _, ok := f.counts[l]; !ok {
+		f.counts[l] = make([]uint64, len(f.buckets)+1)
+	}
+	for i, b := range f.buckets {
+		if v <= b {
+			f.counts[l][i]++
+		}
+	}
+	f.counts[l][len(f.buckets)]++
+	f.values[l] += v
+}
+
+// GaugeFunc registers a gauge which is read by calling fn. A gauge registered
+// again under the same name is the sum of every fn, like the queued requests
+// of several download clients syncing concurrently.
+func (m *Metrics) GaugeFunc(name string, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for i, g := range m.gaugeFuncs {
+		if g.name == name {
+			m.gaugeFuncs[i].fn = func() float64 { return g.fn() + fn() }
+			return
+		}
+	}
+	m.gaugeFuncs = append(m.gaugeFuncs, gaugeFunc{name: name, help: help, fn: fn})
+}
+
+// SetIndexCursor records the timestamp up to which the index has been synced.
+func (m *Metrics) SetIndexCursor(ts time.Time) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.indexCursor = ts
+}
+
+func (m *Metrics) recordRequest(status DownloadStatus) {
+	m.add("go_index_dl_requests_total", 1, "status", string(status))
+}
+
+func (m *Metrics) recordDownload(fileType string, duration time.Duration, size int64) {
+	m.add("go_index_dl_downloaded_bytes_total", float64(size), "file", fileType)
+	m.observe("go_index_dl_download_duration_seconds", duration.Seconds(), "file", fileType)
+}
+
+func (m *Metrics) recordBatch(duration time.Duration) {
+	m.observe("go_index_dl_batch_duration_seconds", duration.Seconds())
+}
+
+func (m *Metrics) recordUpstream(url string, fileType string, result string, healthy bool) {
+	m.add("go_index_dl_upstream_requests_total", 1, "upstream", url, "file", fileType, "result", result)
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	m.set("go_index_dl_upstream_healthy", v, "upstream", url)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mtx.Lock()
+	gauges := append([]gaugeFunc{}, m.gaugeFuncs...)
+	if !m.indexCursor.IsZero() {
+		cursor := m.indexCursor
+		gauges = append(gauges,
+			gaugeFunc{"go_index_dl_index_cursor_timestamp_seconds", "Timestamp of the last synced index entry.", func() float64 { return float64(cursor.UnixNano()) / 1e9 }},
+			gaugeFunc{"go_index_dl_index_cursor_lag_seconds", "Time since the last synced index entry was published.", func() float64 { return m.now().Sub(cursor).Seconds() }},
+		)
+	}
+
+	b := strings.Builder{}
+	names := []string{}
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, l := range sortedKeys(f.values) {
+			if f.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, l, formatFloat(f.values[l]))
+				continue
+			}
+			counts := f.counts[l]
+			for i, count := range counts {
+				le := math.Inf(1)
+				if i < len(f.buckets) {
+					le = f.buckets[i]
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(l, "le", formatFloat(le)), count)
+			}
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, l, formatFloat(f.values[l]))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, l, counts[len(f.buckets)])
+		}
+	}
+	m.mtx.Unlock()
+
+	sort.Slice(gauges, func(i, j int) bool { return gauges[i].name < gauges[j].name })
+	for _, g := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withLabel adds a label to a formatted label set.
+func withLabel(l string, name string, value string) string {
+	extra := name + "=" + strconv.Quote(value)
+	if l == "" {
+		return "{" + extra + "}"
+	}
+	return strings.TrimSuffix(l, "}") + "," + extra + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
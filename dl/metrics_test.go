@@ -0,0 +1,97 @@
+package dl
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.now = func() time.Time { return time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC) }
+	m.recordRequest(DownloadStatusCompleted)
+	m.recordRequest(DownloadStatusCompleted)
+	m.recordRequest(DownloadStatusFailed)
+	m.recordDownload(".zip", 300*time.Millisecond, 1024)
+	m.recordDownload(".zip", 2*time.Second, 1024)
+	m.recordBatch(45 * time.Second)
+	m.GaugeFunc("go_index_dl_requests_queued", "Download requests waiting to be processed.", func() float64 { return 3 })
+	m.SetIndexCursor(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	out := string(b)
+
+	for _, line := range []string{
+		"# TYPE go_index_dl_requests_total counter",
+		`go_index_dl_requests_total{status="completed"} 2`,
+		`go_index_dl_requests_total{status="failed"} 1`,
+		`go_index_dl_downloaded_bytes_total{file=".zip"} 2048`,
+		"# TYPE go_index_dl_download_duration_seconds histogram",
+		`go_index_dl_download_duration_seconds_bucket{file=".zip",le="0.25"} 0`,
+		`go_index_dl_download_duration_seconds_bucket{file=".zip",le="0.5"} 1`,
+		`go_index_dl_download_duration_seconds_bucket{file=".zip",le="+Inf"} 2`,
+		`go_index_dl_download_duration_seconds_sum{file=".zip"} 2.3`,
+		`go_index_dl_download_duration_seconds_count{file=".zip"} 2`,
+		`go_index_dl_batch_duration_seconds_bucket{le="60"} 1`,
+		"go_index_dl_batch_duration_seconds_count 1",
+		"go_index_dl_requests_queued 3",
+		"go_index_dl_index_cursor_timestamp_seconds 1.7040672e+09",
+		"go_index_dl_index_cursor_lag_seconds 3600",
+	} {
+		assert.Contains(t, strings.Split(out, "\n"), line)
+	}
+
+	// nil metrics discard everything
+	var nilMetrics *Metrics
+	nilMetrics.recordRequest(DownloadStatusCompleted)
+	nilMetrics.SetIndexCursor(time.Now())
+}
+
+func TestDownloadClientMetrics(t *testing.T) {
+	p := newTestProxy(t)
+	mod := Module{Path: "example.com/measured", Version: "v1.0.0"}
+	p.addModule(t, mod, map[string]string{"go.mod": "module example.com/measured\n"})
+
+	m := NewMetrics()
+	syncWith(t, NewDownloadClient().WithMetrics(m), t.TempDir(), Modules{mod})
+
+	out := strings.Builder{}
+	_, err := m.WriteTo(&out)
+	assert.Nil(t, err)
+	lines := strings.Split(out.String(), "\n")
+	assert.Contains(t, lines, `go_index_dl_requests_total{status="completed"} 1`)
+	assert.Contains(t, lines, `go_index_dl_downloaded_bytes_total{file=".mod"} 28`)
+	assert.Contains(t, lines, `go_index_dl_download_duration_seconds_count{file=".zip"} 1`)
+	assert.Contains(t, lines, `go_index_dl_download_duration_seconds_count{file="list"} 1`)
+	assert.Contains(t, lines, "go_index_dl_batch_duration_seconds_count 1")
+	assert.Contains(t, lines, "go_index_dl_requests_inflight 0")
+}
+
+func TestMetricsSeveralDownloadClients(t *testing.T) {
+	m := NewMetrics()
+	a := NewDownloadClient().WithMetrics(m)
+	b := NewDownloadClient().WithMetrics(m)
+	a.stats.queuedRequests.Add(2)
+	b.stats.queuedRequests.Add(3)
+	b.stats.inflightRequests.Add(1)
+
+	out := strings.Builder{}
+	_, err := m.WriteTo(&out)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(out.String(), "# TYPE go_index_dl_requests_queued gauge"))
+	assert.Equal(t, 1, strings.Count(out.String(), "# TYPE go_index_dl_requests_inflight gauge"))
+	lines := strings.Split(out.String(), "\n")
+	assert.Contains(t, lines, "go_index_dl_requests_queued 5")
+	assert.Contains(t, lines, "go_index_dl_requests_inflight 1")
+}
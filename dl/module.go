@@ -1,12 +1,16 @@
 package dl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"regexp"
+	"strings"
 	"time"
+
+	"golang.org/x/mod/semver"
 )
 
 // Module represents one entry at https://index.golang.org/index?limit=1
@@ -16,10 +20,6 @@ type Module struct {
 	Version   string
 }
 
-func (m Module) BaseURL() string {
-	return fmt.Sprintf("%s/%s/@v/%s", GO_PROXY, m.Path, m.Version)
-}
-
 func (m Module) AsJSON() string {
 	b, err := json.Marshal(m)
 	if err != nil {
@@ -51,3 +51,22 @@ func (ms Modules) GetMaxTs() time.Time {
 	}
 	return maxTs
 }
+
+// ListStoredModules lists a store populated by DownloadClient.Download and
+// returns every module version which has a .mod file.
+func ListStoredModules(ctx context.Context, store Store) (Modules, error) {
+	keys, err := store.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	mods := Modules{}
+	for _, key := range keys {
+		modPath, file, ok := strings.Cut(key, "/@v/")
+		version := strings.TrimSuffix(file, ".mod")
+		if !ok || strings.HasPrefix(key, quarantinePrefix+"/") || version == file || strings.Contains(file, "/") || !semver.IsValid(version) {
+			continue
+		}
+		mods = append(mods, Module{Path: modPath, Version: version})
+	}
+	return mods, nil
+}
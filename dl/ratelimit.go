@@ -0,0 +1,187 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimits are limits on upstream traffic. Zero means unlimited.
+type RateLimits struct {
+	RequestsPerSecond float64
+	BytesPerSecond    float64
+}
+
+// RateLimiter limits the requests and bytes per second sent to and received
+// from upstream, both in total and per host. The limits can be changed while
+// requests are in flight.
+type RateLimiter struct {
+	mtx     sync.Mutex
+	global  RateLimits
+	perHost RateLimits
+
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+	hosts    map[string]*hostLimiter
+}
+
+type hostLimiter struct {
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+func NewRateLimiter(global RateLimits, perHost RateLimits) *RateLimiter {
+	l := &RateLimiter{
+		requests: rate.NewLimiter(rate.Inf, 1),
+		bytes:    rate.NewLimiter(rate.Inf, 1),
+		hosts:    map[string]*hostLimiter{},
+	}
+	l.SetLimits(global, perHost)
+	return l
+}
+
+// Limits returns the current global and per host limits.
+func (l *RateLimiter) Limits() (global RateLimits, perHost RateLimits) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.global, l.perHost
+}
+
+// SetLimits changes the global and per host limits.
+func (l *RateLimiter) SetLimits(global RateLimits, perHost RateLimits) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.global, l.perHost = global, perHost
+	setRequestLimit(l.requests, global.RequestsPerSecond)
+	setByteLimit(l.bytes, global.BytesPerSecond)
+	for _, h := range l.hosts {
+		setRequestLimit(h.requests, perHost.RequestsPerSecond)
+		setByteLimit(h.bytes, perHost.BytesPerSecond)
+	}
+}
+
+func setRequestLimit(limiter *rate.Limiter, perSecond float64) {
+	if perSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(perSecond))
+	limiter.SetBurst(1)
+}
+
+// setByteLimit allows reads of up to a second worth of bytes at a time.
+func setByteLimit(limiter *rate.Limiter, perSecond float64) {
+	if perSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(perSecond))
+	limiter.SetBurst(max(int(perSecond), 1))
+}
+
+func (l *RateLimiter) host(host string) *hostLimiter {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimiter{requests: rate.NewLimiter(rate.Inf, 1), bytes: rate.NewLimiter(rate.Inf, 1)}
+		setRequestLimit(h.requests, l.perHost.RequestsPerSecond)
+		setByteLimit(h.bytes, l.perHost.BytesPerSecond)
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// Client returns an http.Client whose traffic is limited by l.
+func (l *RateLimiter) Client() *http.Client {
+	return &http.Client{Transport: &rateLimitedTransport{limiter: l, base: http.DefaultTransport}}
+}
+
+// rateLimitedTransport waits for the request limiters before sending a
+// request, and for the byte limiters while the response body is read.
+type rateLimitedTransport struct {
+	limiter *RateLimiter
+	base    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := t.limiter.host(req.URL.Host)
+	for _, limiter := range []*rate.Limiter{t.limiter.requests, h.requests} {
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &rateLimitedBody{ReadCloser: resp.Body, ctx: req.Context(), limiters: []*rate.Limiter{t.limiter.bytes, h.bytes}}
+	return resp, nil
+}
+
+type rateLimitedBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	// never read more than the limiters can let through at once
+	for _, limiter := range b.limiters {
+		if limiter.Limit() != rate.Inf && len(p) > limiter.Burst() {
+			p = p[:limiter.Burst()]
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	for _, limiter := range b.limiters {
+		if waitErr := waitN(b.ctx, limiter, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// waitN waits for n tokens in chunks of at most the burst, which may have been
+// lowered since the read was sized.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := min(n, max(limiter.Burst(), 1))
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// rateLimitsSetting is the JSON form of the limits served by ServeHTTP.
+type rateLimitsSetting struct {
+	Global  RateLimits
+	PerHost RateLimits
+}
+
+// ServeHTTP lets the limits be read with GET and changed with PUT, using a
+// JSON body like {"Global":{"RequestsPerSecond":10,"BytesPerSecond":1048576},"PerHost":{...}}.
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		global, perHost := l.Limits()
+		setting := rateLimitsSetting{Global: global, PerHost: perHost}
+		if err := json.NewDecoder(r.Body).Decode(&setting); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l.SetLimits(setting.Global, setting.PerHost)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	global, perHost := l.Limits()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rateLimitsSetting{Global: global, PerHost: perHost})
+}
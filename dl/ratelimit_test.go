@@ -0,0 +1,89 @@
+package dl
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	limiter := NewRateLimiter(RateLimits{RequestsPerSecond: 20}, RateLimits{})
+	client := limiter.Client()
+	get := func() {
+		resp, err := client.Get(srv.URL)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	started := time.Now()
+	for range 5 {
+		get()
+	}
+	assert.GreaterOrEqual(t, time.Since(started), 190*time.Millisecond)
+
+	// the per host limit applies on top of the global one
+	limiter.SetLimits(RateLimits{}, RateLimits{RequestsPerSecond: 10})
+	started = time.Now()
+	for range 3 {
+		get()
+	}
+	assert.GreaterOrEqual(t, time.Since(started), 190*time.Millisecond)
+
+	limiter.SetLimits(RateLimits{}, RateLimits{})
+	started = time.Now()
+	for range 20 {
+		get()
+	}
+	assert.Less(t, time.Since(started), 190*time.Millisecond)
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	body := strings.Repeat("x", 10000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	limiter := NewRateLimiter(RateLimits{BytesPerSecond: 10000}, RateLimits{})
+	started := time.Now()
+	resp, err := limiter.Client().Get(srv.URL)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(b))
+	assert.GreaterOrEqual(t, time.Since(started), 900*time.Millisecond)
+}
+
+func TestRateLimiterServeHTTP(t *testing.T) {
+	limiter := NewRateLimiter(RateLimits{RequestsPerSecond: 5}, RateLimits{})
+	srv := httptest.NewServer(limiter)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL, strings.NewReader(`{"PerHost":{"BytesPerSecond":1048576}}`))
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	global, perHost := limiter.Limits()
+	assert.Equal(t, RateLimits{RequestsPerSecond: 5}, global)
+	assert.Equal(t, RateLimits{BytesPerSecond: 1048576}, perHost)
+
+	resp, err = http.Get(srv.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	setting := rateLimitsSetting{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&setting))
+	assert.Equal(t, rateLimitsSetting{Global: global, PerHost: perHost}, setting)
+}
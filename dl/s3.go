@@ -0,0 +1,336 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Store is a Store in an S3-compatible object store, using path-style
+// requests signed with AWS Signature Version 4. Objects are only visible once
+// fully uploaded, which makes every Put atomic.
+type S3Store struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+
+	// now is overridden in tests
+	now func() time.Time
+}
+
+// NewS3Store creates a store for bucket at endpoint, e.g. https://s3.eu-north-1.amazonaws.com.
+// Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and the
+// region from AWS_REGION, defaulting to us-east-1.
+func NewS3Store(endpoint string, bucket string) *S3Store {
+	return &S3Store{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    GetEnvOr("AWS_REGION", "us-east-1"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    http.DefaultClient,
+		now:       time.Now,
+	}
+}
+
+// WithPrefix stores all keys below prefix in the bucket.
+func (s *S3Store) WithPrefix(prefix string) *S3Store {
+	s.prefix = strings.Trim(prefix, "/")
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	return s
+}
+
+func (s *S3Store) WithRegion(region string) *S3Store {
+	s.region = region
+	return s
+}
+
+func (s *S3Store) WithCredentials(accessKey string, secretKey string) *S3Store {
+	s.accessKey = accessKey
+	s.secretKey = secretKey
+	return s
+}
+
+// NewStore creates a Store from a location, which is either a local directory
+// or an URL like s3://bucket/prefix?endpoint=https://minio.example.com&region=eu-north-1.
+func NewStore(location string) (Store, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return NewLocalStore(location), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	store := NewS3Store(endpoint, u.Host).WithPrefix(u.Path)
+	if region := u.Query().Get("region"); region != "" {
+		store.WithRegion(region)
+	}
+	return store, nil
+}
+
+func (s *S3Store) objectURL(key string) string {
+	return s.endpoint + "/" + s3Escape(s.bucket, false) + "/" + s3Escape(s.prefix+key, false)
+}
+
+func (s *S3Store) do(ctx context.Context, method string, rawURL string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := hexSHA256(nil)
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	s.sign(req, payloadHash)
+	return s.client.Do(req)
+}
+
+// checkResponse turns non-2xx responses into errors, wrapping fs.ErrNotExist for 404.
+func checkS3Response(resp *http.Response, key string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: "s3", Path: key, Err: fs.ErrNotExist}
+	}
+	return &statusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(b)}
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := checkStoreKey(key); err != nil {
+		return err
+	}
+
+	// S3 requires the content length up front
+	size := int64(-1)
+	if f, ok := r.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if size < 0 {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(key), r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Response(resp, key)
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkStoreKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkS3Response(resp, key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (StoreInfo, error) {
+	if err := checkStoreKey(key); err != nil {
+		return StoreInfo{}, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(key), nil, 0)
+	if err != nil {
+		return StoreInfo{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkS3Response(resp, key); err != nil {
+		return StoreInfo{}, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StoreInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// s3ListResult is the subset of a ListObjectsV2 response used by List.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.prefix+prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, s.endpoint+"/"+s3Escape(s.bucket, false)+"?"+canonicalQuery(q), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = checkS3Response(resp, prefix)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := checkStoreKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key), nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkS3Response(resp, key); err != nil && resp.StatusCode != http.StatusNotFound {
+		return err
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := q[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and '/' unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	b := strings.Builder{}
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~", c) >= 0 || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(c)|0x100, 16)[1:]))
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,489 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	errBadRequest = errors.New("bad request")
+	errNotFound   = errors.New("not found")
+	errGone       = errors.New("gone")
+)
+
+var proxyContentTypes = map[string]string{
+	"list":   "text/plain; charset=UTF-8",
+	"latest": "application/json",
+	".info":  "application/json",
+	".mod":   "text/plain; charset=UTF-8",
+	".zip":   "application/zip",
+}
+
+// ProxyServer serves a Store populated by DownloadClient.Download using the
+// GOPROXY protocol, see https://go.dev/ref/mod#goproxy-protocol.
+type ProxyServer struct {
+	store Store
+
+	// pullThrough fetches files missing from store from GO_PROXY, if set.
+	pullThrough *DownloadClient
+	fetches     singleflight.Group
+}
+
+func NewProxyServer() *ProxyServer {
+	return &ProxyServer{
+		store: NewLocalStore(OUTPUT_DIR),
+	}
+}
+
+func (s *ProxyServer) WithOutputDir(dir string) *ProxyServer {
+	s.store = NewLocalStore(dir)
+	return s
+}
+
+func (s *ProxyServer) WithStore(store Store) *ProxyServer {
+	s.store = store
+	return s
+}
+
+// WithPullThrough makes the server fetch anything that is not mirrored yet from
+// GO_PROXY using dlc, which should write to the same store. The list
+// and @latest endpoints are always refreshed from upstream in this mode.
+func (s *ProxyServer) WithPullThrough(dlc *DownloadClient) *ProxyServer {
+	s.pullThrough = dlc
+	return s
+}
+
+// proxyRequest is a parsed GOPROXY protocol request.
+type proxyRequest struct {
+	// Path is the unescaped module path.
+	Path string
+
+	// File is one of "list", "latest" or "<version>.<ext>".
+	File string
+
+	// Version is the unescaped version, only set for .info, .mod and .zip requests.
+	Version string
+
+	// Ext is one of ".info", ".mod" or ".zip", only set together with Version.
+	Ext string
+}
+
+func (r proxyRequest) Module() Module {
+	return Module{Path: r.Path, Version: r.Version}
+}
+
+// parseProxyRequest parses an URL path such as /github.com/!azure/azure-sdk-for-go/@v/v1.0.0.info
+func parseProxyRequest(urlPath string) (proxyRequest, error) {
+	p := strings.TrimPrefix(urlPath, "/")
+
+	var escPath, file string
+	if strings.HasSuffix(p, "/@latest") {
+		escPath, file = strings.TrimSuffix(p, "/@latest"), "latest"
+	} else if i := strings.LastIndex(p, "/@v/"); i >= 0 {
+		escPath, file = p[:i], p[i+len("/@v/"):]
+	} else {
+		return proxyRequest{}, fmt.Errorf("%w: unknown endpoint %q", errNotFound, urlPath)
+	}
+
+	modPath, err := module.UnescapePath(escPath)
+	if err != nil {
+		return proxyRequest{}, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	req := proxyRequest{Path: modPath, File: file}
+	if file == "list" || file == "latest" {
+		return req, nil
+	}
+
+	req.Ext = path.Ext(file)
+	switch req.Ext {
+	case ".info", ".mod", ".zip":
+	default:
+		return proxyRequest{}, fmt.Errorf("%w: unknown endpoint %q", errNotFound, urlPath)
+	}
+	req.Version, err = module.UnescapeVersion(strings.TrimSuffix(file, req.Ext))
+	if err != nil {
+		return proxyRequest{}, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	if !semver.IsValid(req.Version) || semver.Canonical(req.Version) != req.Version {
+		// Queries such as branch names can not be resolved from a mirror.
+		return proxyRequest{}, fmt.Errorf("%w: %s@%s: not a canonical version", errNotFound, modPath, req.Version)
+	}
+	return req, nil
+}
+
+func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("proxy server", "method", r.Method, "path", r.URL.Path)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/sumdb/") {
+		if err := s.serveSumDB(w, r); err != nil {
+			writeProxyError(w, err)
+		}
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/"+vulnDBPrefix+"/") {
+		if err := s.serveVulnDB(w, r); err != nil {
+			writeProxyError(w, err)
+		}
+		return
+	}
+
+	req, err := parseProxyRequest(r.URL.Path)
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+
+	if s.pullThrough != nil {
+		err = s.fetch(r.Context(), req)
+	}
+	if err == nil {
+		switch req.File {
+		case "list":
+			err = s.serveList(w, r, req)
+		case "latest":
+			err = s.serveLatest(w, r, req)
+		default:
+			err = s.serveFile(w, r, req.Path, req.File, req.Ext)
+		}
+	}
+	if err != nil {
+		writeProxyError(w, err)
+	}
+}
+
+// fetch pulls the files needed to answer req from upstream. Concurrent requests
+// for the same files share a single upstream fetch, which is why the fetch is not
+// aborted when the client that started it goes away.
+func (s *ProxyServer) fetch(ctx context.Context, req proxyRequest) error {
+	ctx = context.WithoutCancel(ctx)
+	key := req.Path + "/@v/" + req.File
+	fetchFn := func() (any, error) {
+		switch req.File {
+		case "list":
+			return nil, s.pullThrough.downloadList(ctx, req.Path)
+		case "latest":
+			return nil, s.pullThrough.downloadLatest(ctx, req.Path)
+		}
+		_, _, err := s.pullThrough.downloadVersion(ctx, req.Module())
+		return nil, err
+	}
+	if req.Version != "" {
+		// .info, .mod and .zip are all fetched together
+		key = req.Module().String()
+		if storeFileExists(ctx, s.store, moduleKey(req.Path, req.File)) {
+			return nil
+		}
+	}
+
+	_, err, shared := s.fetches.Do(key, fetchFn)
+	slog.Debug("proxy server pull-through", "key", key, "shared", shared, "err", err)
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrInvalidPath):
+		return fmt.Errorf("%w: %v", errNotFound, err)
+	case errors.Is(err, ErrGone):
+		return fmt.Errorf("%w: %v", errGone, err)
+	case req.Version == "":
+		// fall back to whatever has been mirrored for list and @latest
+		slog.Warn("proxy server pull-through failed, serving mirrored files", "key", key, "err", err)
+		return nil
+	}
+	return err
+}
+
+// moduleExists reports whether anything has been mirrored for modPath.
+func (s *ProxyServer) moduleExists(ctx context.Context, modPath string) bool {
+	keys, err := s.store.List(ctx, moduleKey(modPath, "")+"/")
+	return err == nil && len(keys) > 0
+}
+
+// notFound returns errNotFound when the module is unknown to the mirror,
+// and errGone when the module is known but the requested file is not.
+func (s *ProxyServer) notFound(ctx context.Context, modPath string, file string) error {
+	if !s.moduleExists(ctx, modPath) {
+		return fmt.Errorf("%w: module %s is not mirrored", errNotFound, modPath)
+	}
+	return fmt.Errorf("%w: %s/@v/%s is not mirrored", errGone, modPath, file)
+}
+
+func (s *ProxyServer) serveFile(w http.ResponseWriter, r *http.Request, modPath string, file string, kind string) error {
+	key := moduleKey(modPath, file)
+	info, err := s.store.Stat(r.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s.notFound(r.Context(), modPath, file)
+	}
+	if err != nil {
+		return err
+	}
+	f, err := s.store.Get(r.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s.notFound(r.Context(), modPath, file)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", proxyContentTypes[kind])
+	serveStoreContent(w, r, file, info, f)
+	return nil
+}
+
+// serveStoreContent serves content read from a Store, with support for range
+// requests if the store supports seeking.
+func serveStoreContent(w http.ResponseWriter, r *http.Request, name string, info StoreInfo, f io.Reader) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, info.ModTime, rs)
+		return
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, f)
+}
+
+// localVersions returns all versions which have an .info file in the mirror.
+func (s *ProxyServer) localVersions(ctx context.Context, modPath string) ([]string, error) {
+	prefix := moduleKey(modPath, "") + "/"
+	keys, err := s.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, s.notFound(ctx, modPath, "list")
+	}
+
+	versions := []string{}
+	for _, key := range keys {
+		file := strings.TrimPrefix(key, prefix)
+		if strings.Contains(file, "/") || !strings.HasSuffix(file, ".info") {
+			continue
+		}
+		v := strings.TrimSuffix(file, ".info")
+		if semver.IsValid(v) {
+			versions = append(versions, v)
+		}
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+// serveList lists the mirrored versions of a module. Pseudo-versions are
+// omitted, just like the go command expects. In pull-through mode the upstream
+// list is served instead.
+func (s *ProxyServer) serveList(w http.ResponseWriter, r *http.Request, req proxyRequest) error {
+	if s.pullThrough != nil && storeFileExists(r.Context(), s.store, moduleKey(req.Path, "list")) {
+		return s.serveFile(w, r, req.Path, "list", "list")
+	}
+
+	versions, err := s.localVersions(r.Context(), req.Path)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", proxyContentTypes["list"])
+	for _, v := range versions {
+		if module.IsPseudoVersion(v) {
+			continue
+		}
+		fmt.Fprintln(w, v)
+	}
+	return nil
+}
+
+// serveLatest serves the upstream @latest response if that version is mirrored
+// (or can be pulled through), otherwise the .info of the highest mirrored version.
+func (s *ProxyServer) serveLatest(w http.ResponseWriter, r *http.Request, req proxyRequest) error {
+	if b, err := readStoreFile(r.Context(), s.store, moduleKey(req.Path, "latest")); err == nil {
+		latest := struct{ Version string }{}
+		if err := json.Unmarshal(b, &latest); err == nil && (s.pullThrough != nil || storeFileExists(r.Context(), s.store, moduleKey(req.Path, latest.Version+".info"))) {
+			return s.serveFile(w, r, req.Path, "latest", "latest")
+		}
+	}
+
+	versions, err := s.localVersions(r.Context(), req.Path)
+	if err != nil {
+		return err
+	}
+	latest := latestVersion(versions)
+	if latest == "" {
+		return s.notFound(r.Context(), req.Path, "latest")
+	}
+	return s.serveFile(w, r, req.Path, latest+".info", "latest")
+}
+
+// latestVersion picks the version the go command would consider latest: the
+// highest release, else the highest pre-release, else the highest pseudo-version.
+func latestVersion(sortedVersions []string) string {
+	var release, prerelease, pseudo string
+	for _, v := range sortedVersions {
+		switch {
+		case module.IsPseudoVersion(v):
+			pseudo = v
+		case semver.Prerelease(v) != "":
+			prerelease = v
+		default:
+			release = v
+		}
+	}
+	for _, v := range []string{release, prerelease, pseudo} {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// serveSumDB serves checksum databases mirrored below "sumdb" in the store by
+// ChecksumDB.WithCache, see https://go.dev/ref/mod#checksum-database.
+func (s *ProxyServer) serveSumDB(w http.ResponseWriter, r *http.Request) error {
+	name, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sumdb/"), "/")
+	dbPrefix := path.Join("sumdb", name)
+	if name == "" || strings.Contains(name, "..") || !storeFileExists(r.Context(), s.store, path.Join(dbPrefix, "latest")) {
+		return fmt.Errorf("%w: checksum database %q is not mirrored", errNotFound, name)
+	}
+	if file != path.Clean(file) || strings.HasPrefix(file, "..") {
+		return fmt.Errorf("%w: invalid path %q", errBadRequest, file)
+	}
+
+	switch {
+	case file == "supported":
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case file == "latest" || strings.HasPrefix(file, "lookup/"):
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		b, err := readStoreFile(r.Context(), s.store, path.Join(dbPrefix, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s/%s is not mirrored", errNotFound, name, file)
+		}
+		if err != nil {
+			return err
+		}
+		http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(b))
+		return nil
+	case strings.HasPrefix(file, "tile/"):
+		tile, err := tlog.ParseTilePath(file)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		b, err := readMirroredTile(r.Context(), s.store, dbPrefix, tile)
+		if err != nil {
+			return fmt.Errorf("%w: %s/%s is not mirrored", errNotFound, name, file)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(b))
+		return nil
+	}
+	return fmt.Errorf("%w: unknown endpoint %q", errNotFound, r.URL.Path)
+}
+
+// serveVulnDB serves the vulnerability database mirrored below "vulndb" in
+// the store by VulnDBMirror, which GOVULNDB can point at.
+func (s *ProxyServer) serveVulnDB(w http.ResponseWriter, r *http.Request) error {
+	file := strings.TrimPrefix(r.URL.Path, "/"+vulnDBPrefix+"/")
+	if !isVulnDBFile(file) {
+		return fmt.Errorf("%w: unknown endpoint %q", errNotFound, r.URL.Path)
+	}
+	b, err := readStoreFile(r.Context(), s.store, path.Join(vulnDBPrefix, file))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s is not mirrored", errNotFound, file)
+	}
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(file, ".gz") {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(b))
+	return nil
+}
+
+// readMirroredTile reads a tile from a mirrored checksum database. Hash tiles
+// which were only mirrored with a larger width are cut down to the requested
+// width, since a partial tile is a prefix of any wider tile. The full tile is
+// tried first, then the narrowest of the wider partial tiles in the store.
+func readMirroredTile(ctx context.Context, store Store, dbPrefix string, tile tlog.Tile) ([]byte, error) {
+	b, err := readStoreFile(ctx, store, path.Join(dbPrefix, tile.Path()))
+	if err == nil || tile.L < 0 || tile.W == 1<<tile.H {
+		return b, err
+	}
+
+	cut := func(wider tlog.Tile) ([]byte, bool) {
+		wb, err := readStoreFile(ctx, store, path.Join(dbPrefix, wider.Path()))
+		if err != nil || len(wb) < tile.W*tlog.HashSize {
+			return nil, false
+		}
+		return wb[:tile.W*tlog.HashSize], true
+	}
+	full := tile
+	full.W = 1 << tile.H
+	if wb, ok := cut(full); ok {
+		return wb, nil
+	}
+
+	// partial tiles are stored as <full tile>.p/<width>
+	partialPrefix := path.Dir(path.Join(dbPrefix, tile.Path())) + "/"
+	keys, listErr := store.List(ctx, partialPrefix)
+	if listErr != nil {
+		return nil, listErr
+	}
+	widths := []int{}
+	for _, key := range keys {
+		if w, err := strconv.Atoi(strings.TrimPrefix(key, partialPrefix)); err == nil && w > tile.W && w < full.W {
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	for _, w := range widths {
+		wider := tile
+		wider.W = w
+		if wb, ok := cut(wider); ok {
+			return wb, nil
+		}
+	}
+	return nil, err
+}
+
+func writeProxyError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, errNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errGone):
+		status = http.StatusGone
+	default:
+		slog.Error("proxy server", "err", err)
+	}
+	http.Error(w, err.Error(), status)
+}
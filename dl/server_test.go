@@ -0,0 +1,156 @@
+package dl
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := path.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(path.Dir(p), os.ModePerm))
+		assert.Nil(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+}
+
+func TestProxyServer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"github.com/Azure/go-autorest/@v/list":                                    "v1.0.0\nv1.1.0\n",
+		"github.com/Azure/go-autorest/@v/latest":                                  `{"Version":"v1.1.0"}`,
+		"github.com/Azure/go-autorest/@v/v1.0.0.info":                             `{"Version":"v1.0.0"}`,
+		"github.com/Azure/go-autorest/@v/v1.0.0.mod":                              "module github.com/Azure/go-autorest\n",
+		"github.com/Azure/go-autorest/@v/v1.0.0.zip":                              "zip",
+		"github.com/Azure/go-autorest/@v/v1.1.0-rc.1.info":                        `{"Version":"v1.1.0-rc.1"}`,
+		"github.com/Azure/go-autorest/@v/v0.0.0-20190101000000-abcdefabcdef.info": `{"Version":"v0.0.0-20190101000000-abcdefabcdef"}`,
+	})
+	srv := httptest.NewServer(NewProxyServer().WithOutputDir(dir))
+	defer srv.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/github.com/!azure/go-autorest/@v/list", 200, "text/plain; charset=UTF-8", "v1.0.0\nv1.1.0-rc.1\n"},
+		{"/github.com/!azure/go-autorest/@v/v1.0.0.info", 200, "application/json", `{"Version":"v1.0.0"}`},
+		{"/github.com/!azure/go-autorest/@v/v1.0.0.mod", 200, "text/plain; charset=UTF-8", "module github.com/Azure/go-autorest\n"},
+		{"/github.com/!azure/go-autorest/@v/v1.0.0.zip", 200, "application/zip", "zip"},
+		{"/github.com/!azure/go-autorest/@latest", 200, "application/json", `{"Version":"v1.0.0"}`},
+		{"/github.com/!azure/go-autorest/@v/v1.1.0.zip", 410, "", ""},
+		{"/github.com/!azure/go-autorest/@v/master.info", 404, "", ""},
+		{"/github.com/Azure/go-autorest/@v/list", 400, "", ""},
+		{"/github.com/!azure/../@v/list", 400, "", ""},
+		{"/github.com/not/mirrored/@v/list", 404, "", ""},
+		{"/github.com/not/mirrored/@latest", 404, "", ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		assert.Nil(t, err)
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, tt.status, resp.StatusCode, tt.path)
+		if tt.status == 200 {
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"), tt.path)
+			assert.Equal(t, tt.body, string(b), tt.path)
+		}
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	assert.Equal(t, "v1.2.0", latestVersion([]string{"v1.0.0", "v1.2.0", "v1.3.0-rc.1"}))
+	assert.Equal(t, "v1.3.0-rc.1", latestVersion([]string{"v0.0.0-20190101000000-abcdefabcdef", "v1.3.0-rc.1"}))
+	assert.Equal(t, "v0.0.0-20190101000000-abcdefabcdef", latestVersion([]string{"v0.0.0-20190101000000-abcdefabcdef"}))
+	assert.Equal(t, "", latestVersion([]string{}))
+}
+
+func TestProxyServerPullThrough(t *testing.T) {
+	p := newTestProxy(t)
+	p.zipDelay = 100 * time.Millisecond
+	mod := Module{Path: "github.com/Azure/go-autorest", Version: "v1.0.0"}
+	p.addModule(t, mod, map[string]string{"go.mod": "module github.com/Azure/go-autorest\n"})
+	zipData, err := os.ReadFile(path.Join(p.dir, "github.com/!azure/go-autorest/@v/v1.0.0.zip"))
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	dlc := NewDownloadClient().WithOutputDir(dir).WithTempDir(path.Join(dir, "tmp"))
+	srv := httptest.NewServer(NewProxyServer().WithOutputDir(dir).WithPullThrough(dlc))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/github.com/!azure/go-autorest/@v/v1.0.0.zip")
+			assert.Nil(t, err)
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Nil(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, zipData, b)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, p.zipFetches.Value())
+	assert.True(t, fileExists(path.Join(dir, "github.com/Azure/go-autorest/@v/v1.0.0.mod")))
+
+	resp, err := http.Get(srv.URL + "/github.com/!azure/go-autorest/@latest")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/github.com/!azure/go-autorest/@v/v2.0.0.info")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+// countingStore counts the Gets of a store.
+type countingStore struct {
+	Store
+	gets int
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.gets++
+	return s.Store.Get(ctx, key)
+}
+
+func TestReadMirroredTile(t *testing.T) {
+	dir := t.TempDir()
+	hashes := func(n int) string { return strings.Repeat("h", n*tlog.HashSize) }
+	writeTestFiles(t, dir, map[string]string{
+		"sumdb/sum.example.com/tile/8/0/001.p/5":   hashes(5),
+		"sumdb/sum.example.com/tile/8/0/001.p/200": hashes(200),
+	})
+	store := &countingStore{Store: NewLocalStore(dir)}
+	ctx := context.Background()
+
+	// the narrowest wider partial tile is read, without trying every width
+	b, err := readMirroredTile(ctx, store, "sumdb/sum.example.com", tlog.Tile{H: 8, L: 0, N: 1, W: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, hashes(3), string(b))
+	assert.Equal(t, 3, store.gets)
+
+	store.gets = 0
+	_, err = readMirroredTile(ctx, store, "sumdb/sum.example.com", tlog.Tile{H: 8, L: 0, N: 1, W: 201})
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, 2, store.gets)
+	_, err = readMirroredTile(ctx, store, "sumdb/sum.example.com", tlog.Tile{H: 8, L: 0, N: 2, W: 3})
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
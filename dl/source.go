@@ -0,0 +1,166 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexSource provides the entries of the index to an IndexClient.
+type IndexSource interface {
+	// Feed returns, as JSONL, up to limit entries added at or after since,
+	// oldest first, like https://index.golang.org/index?since=<since>&limit=<limit>.
+	Feed(ctx context.Context, since time.Time, limit int) ([]byte, error)
+}
+
+type indexEntry struct {
+	ts   time.Time
+	line []byte
+}
+
+// FileIndexSource replays an index feed recorded on disk, which is either an
+// IndexArchive directory or a JSONL file like the output of 'list modules',
+// gzipped if its name ends with .gz.
+type FileIndexSource struct {
+	archive *IndexArchive
+	entries []indexEntry
+
+	// the entries of the last read segment of archive
+	mtx            sync.Mutex
+	segment        string
+	segmentEntries []indexEntry
+}
+
+// OpenFileIndexSource opens the index feed recorded at location.
+func OpenFileIndexSource(location string) (*FileIndexSource, error) {
+	info, err := os.Stat(location)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if _, err := os.Stat(path.Join(location, archiveIndexFile)); err != nil {
+			return nil, fmt.Errorf("%s is not an index archive: %w", location, err)
+		}
+		archive, err := OpenIndexArchive(location)
+		if err != nil {
+			return nil, err
+		}
+		return &FileIndexSource{archive: archive}, nil
+	}
+
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(location, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	entries := []indexEntry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := parseIndexEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", location, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", location, err)
+	}
+	sortIndexEntries(entries)
+	return &FileIndexSource{entries: entries}, nil
+}
+
+func parseIndexEntry(line []byte) (indexEntry, error) {
+	entry := struct{ Timestamp time.Time }{}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return indexEntry{}, fmt.Errorf("invalid index entry %q: %w", line, err)
+	}
+	return indexEntry{ts: entry.Timestamp, line: bytes.Clone(line)}, nil
+}
+
+func sortIndexEntries(entries []indexEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ts.Before(entries[j].ts) })
+}
+
+func (s *FileIndexSource) Feed(ctx context.Context, since time.Time, limit int) ([]byte, error) {
+	feed := bytes.Buffer{}
+	n := 0
+	add := func(entries []indexEntry) {
+		i := sort.Search(len(entries), func(i int) bool { return !entries[i].ts.Before(since) })
+		for ; i < len(entries) && n < limit; i++ {
+			feed.Write(entries[i].line)
+			feed.WriteByte('\n')
+			n++
+		}
+	}
+	if s.archive == nil {
+		add(s.entries)
+		return feed.Bytes(), nil
+	}
+
+	for _, segment := range s.archive.Segments() {
+		if n >= limit {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if segment.End.Before(since) {
+			continue
+		}
+		entries, err := s.readSegment(segment.Name)
+		if err != nil {
+			return nil, err
+		}
+		add(entries)
+	}
+	return feed.Bytes(), nil
+}
+
+// readSegment returns the sorted entries of a segment of the archive.
+func (s *FileIndexSource) readSegment(name string) ([]indexEntry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.segment == name {
+		return s.segmentEntries, nil
+	}
+	entries := []indexEntry{}
+	err := s.archive.ReadSegment(name, func(line []byte) error {
+		entry, err := parseIndexEntry(line)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive segment %s: %w", name, err)
+	}
+	sortIndexEntries(entries)
+	s.segment = name
+	s.segmentEntries = entries
+	return entries, nil
+}
@@ -0,0 +1,64 @@
+package dl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileIndexSource(t *testing.T) {
+	ts := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	mods := Modules{
+		{Timestamp: ts, Path: "example.com/a", Version: "v1.0.0"},
+		{Timestamp: ts.Add(time.Hour), Path: "example.com/b", Version: "v1.0.0"},
+		{Timestamp: ts.Add(24 * time.Hour), Path: "example.com/c", Version: "v1.0.0"},
+	}
+	feed := bytes.Buffer{}
+	for _, i := range []int{2, 0, 1} {
+		feed.WriteString(mods[i].AsJSON() + "\n")
+	}
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(path.Join(dir, "feed.jsonl"), feed.Bytes(), 0o644))
+	gz := bytes.Buffer{}
+	zw := gzip.NewWriter(&gz)
+	zw.Write(feed.Bytes())
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, os.WriteFile(path.Join(dir, "feed.jsonl.gz"), gz.Bytes(), 0o644))
+	archive, err := OpenIndexArchive(path.Join(dir, "index"))
+	assert.Nil(t, err)
+	assert.Nil(t, archive.Append(feed.Bytes()))
+
+	for _, location := range []string{"feed.jsonl", "feed.jsonl.gz", "index"} {
+		source, err := OpenFileIndexSource(path.Join(dir, location))
+		assert.Nil(t, err, location)
+		c := NewIndexClient(false).WithSource(source)
+
+		scraped, err := c.Scrape(context.Background(), 2)
+		assert.Nil(t, err, location)
+		assert.Equal(t, mods[:2], scraped, location)
+
+		// the cursor is inclusive like the one of the index
+		c.WithExplicitMaxTs(scraped.GetMaxTs())
+		scraped, err = c.Scrape(context.Background(), 2)
+		assert.Nil(t, err, location)
+		assert.Equal(t, mods[1:], scraped, location)
+
+		c.WithExplicitMaxTs(ts.Add(48 * time.Hour))
+		scraped, err = c.Scrape(context.Background(), 2)
+		assert.Nil(t, err, location)
+		assert.Empty(t, scraped, location)
+	}
+
+	_, err = OpenFileIndexSource(dir)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.WriteFile(path.Join(dir, "invalid.jsonl"), []byte("not json\n"), 0o644))
+	_, err = OpenFileIndexSource(path.Join(dir, "invalid.jsonl"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,220 @@
+package dl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	stateModulesBucket  = []byte("modules")
+	statePathsBucket    = []byte("paths")
+	stateBackfillBucket = []byte("backfill")
+)
+
+// ModuleState is the persisted download state of one module version.
+type ModuleState struct {
+	Path    string
+	Version string
+	Status  DownloadStatus
+
+	// Attempts is the number of times a download of the module version has been attempted.
+	Attempts int
+
+	// Hashes maps ".mod" and ".zip" to the h1: hashes of the downloaded files.
+	Hashes map[string]string `json:",omitempty"`
+
+	// Vulns are the ids of the vulnerabilities affecting the module version.
+	Vulns []string `json:",omitempty"`
+
+	// Licenses are the license files of the module version.
+	Licenses []License `json:",omitempty"`
+
+	// Error is the error of the last failed attempt.
+	Error string `json:",omitempty"`
+
+	FirstSeen   time.Time
+	LastUpdated time.Time
+	Completed   time.Time `json:",omitempty"`
+}
+
+// StateStore persists the state of module versions across restarts, in an
+// embedded bbolt database.
+type StateStore struct {
+	db *bolt.DB
+}
+
+// OpenStateStore opens, or creates, the state store at filepath. Only one
+// process can have the store open at a time.
+func OpenStateStore(filepath string) (*StateStore, error) {
+	if err := createDirIfNotExist(path.Dir(filepath)); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath, 0o644, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("failed to open state store %s: it is locked by another process, like a running 'sync modules'", filepath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %s: %w", filepath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{stateModulesBucket, statePathsBucket, stateBackfillBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &StateStore{db: db}, nil
+}
+
+func (s *StateStore) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the state of m, and false if nothing has been recorded for it.
+func (s *StateStore) Get(m Module) (ModuleState, bool, error) {
+	state := ModuleState{}
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateModulesBucket).Get([]byte(m.String()))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, &state)
+	})
+	return state, found, err
+}
+
+// Update atomically updates the state of m with fn. New states are created
+// with FirstSeen set, and LastUpdated is always set.
+func (s *StateStore) Update(m Module, fn func(state *ModuleState)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return updateState(tx, m, fn)
+	})
+}
+
+// UpdateAll updates the states of mods with fn like Update, in a single
+// transaction.
+func (s *StateStore) UpdateAll(mods []Module, fn func(m Module, state *ModuleState)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, m := range mods {
+			if err := updateState(tx, m, func(state *ModuleState) { fn(m, state) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func updateState(tx *bolt.Tx, m Module, fn func(state *ModuleState)) error {
+	bucket := tx.Bucket(stateModulesBucket)
+	key := []byte(m.String())
+
+	now := time.Now().UTC()
+	state := ModuleState{Path: m.Path, Version: m.Version, Status: DownloadStatusPending, FirstSeen: now}
+	if b := bucket.Get(key); b != nil {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return err
+		}
+	}
+	fn(&state)
+	state.LastUpdated = now
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, b)
+}
+
+// IsCompleted reports whether m has been downloaded successfully.
+func (s *StateStore) IsCompleted(m Module) bool {
+	state, found, err := s.Get(m)
+	return err == nil && found && state.Status == DownloadStatusCompleted
+}
+
+// GetPathMetadata returns the metadata of modPath, and false if nothing has
+// been recorded for it.
+func (s *StateStore) GetPathMetadata(modPath string) (PathMetadata, bool, error) {
+	meta := PathMetadata{}
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statePathsBucket).Get([]byte(modPath))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, &meta)
+	})
+	return meta, found, err
+}
+
+// PutPathMetadata records the metadata of a module path.
+func (s *StateStore) PutPathMetadata(meta PathMetadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statePathsBucket).Put([]byte(meta.Path), b)
+	})
+}
+
+// Annotate annotates m with the metadata recorded for its path, and the
+// vulnerabilities and licenses recorded for it, if any.
+func (s *StateStore) Annotate(m Module) (AnnotatedModule, error) {
+	annotated := AnnotatedModule{Module: m}
+	meta, found, err := s.GetPathMetadata(m.Path)
+	if err != nil {
+		return annotated, err
+	}
+	if found {
+		annotated = meta.Annotate(m)
+	}
+	state, found, err := s.Get(m)
+	if err != nil {
+		return annotated, err
+	}
+	if found {
+		annotated.Vulns = state.Vulns
+		annotated.Licenses = licenseIDs(state.Licenses)
+	}
+	return annotated, nil
+}
+
+// GetBackfillPlan returns the plan of the last backfill, and false if there
+// has been none.
+func (s *StateStore) GetBackfillPlan() (BackfillPlan, bool, error) {
+	plan := BackfillPlan{}
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateBackfillBucket).Get([]byte("plan"))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, &plan)
+	})
+	return plan, found, err
+}
+
+// PutBackfillPlan records the plan, and progress, of a backfill.
+func (s *StateStore) PutBackfillPlan(plan BackfillPlan) error {
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBackfillBucket).Put([]byte("plan"), b)
+	})
+}
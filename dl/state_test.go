@@ -0,0 +1,85 @@
+package dl
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateStore(t *testing.T) {
+	stateFile := path.Join(t.TempDir(), "state.db")
+	mod := Module{Path: "example.com/a", Version: "v1.0.0"}
+
+	store, err := OpenStateStore(stateFile)
+	assert.Nil(t, err)
+	_, found, err := store.Get(mod)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	assert.Nil(t, store.Update(mod, func(state *ModuleState) {
+		state.Status = DownloadStatusCompleted
+		state.Attempts += 1
+		state.Hashes = map[string]string{".zip": "h1:abc"}
+	}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenStateStore(stateFile)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// only one process can have the store open
+	_, err = OpenStateStore(stateFile)
+	assert.ErrorContains(t, err, "locked by another process")
+	state, found, err := store.Get(mod)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, DownloadStatus(DownloadStatusCompleted), state.Status)
+	assert.Equal(t, 1, state.Attempts)
+	assert.Equal(t, "h1:abc", state.Hashes[".zip"])
+	assert.False(t, state.FirstSeen.IsZero())
+	assert.True(t, store.IsCompleted(mod))
+
+	// several versions are updated in one transaction
+	other := Module{Path: "example.com/a", Version: "v1.1.0"}
+	assert.Nil(t, store.UpdateAll([]Module{mod, other}, func(m Module, state *ModuleState) {
+		state.Vulns = []string{"GO-2024-0001", m.Version}
+	}))
+	state, _, err = store.Get(mod)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"GO-2024-0001", "v1.0.0"}, state.Vulns)
+	assert.Equal(t, "h1:abc", state.Hashes[".zip"])
+	state, found, err = store.Get(other)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"GO-2024-0001", "v1.1.0"}, state.Vulns)
+}
+
+func TestDownloadClientStateStore(t *testing.T) {
+	p := newTestProxy(t)
+	mod := Module{Path: "example.com/stateful", Version: "v1.0.0"}
+	p.addModule(t, mod, map[string]string{"go.mod": "module example.com/stateful\n"})
+
+	dir := t.TempDir()
+	store, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	syncWith(t, NewDownloadClient().WithStateStore(store), dir, Modules{mod})
+
+	state, found, err := store.Get(mod)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, DownloadStatus(DownloadStatusCompleted), state.Status)
+	assert.Equal(t, p.hashes[mod.String()], state.Hashes[".zip"])
+	assert.Equal(t, p.hashes[mod.String()+"/go.mod"], state.Hashes[".mod"])
+
+	// a new client skips the completed module without queueing it
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithStateStore(store)
+	c.enqueueMod(context.Background(), mod, false)
+	assert.Equal(t, 0, c.stats.queuedRequests.Value())
+}
@@ -0,0 +1,232 @@
+package dl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store persists mirrored files under slash-separated keys laid out like a
+// GOPROXY, e.g. "golang.org/x/mod/@v/v0.22.0.zip".
+type Store interface {
+	// Put stores the content of r under key. The commit is atomic, readers
+	// either observe the previous content or all of the new content.
+	Put(ctx context.Context, key string, r io.Reader) error
+
+	// Get opens the content stored under key. The returned reader implements
+	// io.Seeker if the store supports it. Missing keys return an error
+	// wrapping fs.ErrNotExist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Stat describes the content stored under key. Missing keys return an
+	// error wrapping fs.ErrNotExist.
+	Stat(ctx context.Context, key string) (StoreInfo, error)
+
+	// List returns all keys starting with prefix, in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// StoreInfo describes a stored file.
+type StoreInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// filePutter is implemented by stores which can take over a local file
+// cheaper than copying it through Put.
+type filePutter interface {
+	PutFile(ctx context.Context, key string, filepath string) error
+}
+
+// putFile stores the local file at filepath under key, and removes the file.
+func putFile(ctx context.Context, store Store, key string, filepath string) error {
+	if fp, ok := store.(filePutter); ok {
+		return fp.PutFile(ctx, key, filepath)
+	}
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filepath)
+	defer f.Close()
+	return store.Put(ctx, key, f)
+}
+
+// readStoreFile reads all of the content stored under key.
+func readStoreFile(ctx context.Context, store Store, key string) ([]byte, error) {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// storeFileExists reports whether anything is stored under key.
+func storeFileExists(ctx context.Context, store Store, key string) bool {
+	_, err := store.Stat(ctx, key)
+	return err == nil
+}
+
+// checkStoreKey rejects keys which could escape the store.
+func checkStoreKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return fmt.Errorf("invalid store key %q", key)
+	}
+	return nil
+}
+
+// localStoreTempPrefix marks in-progress writes, which List skips.
+const localStoreTempPrefix = ".go-index-dl-"
+
+// LocalStore is a Store on the local filesystem, rooted at a directory.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if err := checkStoreKey(key); err != nil {
+		return "", err
+	}
+	return path.Join(s.dir, key), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := createDirIfNotExist(path.Dir(target)); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(path.Dir(target), localStoreTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), target)
+}
+
+// PutFile moves filepath into place, falling back to copying it when it is on
+// another filesystem.
+func (s *LocalStore) PutFile(ctx context.Context, key string, filepath string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := createDirIfNotExist(path.Dir(target)); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath, target); err == nil {
+		return nil
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filepath)
+	defer f.Close()
+	return s.Put(ctx, key, f)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return nil, err
+	}
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (StoreInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return StoreInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return StoreInfo{}, err
+	}
+	if info.IsDir() {
+		return StoreInfo{}, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+	}
+	return StoreInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]string, error) {
+	// only walk the deepest directory covering the prefix
+	root := s.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if err := checkStoreKey(prefix[:i]); err != nil {
+			return nil, err
+		}
+		root = path.Join(s.dir, prefix[:i])
+	}
+
+	keys := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localStoreTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// knownChecksumDBs maps well-known checksum database names to their pinned
+// verifier keys, the same way the go command does.
+var knownChecksumDBs = map[string]string{
+	"sum.golang.org": "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8",
+}
+
+// ErrChecksumMismatch is returned when a downloaded file does not match the
+// hash recorded in the checksum database. Such downloads are not retried.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumDB verifies module files against a checksum database such as
+// sum.golang.org, see https://go.dev/ref/mod#checksum-database. Lookups and
+// tiles are cached in memory for the life of the database, unless WithCache
+// is used.
+type ChecksumDB struct {
+	name       string
+	key        string
+	url        string
+	httpClient *http.Client
+
+	// cache holds verified lookups, tiles and the latest tree head below cachePrefix, if set.
+	cache       Store
+	cachePrefix string
+
+	latestMtx sync.Mutex
+	latest    []byte
+	memCache  sync.Map
+}
+
+// NewChecksumDB creates a ChecksumDB from a GOSUMDB-style setting, which is
+// either a known database name such as "sum.golang.org", or a verifier key
+// "<name>+<hash>+<key>", optionally followed by a space and the database URL.
+func NewChecksumDB(setting string) (*ChecksumDB, error) {
+	key, url, _ := strings.Cut(strings.TrimSpace(setting), " ")
+	if known, ok := knownChecksumDBs[key]; ok {
+		key = known
+	}
+	verifier, err := note.NewVerifier(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum database %q: %v", setting, err)
+	}
+	if url == "" {
+		url = "https://" + verifier.Name()
+	}
+
+	db := &ChecksumDB{
+		name:       verifier.Name(),
+		key:        key,
+		url:        strings.TrimSuffix(url, "/"),
+		httpClient: http.DefaultClient,
+	}
+	return db, nil
+}
+
+// WithRateLimiter limits all requests to the database with limiter.
+func (db *ChecksumDB) WithRateLimiter(limiter *RateLimiter) *ChecksumDB {
+	db.httpClient = limiter.Client()
+	return db
+}
+
+// WithCache makes the database cache verified lookups, tiles and the latest
+// signed tree head in store under prefix/<name>/, instead of in memory. The
+// cache uses the same layout as the database itself, so with the prefix
+// "sumdb" it doubles as a mirror which ProxyServer can serve.
+func (db *ChecksumDB) WithCache(store Store, prefix string) *ChecksumDB {
+	db.cache = store
+	db.cachePrefix = prefix
+	return db
+}
+
+// cacheKey returns the store key of a cached file.
+func (db *ChecksumDB) cacheKey(file string) string {
+	return path.Join(db.cachePrefix, file)
+}
+
+func (db *ChecksumDB) Name() string {
+	return db.name
+}
+
+// Mirror looks up m in the database, which caches the lookup record and all
+// tiles needed to verify it.
+func (db *ChecksumDB) Mirror(ctx context.Context, m Module) error {
+	for _, version := range []string{m.Version, m.Version + "/go.mod"} {
+		if _, err := db.lookup(ctx, m.Path, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the h1: hash recorded for path@version, or for its go.mod if
+// version ends with /go.mod. sumdb.Client has no context, so every lookup
+// gets a client of its own, which shares the tiles and tree head of db.
+func (db *ChecksumDB) lookup(ctx context.Context, modPath string, version string) (string, error) {
+	lines, err := sumdb.NewClient(&checksumDBOps{db: db, ctx: ctx}).Lookup(modPath, version)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == version {
+			return fields[2], nil
+		}
+	}
+	return "", fmt.Errorf("%s@%s: no hash in checksum database %s", modPath, version, db.name)
+}
+
+// verify checks the h1: hash h of the .mod or .zip file of m.
+func (db *ChecksumDB) verify(ctx context.Context, m Module, ext string, h string) error {
+	version := m.Version
+	if ext == ".mod" {
+		version += "/go.mod"
+	}
+
+	want, err := db.lookup(ctx, m.Path, version)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s@%s in %s: %w", m.Path, version, db.name, err)
+	}
+	if h != want {
+		return fmt.Errorf("%w: %s@%s: downloaded %s, %s has %s", ErrChecksumMismatch, m.Path, version, h, db.name, want)
+	}
+	return nil
+}
+
+// hashMod returns the h1: hash of a go.mod file, as recorded in go.sum.
+func hashMod(data []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// hashZip returns the h1: hash of a module zip, as recorded in go.sum.
+func hashZip(zipPath string) (string, error) {
+	return dirhash.HashZip(zipPath, dirhash.Hash1)
+}
+
+// checksumDBOps implements sumdb.ClientOps for a ChecksumDB.
+type checksumDBOps struct {
+	db  *ChecksumDB
+	ctx context.Context
+}
+
+func (o *checksumDBOps) ReadRemote(remotePath string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(o.ctx, http.MethodGet, o.db.url+remotePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.db.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, &statusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(b)}
+	}
+	return b, nil
+}
+
+func (o *checksumDBOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.db.key), nil
+	}
+	if file == o.db.name+"/latest" {
+		o.db.latestMtx.Lock()
+		defer o.db.latestMtx.Unlock()
+		return o.readLatest()
+	}
+	return nil, fmt.Errorf("unknown config %s", file)
+}
+
+// readLatest reads the latest signed tree head, must be called with latestMtx held.
+func (o *checksumDBOps) readLatest() ([]byte, error) {
+	if o.db.cache == nil {
+		return o.db.latest, nil
+	}
+	b, err := readStoreFile(o.ctx, o.db.cache, o.db.cacheKey(o.db.name+"/latest"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []byte{}, nil
+	}
+	return b, err
+}
+
+func (o *checksumDBOps) WriteConfig(file string, old, new []byte) error {
+	if file != o.db.name+"/latest" {
+		return fmt.Errorf("unknown config %s", file)
+	}
+	o.db.latestMtx.Lock()
+	defer o.db.latestMtx.Unlock()
+	current, err := o.readLatest()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, old) {
+		return sumdb.ErrWriteConflict
+	}
+	if o.db.cache == nil {
+		o.db.latest = new
+		return nil
+	}
+	return o.db.cache.Put(context.Background(), o.db.cacheKey(o.db.name+"/latest"), bytes.NewReader(new))
+}
+
+func (o *checksumDBOps) ReadCache(file string) ([]byte, error) {
+	if o.db.cache == nil {
+		if b, ok := o.db.memCache.Load(file); ok {
+			return b.([]byte), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	return readStoreFile(o.ctx, o.db.cache, o.db.cacheKey(file))
+}
+
+func (o *checksumDBOps) WriteCache(file string, data []byte) {
+	if o.db.cache == nil {
+		o.db.memCache.Store(file, data)
+		return
+	}
+	if err := o.db.cache.Put(context.Background(), o.db.cacheKey(file), bytes.NewReader(data)); err != nil {
+		slog.Error("checksum database: failed to write cache", "file", file, "err", err)
+	}
+}
+
+func (o *checksumDBOps) Log(msg string) {
+	slog.Debug("checksum database", "msg", msg)
+}
+
+func (o *checksumDBOps) SecurityError(msg string) {
+	slog.Error("checksum database: security error", "msg", msg)
+}
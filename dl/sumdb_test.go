@@ -0,0 +1,217 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"praktiskt/go-index-dl/utils"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+	modzip "golang.org/x/mod/zip"
+)
+
+// testProxy is an in-process GOPROXY and checksum database serving fake modules.
+type testProxy struct {
+	dir        string
+	sumDB      *httptest.Server
+	proxy      *httptest.Server
+	sumDBVKey  string
+	hashes     map[string]string
+	zipFetches utils.ConcurrentCounter[int]
+
+	// zipDelay slows down .zip responses
+	zipDelay time.Duration
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	p := &testProxy{dir: t.TempDir(), hashes: map[string]string{}, zipFetches: utils.NewConcurrentCounter[int]()}
+	p.proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Ext(r.URL.Path) == ".zip" {
+			p.zipFetches.Increment()
+			time.Sleep(p.zipDelay)
+		}
+		http.FileServer(http.Dir(p.dir)).ServeHTTP(w, r)
+	}))
+	t.Cleanup(p.proxy.Close)
+
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	assert.Nil(t, err)
+	p.sumDBVKey = vkey
+	p.sumDB = httptest.NewServer(sumdb.NewServer(sumdb.NewTestServer(skey, func(modPath, vers string) ([]byte, error) {
+		modHash, ok := p.hashes[modPath+"@"+vers+"/go.mod"]
+		if !ok {
+			return nil, fmt.Errorf("%s@%s not found", modPath, vers)
+		}
+		return []byte(fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", modPath, vers, p.hashes[modPath+"@"+vers], modPath, vers, modHash)), nil
+	})))
+	t.Cleanup(p.sumDB.Close)
+
+	orig := GO_PROXY
+	GO_PROXY = p.proxy.URL
+	t.Cleanup(func() { GO_PROXY = orig })
+	return p
+}
+
+func (p *testProxy) checksumDB(t *testing.T) *ChecksumDB {
+	db, err := NewChecksumDB(p.sumDBVKey + " " + p.sumDB.URL)
+	assert.Nil(t, err)
+	return db
+}
+
+// addModule publishes mod with the given files, go.mod included, and records its hashes.
+func (p *testProxy) addModule(t *testing.T, mod Module, files map[string]string) {
+	srcDir := t.TempDir()
+	writeTestFiles(t, srcDir, files)
+	zipData := bytes.Buffer{}
+	assert.Nil(t, modzip.CreateFromDir(&zipData, module.Version{Path: mod.Path, Version: mod.Version}, srcDir))
+
+	dir := path.Join(p.dir, escapePath(mod.Path), "@v")
+	writeTestFiles(t, dir, map[string]string{
+		"list":                mod.Version + "\n",
+		mod.Version + ".info": fmt.Sprintf(`{"Version":%q,"Time":"2024-01-01T00:00:00Z"}`, mod.Version),
+		mod.Version + ".mod":  files["go.mod"],
+		mod.Version + ".zip":  zipData.String(),
+		"../@latest":          fmt.Sprintf(`{"Version":%q,"Time":"2024-01-01T00:00:00Z"}`, mod.Version),
+	})
+
+	zipHash, err := dirhash.HashZip(path.Join(dir, mod.Version+".zip"), dirhash.Hash1)
+	assert.Nil(t, err)
+	modHash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return os.Open(path.Join(dir, mod.Version+".mod"))
+	})
+	assert.Nil(t, err)
+	p.hashes[mod.String()] = zipHash
+	p.hashes[mod.String()+"/go.mod"] = modHash
+}
+
+// syncWith downloads mods into dir with c, which is set up to write there, and
+// returns the modules stored in dir.
+func syncWith(t *testing.T, c *DownloadClient, dir string, mods Modules) Modules {
+	c.WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithSkipMaxTsWrite(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.ProcessIncomingDownloadRequests(ctx)
+	c.EnqueueBatch(ctx, mods)
+	assert.Nil(t, c.AwaitInflight(ctx))
+
+	stored, err := ListStoredModules(ctx, NewLocalStore(dir))
+	assert.Nil(t, err)
+	return stored
+}
+
+func TestChecksumDBVerify(t *testing.T) {
+	p := newTestProxy(t)
+	mod := Module{Path: "example.com/good", Version: "v1.0.0"}
+	p.addModule(t, mod, map[string]string{
+		"go.mod":  "module example.com/good\n",
+		"good.go": "package good\n",
+	})
+
+	dir := t.TempDir()
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithChecksumDB(p.checksumDB(t))
+	assert.Nil(t, c.Download(context.Background(), NewDownloadRequest(mod, true, 0)))
+	assert.True(t, fileExists(path.Join(dir, "example.com/good/@v/v1.0.0.zip")))
+
+	stored, err := ListStoredModules(context.Background(), NewLocalStore(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, Modules{mod}, stored)
+}
+
+func TestChecksumDBMismatch(t *testing.T) {
+	p := newTestProxy(t)
+	mod := Module{Path: "example.com/tampered", Version: "v1.0.0"}
+	p.addModule(t, mod, map[string]string{
+		"go.mod":      "module example.com/tampered\n",
+		"tampered.go": "package tampered\n",
+	})
+	p.hashes[mod.String()] = "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+	dir := t.TempDir()
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithChecksumDB(p.checksumDB(t))
+	err := c.Download(context.Background(), NewDownloadRequest(mod, true, 0))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	for _, ext := range []string{".mod", ".zip", ".info"} {
+		assert.False(t, fileExists(path.Join(dir, "example.com/tampered/@v/v1.0.0"+ext)))
+	}
+	// a list would advertise the version
+	assert.False(t, fileExists(path.Join(dir, "example.com/tampered/@v/list")))
+	assert.False(t, fileExists(path.Join(dir, "example.com/tampered/@v/latest")))
+}
+
+func TestChecksumDBMirror(t *testing.T) {
+	p := newTestProxy(t)
+	mods := Modules{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/B", Version: "v1.1.0"},
+	}
+	for _, mod := range mods {
+		p.addModule(t, mod, map[string]string{"go.mod": "module " + mod.Path + "\n"})
+	}
+
+	dir := t.TempDir()
+	db := p.checksumDB(t).WithCache(NewLocalStore(dir), "sumdb")
+	for _, mod := range mods {
+		assert.Nil(t, db.Mirror(context.Background(), mod))
+	}
+	assert.True(t, fileExists(path.Join(dir, "sumdb/sum.example.com/latest")))
+	assert.True(t, fileExists(path.Join(dir, "sumdb/sum.example.com/lookup/example.com/!b@v1.1.0")))
+
+	// verify through the mirror only
+	p.sumDB.Close()
+	srv := httptest.NewServer(NewProxyServer().WithOutputDir(dir))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/sumdb/sum.example.com/supported")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	mirrored, err := NewChecksumDB(p.sumDBVKey + " " + srv.URL + "/sumdb/sum.example.com")
+	assert.Nil(t, err)
+	for _, mod := range mods {
+		h, err := mirrored.lookup(context.Background(), mod.Path, mod.Version)
+		assert.Nil(t, err)
+		assert.Equal(t, p.hashes[mod.String()], h)
+	}
+	_, err = mirrored.lookup(context.Background(), "example.com/missing", "v1.0.0")
+	assert.NotNil(t, err)
+}
+
+func TestChecksumDBCancel(t *testing.T) {
+	p := newTestProxy(t)
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stuck.Close()
+	db, err := NewChecksumDB(p.sumDBVKey + " " + stuck.URL)
+	assert.Nil(t, err)
+	limiter := NewRateLimiter(RateLimits{RequestsPerSecond: 100}, RateLimits{})
+	db.WithRateLimiter(limiter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err = db.Mirror(ctx, Module{Path: "example.com/a", Version: "v1.0.0"})
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
@@ -0,0 +1,196 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// unhealthyAfter is the number of consecutive failures after which an
+	// upstream is skipped when it is allowed to fall back on any error.
+	unhealthyAfter = 3
+
+	// unhealthyCooldown is how long an unhealthy upstream is skipped before it
+	// is tried again.
+	unhealthyCooldown = 30 * time.Second
+)
+
+// Upstreams is a list of proxies to download from, parsed from a GOPROXY-style
+// list like "https://proxy.golang.org,https://artifactory.example.com|https://fallback.example.com".
+// Each upstream is tried in order. After an upstream separated from the next by
+// a comma, the next one is only tried if the module or version was not found
+// (404 or 410). After a pipe, the next one is tried on any error.
+type Upstreams struct {
+	upstreams []*upstream
+	now       func() time.Time
+}
+
+type upstream struct {
+	url             string
+	fallbackOnError bool
+
+	mtx                 sync.Mutex
+	served              int
+	failed              int
+	consecutiveFailures int
+	lastError           string
+	unhealthyUntil      time.Time
+}
+
+// UpstreamHealth is a snapshot of how an upstream has been doing.
+type UpstreamHealth struct {
+	URL                 string
+	Healthy             bool
+	Served              int
+	Failed              int
+	ConsecutiveFailures int
+	LastError           string
+}
+
+// ParseUpstreams parses a GOPROXY-style list. "direct" and "off" are not
+// supported, since files are only ever downloaded from proxies.
+func ParseUpstreams(list string) (*Upstreams, error) {
+	u := &Upstreams{now: time.Now}
+	for list != "" {
+		entry := list
+		fallbackOnError := false
+		if i := strings.IndexAny(list, ",|"); i >= 0 {
+			entry = list[:i]
+			fallbackOnError = list[i] == '|'
+			list = list[i+1:]
+		} else {
+			list = ""
+		}
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+			continue
+		case "direct", "off":
+			return nil, fmt.Errorf("invalid proxy list: %q is not supported", entry)
+		}
+		if !strings.HasPrefix(entry, "http://") && !strings.HasPrefix(entry, "https://") {
+			return nil, fmt.Errorf("invalid proxy list: %q is not an URL", entry)
+		}
+		u.upstreams = append(u.upstreams, &upstream{url: strings.TrimSuffix(entry, "/"), fallbackOnError: fallbackOnError})
+	}
+	if len(u.upstreams) == 0 {
+		return nil, fmt.Errorf("invalid proxy list: no proxies")
+	}
+	return u, nil
+}
+
+// defaultUpstreams parses GO_PROXY, falling back to proxy.golang.org if it is
+// invalid.
+func defaultUpstreams() *Upstreams {
+	u, err := ParseUpstreams(GO_PROXY)
+	if err != nil {
+		slog.Error("invalid GO_PROXY, using https://proxy.golang.org", "err", err)
+		u, _ = ParseUpstreams("https://proxy.golang.org")
+	}
+	return u
+}
+
+// Health returns the health of every upstream, in the order they are tried.
+func (u *Upstreams) Health() []UpstreamHealth {
+	health := []UpstreamHealth{}
+	for _, up := range u.upstreams {
+		up.mtx.Lock()
+		health = append(health, UpstreamHealth{
+			URL:                 up.url,
+			Healthy:             !u.now().Before(up.unhealthyUntil),
+			Served:              up.served,
+			Failed:              up.failed,
+			ConsecutiveFailures: up.consecutiveFailures,
+			LastError:           up.lastError,
+		})
+		up.mtx.Unlock()
+	}
+	return health
+}
+
+// ServeHTTP serves the health of every upstream as JSON.
+func (u *Upstreams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u.Health())
+}
+
+// do calls fetch with the URL of each upstream in turn until one succeeds or
+// must not be fallen back from, and returns the last error. Unhealthy upstreams
+// which may be fallen back from on any error are skipped, unless they are the
+// last one. Every attempt is recorded in m by fileType.
+func (u *Upstreams) do(ctx context.Context, m *Metrics, fileType string, fetch func(baseURL string) error) error {
+	var err error
+	for i, up := range u.upstreams {
+		last := i == len(u.upstreams)-1
+		if up.fallbackOnError && !last && !up.healthy(u.now()) {
+			slog.Debug("skipping unhealthy upstream", "upstream", up.url)
+			continue
+		}
+
+		err = fetch(up.url)
+		if ctx.Err() != nil {
+			return err
+		}
+		switch {
+		case err == nil:
+			up.record(u.now(), true, nil)
+			m.recordUpstream(up.url, fileType, "served", true)
+			return nil
+		case IsNotFound(err):
+			// a proper answer, the upstream is healthy
+			up.record(u.now(), false, nil)
+			m.recordUpstream(up.url, fileType, "not_found", true)
+		default:
+			healthy := up.record(u.now(), false, err)
+			m.recordUpstream(up.url, fileType, "error", healthy)
+			if !up.fallbackOnError {
+				return err
+			}
+		}
+		if !last {
+			slog.Debug("falling back to next upstream", "upstream", up.url, "err", err)
+		}
+	}
+	return err
+}
+
+func (up *upstream) healthy(now time.Time) bool {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	return !now.Before(up.unhealthyUntil)
+}
+
+// record records the outcome of a request, and reports whether the upstream
+// is still healthy.
+func (up *upstream) record(now time.Time, served bool, err error) bool {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	if err == nil {
+		if served {
+			up.served++
+		}
+		up.consecutiveFailures = 0
+		up.unhealthyUntil = time.Time{}
+		return true
+	}
+	up.failed++
+	up.consecutiveFailures++
+	up.lastError = err.Error()
+	if up.consecutiveFailures >= unhealthyAfter {
+		if now.After(up.unhealthyUntil) {
+			slog.Warn("upstream is unhealthy", "upstream", up.url, "consecutiveFailures", up.consecutiveFailures, "err", err)
+		}
+		up.unhealthyUntil = now.Add(unhealthyCooldown)
+	}
+	return !now.Before(up.unhealthyUntil)
+}
@@ -0,0 +1,95 @@
+package dl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	u, err := ParseUpstreams("https://a.example.com/, https://b.example.com|https://c.example.com")
+	assert.Nil(t, err)
+	urls := []string{}
+	for _, h := range u.Health() {
+		urls = append(urls, h.URL)
+	}
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"}, urls)
+	assert.False(t, u.upstreams[0].fallbackOnError)
+	assert.True(t, u.upstreams[1].fallbackOnError)
+	assert.False(t, u.upstreams[2].fallbackOnError)
+
+	for _, list := range []string{"", ",", "https://a.example.com,direct", "off", "a.example.com"} {
+		_, err := ParseUpstreams(list)
+		assert.NotNil(t, err, list)
+	}
+}
+
+func TestDownloadClientUpstreams(t *testing.T) {
+	secondary := newTestProxy(t)
+	primary := newTestProxy(t)
+	a := Module{Path: "example.com/a", Version: "v1.0.0"}
+	b := Module{Path: "example.com/b", Version: "v1.0.0"}
+	primary.addModule(t, a, map[string]string{"go.mod": "module example.com/a\n"})
+	secondary.addModule(t, b, map[string]string{"go.mod": "module example.com/b\n"})
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	download := func(t *testing.T, list string, mods Modules) (*DownloadClient, *Metrics, Modules) {
+		upstreams, err := ParseUpstreams(list)
+		assert.Nil(t, err)
+		m := NewMetrics()
+		c := NewDownloadClient().
+			WithRequestCapacity(len(mods)).
+			WithPerModuleRetries(0).
+			WithUpstreams(upstreams).
+			WithMetrics(m)
+		return c, m, syncWith(t, c, t.TempDir(), mods)
+	}
+
+	t.Run("comma falls back when not found", func(t *testing.T) {
+		_, m, stored := download(t, primary.proxy.URL+","+secondary.proxy.URL, Modules{a, b})
+		assert.Equal(t, Modules{a, b}, stored)
+
+		out := strings.Builder{}
+		m.WriteTo(&out)
+		metrics := out.String()
+		assert.Contains(t, metrics, `go_index_dl_upstream_requests_total{upstream="`+primary.proxy.URL+`",file=".zip",result="served"} 1`)
+		assert.Contains(t, metrics, `go_index_dl_upstream_requests_total{upstream="`+primary.proxy.URL+`",file="list",result="not_found"} 1`)
+		assert.Contains(t, metrics, `go_index_dl_upstream_requests_total{upstream="`+secondary.proxy.URL+`",file=".zip",result="served"} 1`)
+		assert.Contains(t, metrics, `go_index_dl_upstream_healthy{upstream="`+primary.proxy.URL+`"} 1`)
+	})
+
+	t.Run("comma does not fall back on errors", func(t *testing.T) {
+		c, _, stored := download(t, broken.URL+","+primary.proxy.URL, Modules{a})
+		assert.Len(t, stored, 0)
+		assert.ErrorIs(t, c.FailedModules()[a.String()], ErrTransient)
+	})
+
+	t.Run("pipe falls back on errors", func(t *testing.T) {
+		c, m, stored := download(t, broken.URL+"|"+primary.proxy.URL, Modules{a})
+		assert.Equal(t, Modules{a}, stored)
+
+		// list, .zip and .mod failed, after which the broken upstream is skipped
+		health := c.upstreams.Health()
+		assert.False(t, health[0].Healthy)
+		assert.Equal(t, 3, health[0].Failed)
+		assert.Equal(t, 5, health[1].Served)
+
+		out := strings.Builder{}
+		m.WriteTo(&out)
+		assert.Contains(t, out.String(), `go_index_dl_upstream_healthy{upstream="`+broken.URL+`"} 0`)
+
+		// the health is served next to the metrics
+		rec := httptest.NewRecorder()
+		c.upstreams.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/upstreams", nil))
+		served := []UpstreamHealth{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &served))
+		assert.Equal(t, health, served)
+	})
+}
@@ -1,11 +1,17 @@
 package dl
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
+	"strings"
 	"time"
+
+	"github.com/ncruces/go-strftime"
+	"golang.org/x/mod/module"
 )
 
 func GetEnvOr(env string, fallback string) string {
@@ -15,6 +21,35 @@ func GetEnvOr(env string, fallback string) string {
 	return fallback
 }
 
+// statusError is returned when a server responds with anything but 200 OK.
+type statusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server responded with %v: %v", e.Status, e.Body)
+}
+
+// escapePath case-encodes a module path for use in a proxy URL, see
+// https://go.dev/ref/mod#goproxy-protocol. Invalid paths are returned as-is.
+func escapePath(modPath string) string {
+	if escaped, err := module.EscapePath(modPath); err == nil {
+		return escaped
+	}
+	return modPath
+}
+
+// escapeVersion case-encodes a version for use in a proxy URL. Invalid
+// versions are returned as-is.
+func escapeVersion(version string) string {
+	if escaped, err := module.EscapeVersion(version); err == nil {
+		return escaped
+	}
+	return version
+}
+
 func createDirIfNotExist(dir string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return os.MkdirAll(dir, os.ModePerm)
@@ -22,47 +57,117 @@ func createDirIfNotExist(dir string) error {
 	return nil
 }
 
-func downloadFile(filepath string, url string, tempDir string, skipIfExists bool) error {
-	if skipIfExists && fileExists(filepath) {
-		return nil
+// moduleKey returns the store key of a file in the @v directory of modPath.
+func moduleKey(modPath string, file string) string {
+	return path.Join(modPath, "@v", file)
+}
+
+// proxyPath returns the path of file of modPath relative to the proxy URL,
+// where file is "list", "latest" or a version followed by an extension.
+func proxyPath(modPath string, file string) string {
+	switch file {
+	case "list":
+		return escapePath(modPath) + "/@v/list"
+	case "latest":
+		return escapePath(modPath) + "/@latest"
 	}
+	ext := path.Ext(file)
+	return escapePath(modPath) + "/@v/" + escapeVersion(strings.TrimSuffix(file, ext)) + ext
+}
+
+// verifyFunc checks a fully downloaded temporary file before it is moved into place.
+type verifyFunc func(tmpPath string) error
 
+// fetchFile downloads url into a temporary file in tempDir and returns its path.
+// Nothing is left behind if the download or verify fails.
+func fetchFile(ctx context.Context, client *http.Client, url string, tempDir string, verify verifyFunc) (string, error) {
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", err
+		}
+		return "", &DownloadError{Kind: ErrTransient, URL: url, Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		b, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return "", &DownloadError{Kind: ErrTransient, URL: url, Err: err}
 		}
-		return fmt.Errorf("server responded with %v: %v", resp.Status, string(b))
+		return "", classifyStatus(url, resp, string(b))
 	}
 
 	tmpFile, err := os.CreateTemp(tempDir, "go-index-dl")
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer tmpFile.Close()
-	defer os.Remove(tmpFile.Name())
+
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(tmpFile.Name())
+		}
+	}()
 
 	_, err = io.Copy(tmpFile, resp.Body)
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			return "", err
+		}
+		return "", &DownloadError{Kind: ErrTransient, URL: url, Err: err}
 	}
 
 	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
-		return err
+		return "", err
 	}
 
-	if err := os.Rename(tmpFile.Name(), filepath); err != nil {
-		return err
+	if verify != nil {
+		if err := verify(tmpFile.Name()); err != nil {
+			return "", err
+		}
 	}
 
-	return nil
+	ok = true
+	return tmpFile.Name(), nil
+}
+
+// writeTempFile writes a temporary file in tempDir with write and returns its
+// path. Nothing is left behind if write or verify fails.
+func writeTempFile(tempDir string, write func(w io.Writer) error, verify verifyFunc) (string, error) {
+	tmpFile, err := os.CreateTemp(tempDir, "go-index-dl")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if err := write(tmpFile); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return "", err
+	}
+	if verify != nil {
+		if err := verify(tmpFile.Name()); err != nil {
+			return "", err
+		}
+	}
+
+	ok = true
+	return tmpFile.Name(), nil
 }
 
 func loadMaxTsFromFile(maxTsDir string) (time.Time, error) {
@@ -77,6 +182,11 @@ func loadMaxTsFromFile(maxTsDir string) (time.Time, error) {
 	return ts, nil
 }
 
+func writeMaxTsFile(maxTsDir string, maxTs time.Time) error {
+	ts := strftime.Format("%Y-%m-%dT%H:%M:%S.%fZ", maxTs)
+	return os.WriteFile(maxTsDir, []byte(ts), 0o644)
+}
+
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if err != nil {
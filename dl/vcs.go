@@ -0,0 +1,358 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// VCSSource builds the files of private modules from git repositories, for
+// modules which are not available from any proxy. The repository of module
+// path example.com/org/repo is <root>/example.com/org/repo, with or without a
+// .git suffix, and may be a clone or a bare repository. Modules in
+// subdirectories of a repository are found through the longest path prefix
+// which has a repository, and are versioned by tags like sub/v1.2.3.
+type VCSSource struct {
+	root     string
+	cacheDir string
+
+	mtx   sync.Mutex
+	repos map[string]*sync.Mutex
+}
+
+// vcsModule is where the code of a module lives in a repository.
+type vcsModule struct {
+	// dir is the local clone of the repository.
+	dir string
+
+	// tagPrefix prefixes the version in the tags of the module.
+	tagPrefix string
+
+	// subdirs are the directories which may hold the module, in order of
+	// preference: the major version subdirectory and the module directory.
+	subdirs []string
+
+	pathMajor string
+}
+
+// NewVCSSource finds repositories under root, a directory or a file:// URL.
+// Repositories are cloned into the user cache dir, see WithCacheDir.
+func NewVCSSource(root string) (*VCSSource, error) {
+	root = strings.TrimPrefix(root, "file://")
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return &VCSSource{
+		root:     root,
+		cacheDir: filepath.Join(cacheDir, "go-index-dl", "vcs"),
+		repos:    map[string]*sync.Mutex{},
+	}, nil
+}
+
+// WithCacheDir clones repositories into dir.
+func (v *VCSSource) WithCacheDir(dir string) *VCSSource {
+	v.cacheDir = dir
+	return v
+}
+
+// repoLock returns the lock guarding the clone of the repository at repoPath.
+func (v *VCSSource) repoLock(repoPath string) *sync.Mutex {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	l, ok := v.repos[repoPath]
+	if !ok {
+		l = &sync.Mutex{}
+		v.repos[repoPath] = l
+	}
+	return l
+}
+
+// module finds the repository of modPath and makes sure its clone is up to
+// date, or has version if set.
+func (v *VCSSource) module(ctx context.Context, modPath string, version string) (*vcsModule, error) {
+	if err := module.CheckPath(modPath); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	}
+	pathPrefix, pathMajor, _ := module.SplitPathVersion(modPath)
+
+	for repoPath := modPath; repoPath != "."; repoPath = path.Dir(repoPath) {
+		remote := ""
+		for _, candidate := range []string{repoPath, repoPath + ".git"} {
+			if dir := filepath.Join(v.root, filepath.FromSlash(candidate)); isGitRepo(dir) {
+				remote = dir
+				break
+			}
+		}
+		if remote == "" {
+			continue
+		}
+
+		m := &vcsModule{dir: filepath.Join(v.cacheDir, filepath.FromSlash(repoPath)), pathMajor: pathMajor}
+		prefix := strings.TrimPrefix(strings.TrimPrefix(pathPrefix, repoPath), "/")
+		if prefix != "" {
+			m.tagPrefix = prefix + "/"
+		}
+		if subdir := strings.TrimPrefix(strings.TrimPrefix(modPath, repoPath), "/"); subdir != prefix {
+			m.subdirs = append(m.subdirs, subdir)
+		}
+		m.subdirs = append(m.subdirs, prefix)
+
+		rev := ""
+		if version != "" {
+			rev, _ = m.revision(version)
+		}
+		if err := v.sync(ctx, repoPath, remote, m.dir, rev); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, &DownloadError{Kind: ErrNotFound, URL: "file://" + v.root, Err: fmt.Errorf("no repository for %s", modPath)}
+}
+
+// sync clones remote into dir, or fetches it if rev is not set or not known
+// yet.
+func (v *VCSSource) sync(ctx context.Context, repoPath string, remote string, dir string, rev string) error {
+	l := v.repoLock(repoPath)
+	l.Lock()
+	defer l.Unlock()
+
+	if !isGitRepo(dir) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return err
+		}
+		os.RemoveAll(dir)
+		slog.Debug("cloning", "remote", remote, "dir", dir)
+		_, err := git(ctx, "", "clone", "--quiet", "--no-checkout", remote, dir)
+		return err
+	}
+	if rev != "" {
+		if _, err := git(ctx, dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}"); err == nil {
+			return nil
+		}
+	}
+	slog.Debug("fetching", "remote", remote, "dir", dir)
+	_, err := git(ctx, dir, "fetch", "--quiet", "--tags", "--force", "--prune", "origin", "+refs/heads/*:refs/remotes/origin/*")
+	return err
+}
+
+// isGitRepo reports whether dir is a clone or a bare git repository.
+func isGitRepo(dir string) bool {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	return exists(".git") || (exists("HEAD") && exists("objects"))
+}
+
+// git runs git in dir and returns its output.
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Versions returns the tagged versions of modPath, sorted in semver order.
+func (v *VCSSource) Versions(ctx context.Context, modPath string) ([]string, error) {
+	m, err := v.module(ctx, modPath, "")
+	if err != nil {
+		return nil, err
+	}
+	out, err := git(ctx, m.dir, "tag", "--list", m.tagPrefix+"v*")
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{}
+	for _, tag := range strings.Fields(string(out)) {
+		version := strings.TrimPrefix(tag, m.tagPrefix)
+		if semver.Canonical(version) != version || module.CheckPathMajor(version, m.pathMajor) != nil || module.IsPseudoVersion(version) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return semver.Compare(versions[i], versions[j]) < 0 })
+	return versions, nil
+}
+
+// Latest returns the highest release version of modPath, or the highest
+// pre-release if there are no releases.
+func (v *VCSSource) Latest(ctx context.Context, modPath string) (Module, error) {
+	versions, err := v.Versions(ctx, modPath)
+	if err != nil {
+		return Module{}, err
+	}
+	if len(versions) == 0 {
+		return Module{}, &DownloadError{Kind: ErrNotFound, URL: "file://" + v.root, Err: fmt.Errorf("no versions of %s", modPath)}
+	}
+	latest := versions[len(versions)-1]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if semver.Prerelease(versions[i]) == "" {
+			latest = versions[i]
+			break
+		}
+	}
+	return v.info(ctx, Module{Path: modPath, Version: latest})
+}
+
+// revision returns the git revision of a version of m, either a tag or the
+// commit of a pseudo-version.
+func (m *vcsModule) revision(version string) (string, error) {
+	if module.IsPseudoVersion(version) {
+		return module.PseudoVersionRev(version)
+	}
+	return m.tagPrefix + version, nil
+}
+
+// resolve finds the commit and directory of mod.
+func (v *VCSSource) resolve(ctx context.Context, mod Module) (*vcsModule, string, string, error) {
+	notFound := func(err error) error {
+		return &DownloadError{Kind: ErrNotFound, URL: "file://" + v.root, Err: err}
+	}
+	if err := module.Check(mod.Path, mod.Version); err != nil {
+		return nil, "", "", notFound(err)
+	}
+	if strings.HasSuffix(mod.Version, "+incompatible") {
+		return nil, "", "", notFound(fmt.Errorf("%s: +incompatible versions are not supported", mod))
+	}
+	m, err := v.module(ctx, mod.Path, mod.Version)
+	if err != nil {
+		return nil, "", "", err
+	}
+	rev, err := m.revision(mod.Version)
+	if err != nil {
+		return nil, "", "", notFound(err)
+	}
+	out, err := git(ctx, m.dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return nil, "", "", notFound(fmt.Errorf("%s: unknown revision %s", mod, rev))
+	}
+	commit := strings.TrimSpace(string(out))
+	for _, subdir := range m.subdirs {
+		if _, err := git(ctx, m.dir, "cat-file", "-e", commit+":"+path.Join(subdir, "go.mod")); err == nil {
+			return m, commit, subdir, nil
+		}
+	}
+	if m.pathMajor != "" {
+		return nil, "", "", notFound(fmt.Errorf("%s: no go.mod at %s", mod, rev))
+	}
+	return m, commit, m.subdirs[len(m.subdirs)-1], nil
+}
+
+// info returns mod with the time of its commit.
+func (v *VCSSource) info(ctx context.Context, mod Module) (Module, error) {
+	m, commit, _, err := v.resolve(ctx, mod)
+	if err != nil {
+		return Module{}, err
+	}
+	return m.info(ctx, mod, commit)
+}
+
+func (m *vcsModule) info(ctx context.Context, mod Module, commit string) (Module, error) {
+	out, err := git(ctx, m.dir, "log", "-1", "--format=%cI", commit)
+	if err != nil {
+		return Module{}, err
+	}
+	ts, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+	if err != nil {
+		return Module{}, err
+	}
+	return Module{Path: mod.Path, Version: mod.Version, Timestamp: ts.UTC()}, nil
+}
+
+// fetchFile builds file of modPath, which is "list", "latest" or a version
+// followed by .info, .mod or .zip, into a temporary file in tempDir like the
+// package level fetchFile does.
+func (v *VCSSource) fetchFile(ctx context.Context, modPath string, file string, tempDir string, verify verifyFunc) (string, error) {
+	var write func(w io.Writer) error
+	switch file {
+	case "list":
+		versions, err := v.Versions(ctx, modPath)
+		if err != nil {
+			return "", err
+		}
+		write = func(w io.Writer) error {
+			for _, version := range versions {
+				if _, err := fmt.Fprintln(w, version); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case "latest":
+		latest, err := v.Latest(ctx, modPath)
+		if err != nil {
+			return "", err
+		}
+		write = func(w io.Writer) error { return writeVCSInfo(w, latest) }
+	default:
+		ext := path.Ext(file)
+		mod := Module{Path: modPath, Version: strings.TrimSuffix(file, ext)}
+		m, commit, subdir, err := v.resolve(ctx, mod)
+		if err != nil {
+			return "", err
+		}
+		switch ext {
+		case ".info":
+			info, err := m.info(ctx, mod, commit)
+			if err != nil {
+				return "", err
+			}
+			write = func(w io.Writer) error { return writeVCSInfo(w, info) }
+		case ".mod":
+			data, err := git(ctx, m.dir, "show", commit+":"+path.Join(subdir, "go.mod"))
+			if err != nil {
+				// modules without a go.mod get a synthesized one, like from the go command
+				data = []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(modPath)))
+			}
+			write = func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}
+		case ".zip":
+			write = func(w io.Writer) error {
+				return modzip.CreateFromVCS(w, module.Version{Path: mod.Path, Version: mod.Version}, m.dir, commit, subdir)
+			}
+		default:
+			return "", &DownloadError{Kind: ErrNotFound, URL: "file://" + v.root, Err: fmt.Errorf("unknown file %s", file)}
+		}
+	}
+	return writeTempFile(tempDir, write, verify)
+}
+
+func writeVCSInfo(w io.Writer, m Module) error {
+	return json.NewEncoder(w).Encode(struct {
+		Version string
+		Time    time.Time
+	}{m.Version, m.Timestamp})
+}
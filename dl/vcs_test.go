@@ -0,0 +1,158 @@
+package dl
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"praktiskt/go-index-dl/utils"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE=2024-01-02T03:04:05Z", "GIT_AUTHOR_DATE=2024-01-02T03:04:05Z")
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// newTestRepos creates example.com/private/repo with tags v1.0.0 and v1.1.0-rc.1,
+// and the module example.com/private/repo/sub tagged sub/v0.1.0.
+func newTestRepos(t *testing.T) string {
+	root := t.TempDir()
+	dir := filepath.Join(root, "example.com", "private", "repo")
+	assert.Nil(t, os.MkdirAll(dir, 0o755))
+	runGit(t, dir, "init", "--quiet")
+	writeTestFiles(t, dir, map[string]string{
+		"go.mod":     "module example.com/private/repo\n\nrequire example.com/private/repo/sub v0.1.0\n",
+		"repo.go":    "package repo\n",
+		"sub/go.mod": "module example.com/private/repo/sub\n",
+		"sub/sub.go": "package sub\n",
+	})
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "--quiet", "-m", "initial")
+	runGit(t, dir, "tag", "v1.0.0")
+	runGit(t, dir, "tag", "sub/v0.1.0")
+	writeTestFiles(t, dir, map[string]string{"next.go": "package repo\n"})
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "--quiet", "-m", "next")
+	runGit(t, dir, "tag", "v1.1.0-rc.1")
+	return root
+}
+
+func TestVCSSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := newTestRepos(t)
+	vcs, err := NewVCSSource("file://" + root)
+	assert.Nil(t, err)
+	vcs.WithCacheDir(t.TempDir())
+	ctx := context.Background()
+
+	versions, err := vcs.Versions(ctx, "example.com/private/repo")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v1.0.0", "v1.1.0-rc.1"}, versions)
+
+	versions, err = vcs.Versions(ctx, "example.com/private/repo/sub")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v0.1.0"}, versions)
+
+	latest, err := vcs.Latest(ctx, "example.com/private/repo")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.0.0", latest.Version)
+	assert.Equal(t, "2024-01-02T03:04:05Z", latest.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+
+	_, err = vcs.Versions(ctx, "example.com/private/other")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = vcs.fetchFile(ctx, "example.com/private/repo", "v9.9.9.zip", t.TempDir(), nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the root module does not contain the nested sub module
+	tmpPath, err := vcs.fetchFile(ctx, "example.com/private/repo", "v1.0.0.zip", t.TempDir(), nil)
+	assert.Nil(t, err)
+	_, err = modzip.CheckZip(module.Version{Path: "example.com/private/repo", Version: "v1.0.0"}, tmpPath)
+	assert.Nil(t, err)
+	files := readZipFiles(t, tmpPath)
+	assert.ElementsMatch(t, []string{"example.com/private/repo@v1.0.0/go.mod", "example.com/private/repo@v1.0.0/repo.go"}, files)
+
+	tmpPath, err = vcs.fetchFile(ctx, "example.com/private/repo/sub", "v0.1.0.zip", t.TempDir(), nil)
+	assert.Nil(t, err)
+	files = readZipFiles(t, tmpPath)
+	assert.ElementsMatch(t, []string{"example.com/private/repo/sub@v0.1.0/go.mod", "example.com/private/repo/sub@v0.1.0/sub.go"}, files)
+
+	// pseudo-versions are resolved by their commit
+	commit := runGit(t, filepath.Join(root, "example.com", "private", "repo"), "rev-parse", "HEAD")
+	pseudo := "v1.1.0-rc.1.0.20240102030405-" + commit[:12]
+	tmpPath, err = vcs.fetchFile(ctx, "example.com/private/repo", pseudo+".info", t.TempDir(), nil)
+	assert.Nil(t, err)
+	info := Module{}
+	data, err := os.ReadFile(tmpPath)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(data, &info))
+	assert.Equal(t, pseudo, info.Version)
+}
+
+func TestDownloadClientPrivateModules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := newTestRepos(t)
+	vcs, err := NewVCSSource(root)
+	assert.Nil(t, err)
+	vcs.WithCacheDir(t.TempDir())
+
+	// private modules must never be requested from upstream
+	upstreamRequests := utils.NewConcurrentCounter[int]()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Increment()
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+	upstreams, err := ParseUpstreams(upstream.URL)
+	assert.Nil(t, err)
+
+	p := newTestProxy(t)
+	dir := t.TempDir()
+	c := NewDownloadClient().
+		WithRequestCapacity(2).
+		WithPerModuleRetries(0).
+		WithUpstreams(upstreams).
+		WithChecksumDB(p.checksumDB(t)).
+		WithPrivateModules("example.com/private", vcs)
+	stored := syncWith(t, c, dir, Modules{{Path: "example.com/private/repo", Version: "v1.0.0"}})
+	assert.Len(t, c.FailedModules(), 0)
+	assert.Equal(t, 0, upstreamRequests.Value())
+
+	// the requirement is built as well, in the same layout as downloads
+	assert.Equal(t, Modules{{Path: "example.com/private/repo", Version: "v1.0.0"}, {Path: "example.com/private/repo/sub", Version: "v0.1.0"}}, stored)
+	list, err := os.ReadFile(path.Join(dir, "example.com/private/repo/@v/list"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.0.0\nv1.1.0-rc.1\n", string(list))
+	assert.True(t, fileExists(path.Join(dir, "example.com/private/repo/@v/latest")))
+	assert.True(t, fileExists(path.Join(dir, "example.com/private/repo/sub/@v/v0.1.0.zip")))
+}
+
+func readZipFiles(t *testing.T, zipPath string) []string {
+	r, err := zip.OpenReader(zipPath)
+	assert.Nil(t, err)
+	defer r.Close()
+	names := []string{}
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
@@ -0,0 +1,512 @@
+package dl
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+	"golang.org/x/sync/errgroup"
+)
+
+type VerifyProblem string
+
+const (
+	VerifyProblemMissing      = "missing"
+	VerifyProblemTruncated    = "truncated"
+	VerifyProblemInvalid      = "invalid"
+	VerifyProblemHashMismatch = "hash_mismatch"
+)
+
+// VerifyIssue is a problem with one file of the mirror.
+type VerifyIssue struct {
+	Path string
+
+	// Version is empty for the list and latest files of a module.
+	Version string `json:",omitempty"`
+
+	// File is "list", "latest", ".info", ".mod", ".zip" or ".ziphash".
+	File    string
+	Problem VerifyProblem
+	Detail  string `json:",omitempty"`
+}
+
+// VerifyReport is the result of auditing a mirror.
+type VerifyReport struct {
+	Started  time.Time
+	Finished time.Time
+	Modules  int
+	Versions int
+	Issues   []VerifyIssue
+
+	// Repaired lists the path@version of every module version which has been
+	// downloaded again, and RepairFailed the error of those which failed.
+	Repaired     []string          `json:",omitempty"`
+	RepairFailed map[string]string `json:",omitempty"`
+}
+
+// MirrorVerifier audits the module versions in a store: every version with
+// any of its .info, .mod and .zip must have all of them, and every file must
+// be complete, valid and match the hashes recorded for it. The list of a module
+// is upstream's, which includes versions that were never mirrored, so it is
+// only checked for syntax.
+type MirrorVerifier struct {
+	store      Store
+	tempDir    string
+	numWorkers int
+	checksumDB *ChecksumDB
+	stateStore *StateStore
+}
+
+func NewMirrorVerifier(store Store) *MirrorVerifier {
+	return &MirrorVerifier{
+		store:      store,
+		tempDir:    os.TempDir(),
+		numWorkers: 1,
+	}
+}
+
+// WithTempDir sets where zips are copied to for checking, unless the store is
+// a LocalStore.
+func (v *MirrorVerifier) WithTempDir(dir string) *MirrorVerifier {
+	v.tempDir = dir
+	return v
+}
+
+func (v *MirrorVerifier) WithNumWorkers(cnt int) *MirrorVerifier {
+	v.numWorkers = cnt
+	return v
+}
+
+// WithChecksumDB checks the hashes of .mod and .zip files against db as well.
+func (v *MirrorVerifier) WithChecksumDB(db *ChecksumDB) *MirrorVerifier {
+	v.checksumDB = db
+	return v
+}
+
+// WithStateStore checks the hashes of .mod and .zip files against the ones
+// recorded in store when they were downloaded, and resets the state of
+// repaired module versions.
+func (v *MirrorVerifier) WithStateStore(store *StateStore) *MirrorVerifier {
+	v.stateStore = store
+	return v
+}
+
+// storedModule is the files stored for one module path, keyed by the file
+// name below @v/.
+type storedModule struct {
+	path  string
+	files map[string]bool
+}
+
+// Verify audits every module in the store.
+func (v *MirrorVerifier) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{Started: time.Now().UTC(), Issues: []VerifyIssue{}}
+	keys, err := v.store.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	modules := map[string]*storedModule{}
+	for _, key := range keys {
+		i := strings.LastIndex(key, "/@v/")
+		if i < 0 || strings.HasPrefix(key, "sumdb/") || strings.HasPrefix(key, quarantinePrefix+"/") {
+			continue
+		}
+		modPath, file := key[:i], key[i+len("/@v/"):]
+		if modules[modPath] == nil {
+			modules[modPath] = &storedModule{path: modPath, files: map[string]bool{}}
+		}
+		modules[modPath].files[file] = true
+	}
+
+	mtx := sync.Mutex{}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(v.numWorkers, 1))
+	for _, m := range modules {
+		g.Go(func() error {
+			issues, versions, err := v.verifyModule(gctx, m)
+			if err != nil {
+				return err
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			report.Modules++
+			report.Versions += versions
+			report.Issues = append(report.Issues, issues...)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Version != b.Version {
+			return semver.Compare(a.Version, b.Version) < 0
+		}
+		return a.File < b.File
+	})
+	report.Finished = time.Now().UTC()
+	return report, nil
+}
+
+// verifyModule audits the files of one module path, and returns the issues
+// found and the number of versions checked.
+func (v *MirrorVerifier) verifyModule(ctx context.Context, m *storedModule) ([]VerifyIssue, int, error) {
+	issues := []VerifyIssue{}
+	issue := func(version string, file string, problem VerifyProblem, detail string) {
+		issues = append(issues, VerifyIssue{Path: m.path, Version: version, File: file, Problem: problem, Detail: detail})
+	}
+
+	// versions with any file are expected to be complete, since versions with
+	// only some files have been partially written
+	versions := map[string]bool{}
+	for file := range m.files {
+		for _, ext := range []string{".info", ".mod", ".zip"} {
+			if version, ok := strings.CutSuffix(file, ext); ok && semver.IsValid(version) {
+				versions[version] = true
+			}
+		}
+	}
+	if !m.files["list"] {
+		issue("", "list", VerifyProblemMissing, "")
+	} else {
+		data, err := readStoreFile(ctx, v.store, moduleKey(m.path, "list"))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			version := strings.TrimSpace(line)
+			if version == "" {
+				continue
+			}
+			if !semver.IsValid(version) {
+				issue("", "list", VerifyProblemInvalid, "invalid version "+version)
+			}
+		}
+	}
+	if m.files["latest"] {
+		data, err := readStoreFile(ctx, v.store, moduleKey(m.path, "latest"))
+		if err != nil {
+			return nil, 0, err
+		}
+		if problem, detail := checkInfo(data, ""); problem != "" {
+			issue("", "latest", problem, detail)
+		}
+	}
+
+	for version := range versions {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		versionIssues, err := v.verifyVersion(ctx, Module{Path: m.path, Version: version}, m.files)
+		if err != nil {
+			return nil, 0, err
+		}
+		issues = append(issues, versionIssues...)
+	}
+	return issues, len(versions), nil
+}
+
+// verifyVersion audits the .info, .mod and .zip of m.
+func (v *MirrorVerifier) verifyVersion(ctx context.Context, m Module, files map[string]bool) ([]VerifyIssue, error) {
+	issues := []VerifyIssue{}
+	issue := func(file string, problem VerifyProblem, detail string) {
+		issues = append(issues, VerifyIssue{Path: m.Path, Version: m.Version, File: file, Problem: problem, Detail: detail})
+	}
+
+	var recorded map[string]string
+	if v.stateStore != nil {
+		state, found, err := v.stateStore.Get(m)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			recorded = state.Hashes
+		}
+	}
+	checkHash := func(ext string, h string) {
+		if want, ok := recorded[ext]; ok && want != h {
+			issue(ext, VerifyProblemHashMismatch, "recorded "+want+", stored file has "+h)
+			return
+		}
+		if v.checksumDB == nil {
+			return
+		}
+		if err := v.checksumDB.verify(ctx, m, ext, h); errors.Is(err, ErrChecksumMismatch) {
+			issue(ext, VerifyProblemHashMismatch, err.Error())
+		} else if err != nil {
+			slog.Warn("failed to check hash against checksum database", "modPath", m.Path, "modVersion", m.Version, "file", ext, "err", err)
+		}
+	}
+
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if !files[m.Version+ext] {
+			issue(ext, VerifyProblemMissing, "")
+		}
+	}
+
+	if files[m.Version+".info"] {
+		data, err := readStoreFile(ctx, v.store, moduleKey(m.Path, m.Version+".info"))
+		if err != nil {
+			return nil, err
+		}
+		if problem, detail := checkInfo(data, m.Version); problem != "" {
+			issue(".info", problem, detail)
+		}
+	}
+
+	var modData []byte
+	if files[m.Version+".mod"] {
+		data, err := readStoreFile(ctx, v.store, moduleKey(m.Path, m.Version+".mod"))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			issue(".mod", VerifyProblemTruncated, "empty file")
+		} else if f, err := modfile.ParseLax("go.mod", data, nil); err != nil {
+			issue(".mod", VerifyProblemInvalid, err.Error())
+		} else if f.Module == nil || f.Module.Mod.Path != m.Path {
+			issue(".mod", VerifyProblemInvalid, "does not declare module "+m.Path)
+		} else {
+			modData = data
+			h, err := hashMod(data)
+			if err != nil {
+				return nil, err
+			}
+			checkHash(".mod", h)
+		}
+	}
+
+	if files[m.Version+".zip"] {
+		zipIssues, err := v.verifyZip(ctx, m, modData, files[m.Version+".ziphash"], checkHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range zipIssues {
+			issue(i.File, i.Problem, i.Detail)
+		}
+	}
+	return issues, nil
+}
+
+// verifyZip audits the .zip of m, and its .ziphash if it has one. modData is
+// the valid .mod of m, if any.
+func (v *MirrorVerifier) verifyZip(ctx context.Context, m Module, modData []byte, hasZipHash bool, checkHash func(ext string, h string)) ([]VerifyIssue, error) {
+	issues := []VerifyIssue{}
+	issue := func(file string, problem VerifyProblem, detail string) {
+		issues = append(issues, VerifyIssue{File: file, Problem: problem, Detail: detail})
+	}
+
+	zipPath, cleanup, err := v.localFile(ctx, moduleKey(m.Path, m.Version+".zip"))
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// the central directory is at the end of a zip, so truncated zips can not be opened
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		issue(".zip", VerifyProblemTruncated, err.Error())
+		return issues, nil
+	}
+	r.Close()
+	if err := checkZip(m, zipPath); err != nil {
+		issue(".zip", VerifyProblemInvalid, err.Error())
+		return issues, nil
+	}
+	if modData != nil {
+		if err := checkZipGoMod(m, zipPath, modData); err != nil {
+			issue(".zip", VerifyProblemInvalid, err.Error())
+		}
+	}
+
+	h, err := hashZip(zipPath)
+	if err != nil {
+		issue(".zip", VerifyProblemInvalid, err.Error())
+		return issues, nil
+	}
+	if hasZipHash {
+		data, err := readStoreFile(ctx, v.store, moduleKey(m.Path, m.Version+".ziphash"))
+		if err != nil {
+			return nil, err
+		}
+		if want := strings.TrimSpace(string(data)); want != h {
+			issue(".ziphash", VerifyProblemHashMismatch, "recorded "+want+", stored zip has "+h)
+		}
+	}
+	checkHash(".zip", h)
+	return issues, nil
+}
+
+// localFile returns the path of a local copy of key, and a func which removes
+// the copy. Files of a LocalStore are used in place.
+func (v *MirrorVerifier) localFile(ctx context.Context, key string) (string, func(), error) {
+	if s, ok := v.store.(*LocalStore); ok {
+		p, err := s.path(key)
+		return p, func() {}, err
+	}
+	r, err := v.store.Get(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	tmpPath, err := writeTempFile(v.tempDir, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return tmpPath, func() { os.Remove(tmpPath) }, nil
+}
+
+// checkInfo checks a .info or latest file, which must be for version if set.
+func checkInfo(data []byte, version string) (VerifyProblem, string) {
+	if len(data) == 0 {
+		return VerifyProblemTruncated, "empty file"
+	}
+	info := struct {
+		Version string
+		Time    time.Time
+	}{}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return VerifyProblemTruncated, err.Error()
+		}
+		return VerifyProblemInvalid, err.Error()
+	}
+	if !semver.IsValid(info.Version) || (version != "" && info.Version != version) {
+		return VerifyProblemInvalid, "unexpected version " + info.Version
+	}
+	return "", ""
+}
+
+// Repair deletes the broken files of every module with issues in report, and
+// downloads them again with dlc, which must be processing requests. Module
+// versions which were repaired, or failed to be, are recorded in report. Only
+// versions with issues are downloaded, subject to the filter and policies of
+// dlc, so versions these reject are recorded as failed.
+func (v *MirrorVerifier) Repair(ctx context.Context, report *VerifyReport, dlc *DownloadClient) error {
+	broken := map[string]Module{}
+	brokenPaths := map[string]bool{}
+	for _, issue := range report.Issues {
+		if issue.Problem != VerifyProblemMissing {
+			key := moduleKey(issue.Path, issue.Version+issue.File)
+			if issue.Version == "" {
+				key = moduleKey(issue.Path, issue.File)
+			}
+			if err := v.store.Delete(ctx, key); err != nil {
+				return err
+			}
+			// a zip which does not match its .ziphash can not be trusted either
+			if issue.File == ".zip" || issue.File == ".ziphash" {
+				for _, ext := range []string{".zip", ".ziphash"} {
+					if err := v.store.Delete(ctx, moduleKey(issue.Path, issue.Version+ext)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if issue.Version == "" {
+			brokenPaths[issue.Path] = true
+			continue
+		}
+		m := Module{Path: issue.Path, Version: issue.Version}
+		broken[m.String()] = m
+	}
+
+	// the list and latest files are downloaded along with any version
+	for modPath := range brokenPaths {
+		found := false
+		for _, m := range broken {
+			found = found || m.Path == modPath
+		}
+		if found {
+			continue
+		}
+		mods, err := v.storedVersions(ctx, modPath)
+		if err != nil {
+			return err
+		}
+		if len(mods) == 0 {
+			slog.Warn("no version to repair module with", "modPath", modPath)
+			continue
+		}
+		m := mods[len(mods)-1]
+		broken[m.String()] = m
+	}
+
+	mods := Modules{}
+	for _, m := range broken {
+		if v.stateStore != nil {
+			err := v.stateStore.Update(m, func(state *ModuleState) {
+				state.Status = DownloadStatusPending
+				state.Hashes = nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		mods = append(mods, m)
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].String() < mods[j].String() })
+	if len(mods) == 0 {
+		return nil
+	}
+
+	slog.Info("repairing", "modules", len(mods))
+	dlc.EnqueueBatch(ctx, mods)
+	if err := dlc.AwaitInflight(ctx); err != nil {
+		return err
+	}
+	failed := dlc.FailedModules()
+	report.RepairFailed = map[string]string{}
+	for _, m := range mods {
+		if err, ok := failed[m.String()]; ok {
+			report.RepairFailed[m.String()] = err.Error()
+			continue
+		}
+		// versions rejected by the filter or policies of dlc are not downloaded again
+		if !dlc.completedModules.Exists(m.String()) {
+			report.RepairFailed[m.String()] = "skipped by the module filter or download policies"
+			continue
+		}
+		report.Repaired = append(report.Repaired, m.String())
+	}
+	return nil
+}
+
+// storedVersions returns the versions of modPath which have a .info, in
+// semver order.
+func (v *MirrorVerifier) storedVersions(ctx context.Context, modPath string) (Modules, error) {
+	prefix := moduleKey(modPath, "") + "/"
+	keys, err := v.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	mods := Modules{}
+	for _, key := range keys {
+		version, ok := strings.CutSuffix(strings.TrimPrefix(key, prefix), ".info")
+		if ok && !strings.Contains(version, "/") && semver.IsValid(version) {
+			mods = append(mods, Module{Path: modPath, Version: version})
+		}
+	}
+	sort.Slice(mods, func(i, j int) bool { return semver.Compare(mods[i].Version, mods[j].Version) < 0 })
+	return mods, nil
+}
@@ -0,0 +1,100 @@
+package dl
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrorVerifier(t *testing.T) {
+	p := newTestProxy(t)
+	mods := Modules{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/b", Version: "v1.0.0"},
+		{Path: "example.com/c", Version: "v1.0.0"},
+		{Path: "example.com/d", Version: "v1.0.0"},
+	}
+	for _, m := range mods {
+		p.addModule(t, m, map[string]string{"go.mod": "module " + m.Path + "\n", "x.go": "package x\n"})
+	}
+	// upstream has versions which are not mirrored
+	writeTestFiles(t, path.Join(p.dir, "example.com/a/@v"), map[string]string{"list": "v0.9.0\nv1.0.0\nv1.1.0\n"})
+
+	dir := t.TempDir()
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+	newClient := func() *DownloadClient {
+		return NewDownloadClient().
+			WithOutputDir(dir).
+			WithTempDir(path.Join(dir, "tmp")).
+			WithRequestCapacity(len(mods)).
+			WithSkipMaxTsWrite(true).
+			WithStateStore(stateStore)
+	}
+	syncWith(t, newClient(), dir, mods)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	v := NewMirrorVerifier(NewLocalStore(dir)).WithStateStore(stateStore).WithNumWorkers(2)
+	report, err := v.Verify(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Modules)
+	assert.Equal(t, 4, report.Versions)
+	assert.Len(t, report.Issues, 0)
+	b, err := os.ReadFile(path.Join(dir, "example.com/a/@v/list"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v0.9.0\nv1.0.0\nv1.1.0\n", string(b))
+
+	// break the mirror like crashes and bit rot would
+	zipPath := path.Join(dir, "example.com/a/@v/v1.0.0.zip")
+	zipData, err := os.ReadFile(zipPath)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(zipPath, zipData[:len(zipData)/2], 0o644))
+	assert.Nil(t, os.Remove(path.Join(dir, "example.com/b/@v/v1.0.0.mod")))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "example.com/c/@v/v1.0.0.info"), []byte(`{"Version":"v1.0.0","Ti`), 0o644))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "example.com/d/@v/v1.0.0.mod"), []byte("module example.com/d\n\ngo 1.22\n"), 0o644))
+	assert.Nil(t, os.WriteFile(path.Join(dir, "example.com/d/@v/list"), []byte("v1.0.0\nbad\n"), 0o644))
+
+	report, err = v.Verify(ctx)
+	assert.Nil(t, err)
+	issues := []VerifyIssue{}
+	for _, issue := range report.Issues {
+		issue.Detail = ""
+		issues = append(issues, issue)
+	}
+	assert.Equal(t, []VerifyIssue{
+		{Path: "example.com/a", Version: "v1.0.0", File: ".zip", Problem: VerifyProblemTruncated},
+		{Path: "example.com/b", Version: "v1.0.0", File: ".mod", Problem: VerifyProblemMissing},
+		{Path: "example.com/c", Version: "v1.0.0", File: ".info", Problem: VerifyProblemTruncated},
+		{Path: "example.com/d", File: "list", Problem: VerifyProblemInvalid},
+		{Path: "example.com/d", Version: "v1.0.0", File: ".mod", Problem: VerifyProblemHashMismatch},
+		{Path: "example.com/d", Version: "v1.0.0", File: ".zip", Problem: VerifyProblemInvalid},
+	}, issues)
+
+	c := newClient()
+	go c.ProcessIncomingDownloadRequests(ctx)
+	assert.Nil(t, v.Repair(ctx, report, c))
+	assert.Equal(t, []string{"example.com/a@v1.0.0", "example.com/b@v1.0.0", "example.com/c@v1.0.0", "example.com/d@v1.0.0"}, report.Repaired)
+	assert.Len(t, report.RepairFailed, 0)
+
+	report, err = v.Verify(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, report.Issues, 0)
+
+	// versions rejected by the module filter are not downloaded again
+	assert.Nil(t, os.Remove(path.Join(dir, "example.com/b/@v/v1.0.0.mod")))
+	report, err = v.Verify(ctx)
+	assert.Nil(t, err)
+	filter, err := NewModuleFilter([]string{"!example.com/b"})
+	assert.Nil(t, err)
+	c = newClient().WithModuleFilter(filter)
+	go c.ProcessIncomingDownloadRequests(ctx)
+	assert.Nil(t, v.Repair(ctx, report, c))
+	assert.Empty(t, report.Repaired)
+	assert.Contains(t, report.RepairFailed, "example.com/b@v1.0.0")
+	assert.False(t, fileExists(path.Join(dir, "example.com/b/@v/v1.0.0.mod")))
+}
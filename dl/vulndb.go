@@ -0,0 +1,260 @@
+package dl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// vulnDBPrefix is where the vulnerability database is mirrored in the store.
+const vulnDBPrefix = "vulndb"
+
+var vulnIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// vulnDBMeta is index/db.json of a vulnerability database.
+type vulnDBMeta struct {
+	Modified time.Time `json:"modified"`
+}
+
+// vulnIndexEntry is an entry of index/vulns.json of a vulnerability database.
+type vulnIndexEntry struct {
+	ID       string    `json:"id"`
+	Modified time.Time `json:"modified"`
+}
+
+// VulnDBSyncReport describes what a VulnDBMirror.Sync did.
+type VulnDBSyncReport struct {
+	// Modified is when the mirrored database was last modified upstream.
+	Modified time.Time
+
+	// Entries is the number of entries in the database, of which Updated were
+	// downloaded since they were new or modified.
+	Entries int
+	Updated int
+}
+
+// VulnDBMirror mirrors a vulnerability database in the format of
+// https://go.dev/security/vuln/database, e.g. vuln.go.dev, below "vulndb" in a
+// store. Every .json file is stored gzipped as .json.gz as well, like the
+// go command's vulnerability database clients expect when fetching over HTTP.
+type VulnDBMirror struct {
+	upstream   string
+	localDir   string
+	store      Store
+	httpClient *http.Client
+	numWorkers int
+}
+
+// NewVulnDBMirror mirrors the database at upstream, which is an http(s) URL,
+// or a file:// URL or directory holding a copy of a database.
+func NewVulnDBMirror(upstream string, store Store) (*VulnDBMirror, error) {
+	m := &VulnDBMirror{store: store, httpClient: http.DefaultClient, numWorkers: 10}
+	switch {
+	case strings.HasPrefix(upstream, "https://"), strings.HasPrefix(upstream, "http://"):
+		m.upstream = strings.TrimSuffix(upstream, "/")
+	default:
+		dir, err := filepath.Abs(strings.TrimPrefix(upstream, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		m.localDir = dir
+	}
+	return m, nil
+}
+
+// WithRateLimiter limits all requests to upstream with limiter.
+func (m *VulnDBMirror) WithRateLimiter(limiter *RateLimiter) *VulnDBMirror {
+	m.httpClient = limiter.Client()
+	return m
+}
+
+func (m *VulnDBMirror) WithNumWorkers(n int) *VulnDBMirror {
+	m.numWorkers = max(n, 1)
+	return m
+}
+
+// Sync mirrors the entries which are new or modified since the last sync,
+// followed by the index files. Nothing is downloaded but index/db.json if the
+// database has not been modified.
+func (m *VulnDBMirror) Sync(ctx context.Context) (VulnDBSyncReport, error) {
+	report := VulnDBSyncReport{}
+	dbData, err := m.fetch(ctx, "index/db.json")
+	if err != nil {
+		return report, err
+	}
+	upstreamMeta := vulnDBMeta{}
+	if err := json.Unmarshal(dbData, &upstreamMeta); err != nil {
+		return report, fmt.Errorf("failed to parse index/db.json: %w", err)
+	}
+	report.Modified = upstreamMeta.Modified
+
+	localEntries := map[string]time.Time{}
+	if b, err := readStoreFile(ctx, m.store, path.Join(vulnDBPrefix, "index/db.json")); err == nil {
+		localMeta := vulnDBMeta{}
+		if err := json.Unmarshal(b, &localMeta); err == nil && localMeta.Modified.Equal(upstreamMeta.Modified) {
+			slog.Info("vulnerability database is up to date", "modified", localMeta.Modified)
+			return report, nil
+		}
+		if b, err := readStoreFile(ctx, m.store, path.Join(vulnDBPrefix, "index/vulns.json")); err == nil {
+			entries := []vulnIndexEntry{}
+			if err := json.Unmarshal(b, &entries); err == nil {
+				for _, e := range entries {
+					localEntries[e.ID] = e.Modified
+				}
+			}
+		}
+	}
+
+	vulnsData, err := m.fetch(ctx, "index/vulns.json")
+	if err != nil {
+		return report, err
+	}
+	entries := []vulnIndexEntry{}
+	if err := json.Unmarshal(vulnsData, &entries); err != nil {
+		return report, fmt.Errorf("failed to parse index/vulns.json: %w", err)
+	}
+	report.Entries = len(entries)
+
+	// every id is validated before any entry is written
+	updated := []string{}
+	for _, e := range entries {
+		if modified, ok := localEntries[e.ID]; ok && !e.Modified.After(modified) {
+			continue
+		}
+		if !vulnIDRegexp.MatchString(e.ID) {
+			return report, fmt.Errorf("invalid vulnerability id %q", e.ID)
+		}
+		updated = append(updated, e.ID)
+	}
+	report.Updated = len(updated)
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(m.numWorkers)
+	for _, id := range updated {
+		g.Go(func() error {
+			return m.syncEntry(gctx, id)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return report, err
+	}
+
+	modulesData, err := m.fetch(ctx, "index/modules.json")
+	if err != nil {
+		return report, err
+	}
+	if !json.Valid(modulesData) {
+		return report, fmt.Errorf("failed to parse index/modules.json")
+	}
+	// db.json goes last, it marks the mirror as up to date
+	for _, f := range []struct {
+		file string
+		data []byte
+	}{
+		{"index/modules.json", modulesData},
+		{"index/vulns.json", vulnsData},
+		{"index/db.json", dbData},
+	} {
+		if err := m.put(ctx, f.file, f.data); err != nil {
+			return report, err
+		}
+	}
+	slog.Info("mirrored vulnerability database", "modified", report.Modified, "entries", report.Entries, "updated", report.Updated)
+	return report, nil
+}
+
+// syncEntry mirrors the OSV entry of id.
+func (m *VulnDBMirror) syncEntry(ctx context.Context, id string) error {
+	file := "ID/" + id + ".json"
+	data, err := m.fetch(ctx, file)
+	if err != nil {
+		return err
+	}
+	entry := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if entry.ID != id {
+		return fmt.Errorf("%s holds %q", file, entry.ID)
+	}
+	slog.Debug("mirrored vulnerability", "id", id)
+	return m.put(ctx, file, data)
+}
+
+// put stores data as file and file.gz.
+func (m *VulnDBMirror) put(ctx context.Context, file string, data []byte) error {
+	gz := bytes.Buffer{}
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := m.store.Put(ctx, path.Join(vulnDBPrefix, file+".gz"), &gz); err != nil {
+		return err
+	}
+	return m.store.Put(ctx, path.Join(vulnDBPrefix, file), bytes.NewReader(data))
+}
+
+// fetch reads file from upstream.
+func (m *VulnDBMirror) fetch(ctx context.Context, file string) ([]byte, error) {
+	if m.localDir != "" {
+		b, err := os.ReadFile(filepath.Join(m.localDir, filepath.FromSlash(file)))
+		if err != nil && os.IsNotExist(err) {
+			return nil, &DownloadError{Kind: ErrNotFound, URL: file, Err: err}
+		}
+		return b, err
+	}
+
+	url := m.upstream + "/" + file
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, &DownloadError{Kind: ErrTransient, URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &DownloadError{Kind: ErrTransient, URL: url, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, classifyStatus(url, resp, string(b))
+	}
+	return b, nil
+}
+
+// isVulnDBFile reports whether file is part of a vulnerability database.
+func isVulnDBFile(file string) bool {
+	file = strings.TrimSuffix(file, ".gz")
+	switch file {
+	case "index/db.json", "index/modules.json", "index/vulns.json":
+		return true
+	}
+	id, ok := strings.CutPrefix(file, "ID/")
+	id, isJSON := strings.CutSuffix(id, ".json")
+	return ok && isJSON && vulnIDRegexp.MatchString(id)
+}
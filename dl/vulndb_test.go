@@ -0,0 +1,139 @@
+package dl
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testVulnDB is a vulnerability database in a directory.
+type testVulnDB struct {
+	dir     string
+	entries map[string]string
+}
+
+func newTestVulnDB(t *testing.T) *testVulnDB {
+	return &testVulnDB{dir: t.TempDir(), entries: map[string]string{}}
+}
+
+// addEntry adds an entry affecting modPath before fixed, or all versions if
+// fixed is empty, with the OSV fields in extra.
+func (db *testVulnDB) addEntry(t *testing.T, id string, modified time.Time, modPath string, fixed string, extra string) {
+	events := `{"introduced":"0"}`
+	if fixed != "" {
+		events += fmt.Sprintf(`,{"fixed":%q}`, fixed)
+	}
+	db.entries[id] = fmt.Sprintf(`{"schema_version":"1.3.1","id":%q,"modified":%q,"affected":[{"package":{"name":%q,"ecosystem":"Go"},"ranges":[{"type":"SEMVER","events":[%s]}]}]%s}`,
+		id, modified.Format(time.RFC3339), modPath, events, extra)
+	writeTestFiles(t, db.dir, map[string]string{"ID/" + id + ".json": db.entries[id]})
+}
+
+// writeIndex writes the index files of the database, last modified at modified.
+func (db *testVulnDB) writeIndex(t *testing.T, modified time.Time) {
+	vulns := []map[string]any{}
+	modules := map[string][]map[string]any{}
+	for _, entry := range db.entries {
+		osv := struct {
+			ID       string
+			Modified time.Time
+			Affected []struct {
+				Package struct{ Name string }
+			}
+		}{}
+		assert.Nil(t, json.Unmarshal([]byte(entry), &osv))
+		vulns = append(vulns, map[string]any{"id": osv.ID, "modified": osv.Modified})
+		for _, a := range osv.Affected {
+			modules[a.Package.Name] = append(modules[a.Package.Name], map[string]any{"id": osv.ID, "modified": osv.Modified})
+		}
+	}
+	modulesIndex := []map[string]any{}
+	for modPath, vulns := range modules {
+		modulesIndex = append(modulesIndex, map[string]any{"path": modPath, "vulns": vulns})
+	}
+	marshal := func(v any) string {
+		b, err := json.Marshal(v)
+		assert.Nil(t, err)
+		return string(b)
+	}
+	writeTestFiles(t, db.dir, map[string]string{
+		"index/db.json":      marshal(map[string]any{"modified": modified}),
+		"index/vulns.json":   marshal(vulns),
+		"index/modules.json": marshal(modulesIndex),
+	})
+}
+
+func TestVulnDBMirror(t *testing.T) {
+	db := newTestVulnDB(t)
+	modified := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	db.addEntry(t, "GO-2024-0001", modified, "example.com/a", "v1.0.1", "")
+	db.addEntry(t, "GO-2024-0002", modified, "example.com/b", "", "")
+	db.writeIndex(t, modified)
+
+	dir := t.TempDir()
+	mirror, err := NewVulnDBMirror("file://"+db.dir, NewLocalStore(dir))
+	assert.Nil(t, err)
+	report, err := mirror.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, VulnDBSyncReport{Modified: modified, Entries: 2, Updated: 2}, report)
+	for _, file := range []string{"index/db.json", "index/db.json.gz", "index/modules.json", "index/vulns.json.gz", "ID/GO-2024-0001.json", "ID/GO-2024-0002.json.gz"} {
+		assert.True(t, fileExists(path.Join(dir, "vulndb", file)), file)
+	}
+
+	// nothing is downloaded if the database has not been modified
+	report, err = mirror.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, VulnDBSyncReport{Modified: modified}, report)
+
+	// only new and modified entries are downloaded
+	modified = modified.Add(24 * time.Hour)
+	db.addEntry(t, "GO-2024-0002", modified, "example.com/b", "v1.2.0", "")
+	db.addEntry(t, "GO-2024-0003", modified, "example.com/c", "", "")
+	db.writeIndex(t, modified)
+	report, err = mirror.Sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, VulnDBSyncReport{Modified: modified, Entries: 3, Updated: 2}, report)
+	b, err := readStoreFile(context.Background(), NewLocalStore(dir), "vulndb/ID/GO-2024-0002.json")
+	assert.Nil(t, err)
+	assert.Equal(t, db.entries["GO-2024-0002"], string(b))
+
+	// the mirror is served like vuln.go.dev
+	srv := httptest.NewServer(NewProxyServer().WithOutputDir(dir))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/vulndb/ID/GO-2024-0003.json.gz")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	zr, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+	b, err = io.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, db.entries["GO-2024-0003"], string(b))
+	for _, p := range []string{"/vulndb/ID/GO-2024-0004.json", "/vulndb/ID/../index/db.json", "/vulndb/other.json"} {
+		resp, err := http.Get(srv.URL + p)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, p)
+	}
+
+	// nothing is written if any id is invalid
+	modified = modified.Add(24 * time.Hour)
+	db.addEntry(t, "GO-2024-0004", modified, "example.com/d", "", "")
+	db.addEntry(t, "../evil", modified, "example.com/e", "", "")
+	db.writeIndex(t, modified)
+	_, err = mirror.Sync(context.Background())
+	assert.ErrorContains(t, err, `invalid vulnerability id "../evil"`)
+	assert.False(t, fileExists(path.Join(dir, "vulndb/ID/GO-2024-0004.json")))
+
+	// the upstream must be a database
+	_, err = NewVulnDBMirror(path.Join(db.dir, "index/db.json"), NewLocalStore(dir))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,447 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+const (
+	SeverityLow      = "LOW"
+	SeverityModerate = "MODERATE"
+	SeverityHigh     = "HIGH"
+	SeverityCritical = "CRITICAL"
+)
+
+var severityRanks = map[string]int{SeverityLow: 1, SeverityModerate: 2, SeverityHigh: 3, SeverityCritical: 4}
+
+// ParseMinSeverity parses the severity from which a vulnerability is
+// considered, one of low, moderate, high or critical, or "any" which includes
+// vulnerabilities of unknown severity.
+func ParseMinSeverity(s string) (string, error) {
+	s = strings.ToUpper(s)
+	if s == "ANY" {
+		return "", nil
+	}
+	if s == "MEDIUM" {
+		s = SeverityModerate
+	}
+	if _, ok := severityRanks[s]; !ok {
+		return "", fmt.Errorf("unknown severity %q, must be one of any, low, moderate, high or critical", s)
+	}
+	return s, nil
+}
+
+// AtLeast reports whether the severity of v is at least minSeverity, which is
+// always the case for an empty minSeverity.
+func (v Vuln) AtLeast(minSeverity string) bool {
+	return severityRanks[v.Severity] >= severityRanks[minSeverity]
+}
+
+// Vuln is a vulnerability affecting a module version.
+type Vuln struct {
+	ID      string
+	Aliases []string `json:",omitempty"`
+	Summary string   `json:",omitempty"`
+
+	// Severity is one of LOW, MODERATE, HIGH or CRITICAL, or empty if the
+	// database does not know, which is the case for all of vuln.go.dev.
+	Severity string `json:",omitempty"`
+
+	// Fixed is the version fixing the vulnerability, if any.
+	Fixed string `json:",omitempty"`
+}
+
+// osvEntry is the part of an OSV entry, see https://ossf.github.io/osv-schema,
+// needed to tell which module versions it affects.
+type osvEntry struct {
+	ID        string    `json:"id"`
+	Modified  time.Time `json:"modified"`
+	Withdrawn time.Time `json:"withdrawn"`
+	Aliases   []string  `json:"aliases"`
+	Summary   string    `json:"summary"`
+	Severity  []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	Affected []struct {
+		Package struct {
+			Name      string `json:"name"`
+			Ecosystem string `json:"ecosystem"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string `json:"type"`
+			Events []struct {
+				Introduced   string `json:"introduced"`
+				Fixed        string `json:"fixed"`
+				LastAffected string `json:"last_affected"`
+			} `json:"events"`
+		} `json:"ranges"`
+	} `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+// affects reports whether e affects mod, and the version fixing it if any.
+func (e osvEntry) affects(mod Module) (bool, string) {
+	if !e.Withdrawn.IsZero() {
+		return false, ""
+	}
+	for _, a := range e.Affected {
+		if a.Package.Name != mod.Path || a.Package.Ecosystem != "Go" {
+			continue
+		}
+		for _, r := range a.Ranges {
+			if r.Type != "SEMVER" {
+				continue
+			}
+			affected, fixed := false, ""
+			for _, ev := range r.Events {
+				switch {
+				case ev.Introduced != "":
+					if ev.Introduced == "0" || semver.Compare(mod.Version, osvVersion(ev.Introduced)) >= 0 {
+						affected = true
+						fixed = ""
+					}
+				case ev.Fixed != "":
+					if semver.Compare(mod.Version, osvVersion(ev.Fixed)) >= 0 {
+						affected = false
+					} else if fixed == "" {
+						fixed = osvVersion(ev.Fixed)
+					}
+				case ev.LastAffected != "":
+					if semver.Compare(mod.Version, osvVersion(ev.LastAffected)) > 0 {
+						affected = false
+					}
+				}
+			}
+			if affected {
+				return true, fixed
+			}
+		}
+	}
+	return false, ""
+}
+
+// osvVersion turns an OSV SEMVER version like 1.2.3 into a Go version.
+func osvVersion(v string) string {
+	return "v" + strings.TrimPrefix(v, "v")
+}
+
+// severity returns the severity of e from database_specific.severity, as
+// used by GitHub, or from a CVSS v3 vector.
+func (e osvEntry) severity() string {
+	if s := strings.ToUpper(e.DatabaseSpecific.Severity); s != "" {
+		if s == "MEDIUM" {
+			s = SeverityModerate
+		}
+		if _, ok := severityRanks[s]; ok {
+			return s
+		}
+	}
+	for _, s := range e.Severity {
+		if s.Type != "CVSS_V3" {
+			continue
+		}
+		score, err := cvss3BaseScore(s.Score)
+		if err != nil {
+			continue
+		}
+		switch {
+		case score >= 9:
+			return SeverityCritical
+		case score >= 7:
+			return SeverityHigh
+		case score >= 4:
+			return SeverityModerate
+		case score > 0:
+			return SeverityLow
+		}
+	}
+	return ""
+}
+
+// cvss3BaseScore computes the base score of a CVSS v3 vector like
+// CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H, see
+// https://www.first.org/cvss/v3.1/specification-document#7-1-Base-Metrics-Equations.
+func cvss3BaseScore(vector string) (float64, error) {
+	metrics := map[string]string{}
+	parts := strings.Split(vector, "/")
+	if !strings.HasPrefix(parts[0], "CVSS:3.") {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %q", vector)
+	}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, ":")
+		metrics[k] = v
+	}
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C":  {"H": 0.56, "L": 0.22, "N": 0},
+		"I":  {"H": 0.56, "L": 0.22, "N": 0},
+		"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	}
+	w := map[string]float64{}
+	for k, values := range weights {
+		v, ok := values[metrics[k]]
+		if !ok {
+			return 0, fmt.Errorf("invalid CVSS v3 vector %q: bad %s", vector, k)
+		}
+		w[k] = v
+	}
+	changed := metrics["S"] == "C"
+	if !changed && metrics["S"] != "U" {
+		return 0, fmt.Errorf("invalid CVSS v3 vector %q: bad S", vector)
+	}
+	if changed {
+		w["PR"] = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}[metrics["PR"]]
+	}
+
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	if changed {
+		return cvssRoundup(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+	return cvssRoundup(math.Min(impact+exploitability, 10)), nil
+}
+
+// cvssRoundup rounds up to one decimal as defined by CVSS v3.1.
+func cvssRoundup(x float64) float64 {
+	i := int(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+// VulnDB looks up vulnerabilities in a vulnerability database mirrored by
+// VulnDBMirror. It is safe for concurrent use.
+type VulnDB struct {
+	store    Store
+	modified time.Time
+	modules  map[string][]string
+
+	mtx     sync.Mutex
+	entries map[string]osvEntry
+}
+
+// OpenVulnDB opens the vulnerability database mirrored in store.
+func OpenVulnDB(ctx context.Context, store Store) (*VulnDB, error) {
+	b, err := readStoreFile(ctx, store, path.Join(vulnDBPrefix, "index/db.json"))
+	if err != nil {
+		return nil, fmt.Errorf("no vulnerability database is mirrored, see 'sync vulndb': %w", err)
+	}
+	meta := vulnDBMeta{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse index/db.json: %w", err)
+	}
+	b, err = readStoreFile(ctx, store, path.Join(vulnDBPrefix, "index/modules.json"))
+	if err != nil {
+		return nil, err
+	}
+	index := []struct {
+		Path  string `json:"path"`
+		Vulns []struct {
+			ID string `json:"id"`
+		} `json:"vulns"`
+	}{}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index/modules.json: %w", err)
+	}
+	db := &VulnDB{store: store, modified: meta.Modified, modules: map[string][]string{}, entries: map[string]osvEntry{}}
+	for _, m := range index {
+		for _, v := range m.Vulns {
+			db.modules[m.Path] = append(db.modules[m.Path], v.ID)
+		}
+	}
+	return db, nil
+}
+
+// Modified returns when the database was last modified.
+func (db *VulnDB) Modified() time.Time {
+	return db.modified
+}
+
+// Rated reports whether any entry of the database has a severity, which is not
+// the case for vuln.go.dev. Entries are read until a rated one is found.
+func (db *VulnDB) Rated(ctx context.Context) (bool, error) {
+	ids := []string{}
+	for _, modIDs := range db.modules {
+		ids = append(ids, modIDs...)
+	}
+	sort.Strings(ids)
+	for _, id := range slices.Compact(ids) {
+		e, err := db.entry(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if e.severity() != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Vulns returns the vulnerabilities affecting mod, sorted by id.
+func (db *VulnDB) Vulns(ctx context.Context, mod Module) ([]Vuln, error) {
+	vulns := []Vuln{}
+	for _, id := range db.modules[mod.Path] {
+		e, err := db.entry(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if affected, fixed := e.affects(mod); affected {
+			vulns = append(vulns, Vuln{ID: e.ID, Aliases: e.Aliases, Summary: e.Summary, Severity: e.severity(), Fixed: fixed})
+		}
+	}
+	sort.Slice(vulns, func(i, j int) bool { return vulns[i].ID < vulns[j].ID })
+	return vulns, nil
+}
+
+func (db *VulnDB) entry(ctx context.Context, id string) (osvEntry, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if e, ok := db.entries[id]; ok {
+		return e, nil
+	}
+	b, err := readStoreFile(ctx, db.store, path.Join(vulnDBPrefix, "ID", id+".json"))
+	if err != nil {
+		return osvEntry{}, err
+	}
+	e := osvEntry{}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return osvEntry{}, fmt.Errorf("failed to parse %s: %w", id, err)
+	}
+	db.entries[id] = e
+	return e, nil
+}
+
+// VulnIDs returns the ids of vulns.
+func VulnIDs(vulns []Vuln) []string {
+	ids := []string{}
+	for _, v := range vulns {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+// VulnExposure is the exposure of the mirrored versions of a module path to
+// one vulnerability.
+type VulnExposure struct {
+	Vuln
+	Versions []string
+}
+
+// ModuleExposure is the exposure of the mirrored versions of a module path to
+// vulnerabilities.
+type ModuleExposure struct {
+	Path               string
+	Versions           int
+	VulnerableVersions []string
+	LatestVersion      string
+	LatestVulnerable   bool
+	Vulns              []VulnExposure
+}
+
+// VulnReport summarises the exposure of a mirror to vulnerabilities.
+type VulnReport struct {
+	Generated          time.Time
+	DBModified         time.Time
+	Modules            int
+	Versions           int
+	VulnerableModules  int
+	VulnerableVersions int
+	Exposures          []ModuleExposure
+}
+
+// Report looks up every module version in store with a .mod file, and
+// summarises their vulnerabilities by module path, most vulnerable versions
+// first. With a state store, the vulnerabilities of every version are
+// recorded in it as well.
+func (db *VulnDB) Report(ctx context.Context, store Store, stateStore *StateStore) (VulnReport, error) {
+	report := VulnReport{Generated: time.Now().UTC(), DBModified: db.modified}
+	mods, err := ListStoredModules(ctx, store)
+	if err != nil {
+		return report, err
+	}
+	byPath := map[string][]string{}
+	for _, m := range mods {
+		byPath[m.Path] = append(byPath[m.Path], m.Version)
+	}
+	report.Modules = len(byPath)
+	report.Versions = len(mods)
+
+	for modPath, versions := range byPath {
+		semver.Sort(versions)
+		exposure := ModuleExposure{Path: modPath, Versions: len(versions), LatestVersion: latestVersion(versions)}
+		byID := map[string]*VulnExposure{}
+		mods := []Module{}
+		vulnIDs := map[string][]string{}
+		for _, version := range versions {
+			mod := Module{Path: modPath, Version: version}
+			vulns, err := db.Vulns(ctx, mod)
+			if err != nil {
+				return report, err
+			}
+			mods = append(mods, mod)
+			vulnIDs[version] = VulnIDs(vulns)
+			if len(vulns) == 0 {
+				continue
+			}
+			exposure.VulnerableVersions = append(exposure.VulnerableVersions, version)
+			exposure.LatestVulnerable = exposure.LatestVulnerable || version == exposure.LatestVersion
+			for _, v := range vulns {
+				if _, ok := byID[v.ID]; !ok {
+					byID[v.ID] = &VulnExposure{}
+				}
+				// versions are ascending, so the fix is the one of the highest affected version
+				byID[v.ID].Vuln = v
+				byID[v.ID].Versions = append(byID[v.ID].Versions, version)
+			}
+		}
+		if stateStore != nil {
+			// one transaction per module path, rather than an fsync per version
+			err := stateStore.UpdateAll(mods, func(m Module, state *ModuleState) { state.Vulns = vulnIDs[m.Version] })
+			if err != nil {
+				return report, err
+			}
+		}
+		if len(exposure.VulnerableVersions) == 0 {
+			continue
+		}
+		for _, v := range byID {
+			exposure.Vulns = append(exposure.Vulns, *v)
+		}
+		sort.Slice(exposure.Vulns, func(i, j int) bool { return exposure.Vulns[i].ID < exposure.Vulns[j].ID })
+		report.Exposures = append(report.Exposures, exposure)
+		report.VulnerableModules++
+		report.VulnerableVersions += len(exposure.VulnerableVersions)
+	}
+	sort.Slice(report.Exposures, func(i, j int) bool {
+		a, b := report.Exposures[i], report.Exposures[j]
+		if len(a.VulnerableVersions) != len(b.VulnerableVersions) {
+			return len(a.VulnerableVersions) > len(b.VulnerableVersions)
+		}
+		return a.Path < b.Path
+	})
+	return report, nil
+}
@@ -0,0 +1,202 @@
+package dl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestVulnDB mirrors db into the local store at dir and opens it.
+func openTestVulnDB(t *testing.T, db *testVulnDB, dir string) *VulnDB {
+	db.writeIndex(t, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))
+	mirror, err := NewVulnDBMirror(db.dir, NewLocalStore(dir))
+	assert.Nil(t, err)
+	_, err = mirror.Sync(context.Background())
+	assert.Nil(t, err)
+	vulnDB, err := OpenVulnDB(context.Background(), NewLocalStore(dir))
+	assert.Nil(t, err)
+	return vulnDB
+}
+
+func TestCVSS3BaseScore(t *testing.T) {
+	for vector, want := range map[string]float64{
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": 9.8,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H": 10.0,
+		"CVSS:3.0/AV:N/AC:L/PR:N/UI:R/S:U/C:N/I:N/A:H": 6.5,
+		"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:N/I:N/A:N": 0,
+	} {
+		score, err := cvss3BaseScore(vector)
+		assert.Nil(t, err, vector)
+		assert.Equal(t, want, score, vector)
+	}
+	for _, vector := range []string{"CVSS:2.0/AV:N", "CVSS:3.1/AV:N/AC:L", "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:X/C:H/I:H/A:H"} {
+		_, err := cvss3BaseScore(vector)
+		assert.NotNil(t, err, vector)
+	}
+}
+
+func TestParseMinSeverity(t *testing.T) {
+	for s, want := range map[string]string{"any": "", "low": SeverityLow, "Medium": SeverityModerate, "CRITICAL": SeverityCritical} {
+		severity, err := ParseMinSeverity(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, severity, s)
+	}
+	_, err := ParseMinSeverity("severe")
+	assert.NotNil(t, err)
+
+	assert.True(t, Vuln{}.AtLeast(""))
+	assert.False(t, Vuln{}.AtLeast(SeverityLow))
+	assert.True(t, Vuln{Severity: SeverityCritical}.AtLeast(SeverityHigh))
+	assert.False(t, Vuln{Severity: SeverityModerate}.AtLeast(SeverityHigh))
+}
+
+func TestVulnDBVulns(t *testing.T) {
+	db := newTestVulnDB(t)
+	modified := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	db.addEntry(t, "GO-2024-0001", modified, "example.com/a", "1.2.0", `,"aliases":["CVE-2024-0001"],"summary":"bad things"`)
+	db.addEntry(t, "GO-2024-0002", modified, "example.com/a", "", `,"database_specific":{"severity":"CRITICAL"}`)
+	db.addEntry(t, "GO-2024-0003", modified, "example.com/a", "", `,"withdrawn":"2024-01-31T00:00:00Z"`)
+	db.addEntry(t, "GO-2024-0004", modified, "example.com/b", "", `,"severity":[{"type":"CVSS_V3","score":"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:U/C:N/I:N/A:H"}]`)
+	db.entries["GO-2024-0005"] = `{"id":"GO-2024-0005","modified":"2024-01-31T00:00:00Z","affected":[{"package":{"name":"example.com/c","ecosystem":"Go"},"ranges":[{"type":"SEMVER","events":[{"introduced":"1.1.0"},{"fixed":"1.2.0"},{"introduced":"2.0.0"},{"last_affected":"2.0.1"}]}]}]}`
+	writeTestFiles(t, db.dir, map[string]string{"ID/GO-2024-0005.json": db.entries["GO-2024-0005"]})
+	vulnDB := openTestVulnDB(t, db, t.TempDir())
+	assert.Equal(t, modified, vulnDB.Modified())
+
+	ctx := context.Background()
+	vulns, err := vulnDB.Vulns(ctx, Module{Path: "example.com/a", Version: "v1.1.0"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Vuln{
+		{ID: "GO-2024-0001", Aliases: []string{"CVE-2024-0001"}, Summary: "bad things", Fixed: "v1.2.0"},
+		{ID: "GO-2024-0002", Severity: SeverityCritical},
+	}, vulns)
+	vulns, err = vulnDB.Vulns(ctx, Module{Path: "example.com/a", Version: "v1.2.0"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"GO-2024-0002"}, VulnIDs(vulns))
+	vulns, err = vulnDB.Vulns(ctx, Module{Path: "example.com/b", Version: "v0.1.0"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Vuln{{ID: "GO-2024-0004", Severity: SeverityModerate}}, vulns)
+	vulns, err = vulnDB.Vulns(ctx, Module{Path: "example.com/d", Version: "v1.0.0"})
+	assert.Nil(t, err)
+	assert.Empty(t, vulns)
+
+	for version, affected := range map[string]bool{"v1.0.0": false, "v1.1.5": true, "v1.2.0": false, "v2.0.1": true, "v2.0.2": false} {
+		vulns, err := vulnDB.Vulns(ctx, Module{Path: "example.com/c", Version: version})
+		assert.Nil(t, err)
+		assert.Equal(t, affected, len(vulns) == 1, version)
+	}
+
+	rated, err := vulnDB.Rated(ctx)
+	assert.Nil(t, err)
+	assert.True(t, rated)
+
+	_, err = OpenVulnDB(ctx, NewLocalStore(t.TempDir()))
+	assert.NotNil(t, err)
+}
+
+func TestVulnDBRated(t *testing.T) {
+	// like vuln.go.dev, which rates no severities
+	db := newTestVulnDB(t)
+	modified := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	db.addEntry(t, "GO-2024-0001", modified, "example.com/a", "1.2.0", "")
+	db.addEntry(t, "GO-2024-0002", modified, "example.com/b", "", "")
+	rated, err := openTestVulnDB(t, db, t.TempDir()).Rated(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, rated)
+}
+
+func TestVulnDBReport(t *testing.T) {
+	db := newTestVulnDB(t)
+	modified := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	db.addEntry(t, "GO-2024-0001", modified, "example.com/a", "1.1.0", "")
+	db.addEntry(t, "GO-2024-0002", modified, "example.com/b", "", "")
+	db.addEntry(t, "GO-2024-0003", modified, "example.com/b", "1.0.0", "")
+	dir := t.TempDir()
+	vulnDB := openTestVulnDB(t, db, dir)
+	writeTestFiles(t, dir, map[string]string{
+		"example.com/a/@v/v1.0.0.mod": "module example.com/a\n",
+		"example.com/a/@v/v1.1.0.mod": "module example.com/a\n",
+		"example.com/b/@v/v0.1.0.mod": "module example.com/b\n",
+		"example.com/b/@v/v0.2.0.mod": "module example.com/b\n",
+		"example.com/c/@v/v1.0.0.mod": "module example.com/c\n",
+	})
+	stateStore, err := OpenStateStore(path.Join(t.TempDir(), "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+
+	report, err := vulnDB.Report(context.Background(), NewLocalStore(dir), stateStore)
+	assert.Nil(t, err)
+	assert.Equal(t, modified, report.DBModified)
+	assert.Equal(t, 3, report.Modules)
+	assert.Equal(t, 5, report.Versions)
+	assert.Equal(t, 2, report.VulnerableModules)
+	assert.Equal(t, 3, report.VulnerableVersions)
+	assert.Equal(t, []ModuleExposure{
+		{
+			Path: "example.com/b", Versions: 2, VulnerableVersions: []string{"v0.1.0", "v0.2.0"}, LatestVersion: "v0.2.0", LatestVulnerable: true,
+			Vulns: []VulnExposure{
+				{Vuln: Vuln{ID: "GO-2024-0002"}, Versions: []string{"v0.1.0", "v0.2.0"}},
+				{Vuln: Vuln{ID: "GO-2024-0003", Fixed: "v1.0.0"}, Versions: []string{"v0.1.0", "v0.2.0"}},
+			},
+		},
+		{
+			Path: "example.com/a", Versions: 2, VulnerableVersions: []string{"v1.0.0"}, LatestVersion: "v1.1.0",
+			Vulns: []VulnExposure{{Vuln: Vuln{ID: "GO-2024-0001", Fixed: "v1.1.0"}, Versions: []string{"v1.0.0"}}},
+		},
+	}, report.Exposures)
+
+	annotated, err := stateStore.Annotate(Module{Path: "example.com/b", Version: "v0.1.0"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"GO-2024-0002", "GO-2024-0003"}, annotated.Vulns)
+	annotated, err = stateStore.Annotate(Module{Path: "example.com/a", Version: "v1.1.0"})
+	assert.Nil(t, err)
+	assert.Empty(t, annotated.Vulns)
+}
+
+func TestDownloadClientSkipVulnerable(t *testing.T) {
+	p := newTestProxy(t)
+	vulnerable := Module{Path: "example.com/vulnerable", Version: "v1.0.0"}
+	fixed := Module{Path: "example.com/vulnerable", Version: "v1.1.0"}
+	p.addModule(t, vulnerable, map[string]string{"go.mod": "module example.com/vulnerable\n"})
+	p.addModule(t, fixed, map[string]string{"go.mod": "module example.com/vulnerable\n"})
+
+	db := newTestVulnDB(t)
+	modified := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	db.addEntry(t, "GO-2024-0001", modified, "example.com/vulnerable", "1.1.0", `,"database_specific":{"severity":"HIGH"}`)
+	dir := t.TempDir()
+	stateStore, err := OpenStateStore(path.Join(dir, "state.db"))
+	assert.Nil(t, err)
+	defer stateStore.Close()
+	c := NewDownloadClient().
+		WithOutputDir(dir).
+		WithTempDir(path.Join(dir, "tmp")).
+		WithStateStore(stateStore).
+		WithVulnDB(openTestVulnDB(t, db, dir))
+	ctx := context.Background()
+
+	// vulnerabilities below the minimum severity are only recorded
+	c.WithSkipVulnerable(true, SeverityCritical)
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(vulnerable, false, 0)))
+	state, found, err := stateStore.Get(vulnerable)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"GO-2024-0001"}, state.Vulns)
+	assert.Nil(t, os.RemoveAll(path.Join(dir, "example.com")))
+
+	c.WithSkipVulnerable(true, SeverityHigh)
+	err = c.Download(ctx, NewDownloadRequest(vulnerable, false, 0))
+	assert.True(t, errors.Is(err, ErrVulnerable))
+	_, err = os.Stat(path.Join(dir, "example.com/vulnerable/@v/v1.0.0.zip"))
+	assert.True(t, os.IsNotExist(err))
+
+	// required vulnerable versions are downloaded regardless
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(vulnerable, true, 0)))
+	assert.Nil(t, c.Download(ctx, NewDownloadRequest(fixed, false, 0)))
+	stored, err := ListStoredModules(ctx, NewLocalStore(dir))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, Modules{vulnerable, fixed}, stored)
+}
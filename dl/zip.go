@@ -0,0 +1,62 @@
+package dl
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// checkZip checks that the module zip of m at zipPath follows the rules of
+// the go command, see golang.org/x/mod/zip: it is not too large, and every
+// file has a valid path below the <path>@<version>/ prefix.
+func checkZip(m Module, zipPath string) error {
+	cf, err := modzip.CheckZip(module.Version{Path: m.Path, Version: m.Version}, zipPath)
+	if err == nil {
+		err = cf.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidZip, m, err)
+	}
+	return nil
+}
+
+// checkZipGoMod checks that the go.mod in the module zip of m matches modData,
+// the .mod file downloaded separately. Zips without a go.mod must come with a
+// .mod declaring the module path of m, like the one the go command synthesizes.
+func checkZipGoMod(m Module, zipPath string, modData []byte) error {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidZip, m, err)
+	}
+	defer r.Close()
+
+	name := m.Path + "@" + m.Version + "/go.mod"
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidZip, m, err)
+		}
+		defer rc.Close()
+		zipMod, err := io.ReadAll(rc)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidZip, m, err)
+		}
+		if !bytes.Equal(zipMod, modData) {
+			return fmt.Errorf("%w: %s: go.mod in zip does not match .mod", ErrInvalidZip, m)
+		}
+		return nil
+	}
+
+	if modPath := modfile.ModulePath(modData); modPath != m.Path {
+		return fmt.Errorf("%w: %s: zip has no go.mod and .mod declares module %q", ErrInvalidZip, m, modPath)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package dl
+
+import (
+	"archive/zip"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestZip(t *testing.T, files map[string]string) string {
+	zipPath := path.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(zipPath)
+	assert.Nil(t, err)
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		assert.Nil(t, err)
+		_, err = fw.Write([]byte(content))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+	return zipPath
+}
+
+func TestCheckZip(t *testing.T) {
+	m := Module{Path: "example.com/zip", Version: "v1.0.0"}
+	good := writeTestZip(t, map[string]string{
+		"example.com/zip@v1.0.0/go.mod": "module example.com/zip\n",
+		"example.com/zip@v1.0.0/zip.go": "package zip\n",
+	})
+	assert.Nil(t, checkZip(m, good))
+	assert.Nil(t, checkZipGoMod(m, good, []byte("module example.com/zip\n")))
+	assert.ErrorIs(t, checkZipGoMod(m, good, []byte("module example.com/other\n")), ErrInvalidZip)
+
+	outside := writeTestZip(t, map[string]string{
+		"example.com/zip@v1.0.0/go.mod": "module example.com/zip\n",
+		"example.com/other/zip.go":      "package zip\n",
+	})
+	assert.ErrorIs(t, checkZip(m, outside), ErrInvalidZip)
+
+	invalidPath := writeTestZip(t, map[string]string{
+		"example.com/zip@v1.0.0/go.mod": "module example.com/zip\n",
+		"example.com/zip@v1.0.0/a:b.go": "package zip\n",
+	})
+	assert.ErrorIs(t, checkZip(m, invalidPath), ErrInvalidZip)
+
+	notAZip := path.Join(t.TempDir(), "test.zip")
+	assert.Nil(t, os.WriteFile(notAZip, []byte("not a zip"), 0o644))
+	assert.ErrorIs(t, checkZip(m, notAZip), ErrInvalidZip)
+
+	// zips without a go.mod need a .mod for the same module path
+	noGoMod := writeTestZip(t, map[string]string{"example.com/zip@v1.0.0/zip.go": "package zip\n"})
+	assert.Nil(t, checkZipGoMod(m, noGoMod, []byte("module example.com/zip\n")))
+	assert.ErrorIs(t, checkZipGoMod(m, noGoMod, []byte("module example.com/other\n")), ErrInvalidZip)
+}
+
+func TestDownloadClientZipValidation(t *testing.T) {
+	p := newTestProxy(t)
+	good := Module{Path: "example.com/good", Version: "v1.0.0"}
+	p.addModule(t, good, map[string]string{"go.mod": "module example.com/good\n", "good.go": "package good\n"})
+	mismatch := Module{Path: "example.com/mismatch", Version: "v1.0.0"}
+	p.addModule(t, mismatch, map[string]string{"go.mod": "module example.com/mismatch\n"})
+	writeTestFiles(t, p.dir, map[string]string{"example.com/mismatch/@v/v1.0.0.mod": "module example.com/mismatch\n\ngo 1.22\n"})
+
+	dir := t.TempDir()
+	c := NewDownloadClient().WithRequestCapacity(2)
+	stored := syncWith(t, c, dir, Modules{good, mismatch})
+	assert.Equal(t, Modules{good}, stored)
+	zipHash, err := os.ReadFile(path.Join(dir, "example.com/good/@v/v1.0.0.ziphash"))
+	assert.Nil(t, err)
+	assert.Equal(t, p.hashes[good.String()], string(zipHash))
+
+	// invalid zips are not retried, and nothing of the version is stored
+	assert.ErrorIs(t, c.FailedModules()[mismatch.String()], ErrInvalidZip)
+	assert.Equal(t, 2, p.zipFetches.Value())
+	assert.False(t, fileExists(path.Join(dir, "example.com/mismatch/@v/v1.0.0.zip")))
+}
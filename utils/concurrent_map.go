@@ -35,6 +35,13 @@ func (m *ConcurrentMap[A, B]) Delete(k A) {
 	delete(m.m, k)
 }
 
+// Update sets k to the result of fn, which is given the current value of k.
+func (m *ConcurrentMap[A, B]) Update(k A, fn func(v B) B) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.m[k] = fn(m.m[k])
+}
+
 func (m *ConcurrentMap[A, B]) Pop(k A) B {
 	m.l.Lock()
 	defer m.l.Unlock()
@@ -23,6 +23,17 @@ func (m *ConcurrentSet[A]) Set(k A) {
 	m.m[k] = &struct{}{}
 }
 
+// SetIfAbsent sets k unless it is already set, and reports whether it did.
+func (m *ConcurrentSet[A]) SetIfAbsent(k A) bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if _, exists := m.m[k]; exists {
+		return false
+	}
+	m.m[k] = &struct{}{}
+	return true
+}
+
 func (m *ConcurrentSet[A]) Delete(k A) {
 	m.l.Lock()
 	defer m.l.Unlock()